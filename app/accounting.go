@@ -0,0 +1,106 @@
+package app
+
+import (
+	"encoding/json"
+	"ezturp/protocol"
+	"ezturp/tools"
+	"os"
+	"sync"
+	"time"
+)
+
+var audit struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+// OpenAuditLog appends the summary of every closed session to the file at path,
+// one JSON object per line
+func OpenAuditLog(path string) error {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+	if audit.file != nil {
+		_ = audit.file.Close()
+	}
+	audit.file = file
+	return nil
+}
+
+// CloseAuditLog stops writing session summaries
+func CloseAuditLog() error {
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+	if audit.file == nil {
+		return nil
+	}
+	err := audit.file.Close()
+	audit.file = nil
+	return err
+}
+
+func recordSession(logger *tools.Logger, summary SessionSummary) {
+	peer := summary.Peer
+	if peer == "" {
+		peer = summary.Local
+	}
+	logger.Session(summary.Id, peer).Info("closed (%s) : peer %s local %s , %v , in %s out %s",
+		summary.Reason, orDash(summary.Peer), orDash(summary.Local), time.Duration(summary.Duration),
+		protocol.BytesFormat(summary.BytesIn), protocol.BytesFormat(summary.BytesOut))
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+	if audit.file == nil {
+		return
+	}
+	p, _ := json.Marshal(summary)
+	if _, err := audit.file.Write(append(p, '\n')); err != nil {
+		logger.Warn("failed to write the audit log : %v", err)
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// TunnelTotals is the traffic of a tunnel summed over its endpoints. The totals
+// start again from zero when the tunnel is restarted with a changed configuration.
+type TunnelTotals struct {
+	Tunnel   string `json:"tunnel"`
+	Sessions int64  `json:"sessions"`
+	Active   int64  `json:"active"`
+	BytesIn  int64  `json:"bytes_in"`
+	BytesOut int64  `json:"bytes_out"`
+}
+
+// sumTotals adds up metrics per tunnel, in the order the tunnels first appear
+func sumTotals(metrics []Metrics) []TunnelTotals {
+	totals := []TunnelTotals{}
+	index := make(map[string]int)
+	for _, m := range metrics {
+		i, ok := index[m.Tunnel]
+		if !ok {
+			i = len(totals)
+			index[m.Tunnel] = i
+			totals = append(totals, TunnelTotals{Tunnel: m.Tunnel})
+		}
+		t := &totals[i]
+		t.Sessions += m.SessionsOpened
+		t.Active += m.SessionsOpened - m.SessionsClosed
+		t.BytesIn += m.BytesIn
+		t.BytesOut += m.BytesOut
+	}
+	return totals
+}
+
+func logTotals(logger *tools.Logger, totals []TunnelTotals) {
+	for _, t := range totals {
+		logger.Info("tunnel %v : %d sessions , in %s out %s", t.Tunnel, t.Sessions,
+			protocol.BytesFormat(t.BytesIn), protocol.BytesFormat(t.BytesOut))
+	}
+}
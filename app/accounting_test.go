@@ -0,0 +1,72 @@
+package app
+
+import (
+	"encoding/json"
+	"ezturp/tools"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_sumTotals(t *testing.T) {
+	metrics := []Metrics{
+		{Tunnel: "game", Protocol: TCP, SessionsOpened: 3, SessionsClosed: 2, BytesIn: 100, BytesOut: 1000},
+		{Tunnel: "web", Protocol: HTTP, SessionsOpened: 1, SessionsClosed: 1, BytesIn: 5, BytesOut: 50},
+		{Tunnel: "game", Protocol: UDP, SessionsOpened: 2, BytesIn: 10, BytesOut: 20},
+	}
+	want := []TunnelTotals{
+		{Tunnel: "game", Sessions: 5, Active: 3, BytesIn: 110, BytesOut: 1020},
+		{Tunnel: "web", Sessions: 1, Active: 0, BytesIn: 5, BytesOut: 50},
+	}
+	if totals := sumTotals(metrics); !reflect.DeepEqual(totals, want) {
+		t.Errorf("totals %+v, want %+v", totals, want)
+	}
+	if totals := sumTotals(nil); totals == nil || len(totals) != 0 {
+		t.Errorf("totals of nothing %#v, want an empty list", totals)
+	}
+}
+
+func Test_auditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if err := OpenAuditLog(path); err != nil {
+		t.Fatal(err)
+	}
+	defer CloseAuditLog()
+	logger := &tools.Logger{Service: "TcpServer", Name: "web"}
+	m := newMetrics("web", TCP)
+	stat := newSessionStat(m, "10.0.0.1:5000", "")
+	stat.addIn(3)
+	stat.addOut(7)
+	stat.end(logger, 9, CLOSE_PEER)
+	// a session closed from both sides is recorded once
+	stat.end(logger, 9, CLOSE_REMOTE)
+	if err := CloseAuditLog(); err != nil {
+		t.Fatal(err)
+	}
+	newSessionStat(m, "", "127.0.0.1:80").end(logger, 10, CLOSE_IDLE)
+	p, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(p)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("audit log has %d lines : %s", len(lines), p)
+	}
+	var summary SessionSummary
+	if err := json.Unmarshal([]byte(lines[0]), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Tunnel != "web" || summary.Protocol != TCP || summary.Id != 9 || summary.Peer != "10.0.0.1:5000" ||
+		summary.Local != "" || summary.BytesIn != 3 || summary.BytesOut != 7 || summary.Reason != CLOSE_PEER ||
+		summary.End.Before(summary.Start) {
+		t.Errorf("summary %+v", summary)
+	}
+	if strings.Contains(lines[0], `"local"`) {
+		t.Errorf("server summary has a local address : %s", lines[0])
+	}
+	if s := m.Snapshot(); s.SessionsClosed != 2 || s.BytesIn != 3 || s.BytesOut != 7 {
+		t.Errorf("metrics %+v", s)
+	}
+}
@@ -0,0 +1,105 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	UNIX_SCHEME = "unix://"
+)
+
+var unixgramSeq uint32
+
+// splitAddress turns "unix:///path/to.sock" into the unix network matching
+// network ("unix" for tcp, "unixgram" for udp). Other addresses are returned unchanged.
+func splitAddress(network, address string) (string, string) {
+	if !strings.HasPrefix(address, UNIX_SCHEME) {
+		return network, address
+	}
+	path := strings.TrimPrefix(address, UNIX_SCHEME)
+	if network == UDP {
+		return "unixgram", path
+	}
+	return "unix", path
+}
+
+// removeStaleSocket deletes a socket file left behind by a previous run. It
+// fails when something still answers on it.
+func removeStaleSocket(network, path string) error {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	if conn, err := net.DialTimeout(network, path, time.Second); err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("%v is in use", path)
+	}
+	return os.Remove(path)
+}
+
+func listenStream(address string) (net.Listener, error) {
+	network, addr := splitAddress(TCP, address)
+	if network == "unix" {
+		if err := removeStaleSocket(network, addr); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen(network, addr)
+}
+
+func listenPacket(address string) (net.PacketConn, error) {
+	network, addr := splitAddress(UDP, address)
+	if network == "unixgram" {
+		if err := removeStaleSocket(network, addr); err != nil {
+			return nil, err
+		}
+	}
+	return net.ListenPacket(network, addr)
+}
+
+func dialStream(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+	network, addr := splitAddress(TCP, address)
+	dialer := net.Dialer{Timeout: timeout}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// dialPacket connects a datagram socket to address. Unix datagram sockets are
+// bound to a temporary path so that the peer is able to reply.
+func dialPacket(address string) (net.Conn, error) {
+	network, addr := splitAddress(UDP, address)
+	if network != "unixgram" {
+		return net.Dial(network, addr)
+	}
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("ezturp-%d-%d.sock", os.Getpid(), atomic.AddUint32(&unixgramSeq, 1)))
+	conn, err := net.DialUnix(network, &net.UnixAddr{Name: path, Net: network}, &net.UnixAddr{Name: addr, Net: network})
+	if err != nil {
+		return nil, err
+	}
+	return &unixgramConn{UnixConn: conn, path: path}, nil
+}
+
+// replyable reports whether datagrams can be sent back to addr
+func replyable(addr net.Addr) bool {
+	if unixAddr, ok := addr.(*net.UnixAddr); ok {
+		return unixAddr.Name != ""
+	}
+	return addr != nil
+}
+
+type unixgramConn struct {
+	*net.UnixConn
+	path string
+}
+
+func (c *unixgramConn) Close() error {
+	err := c.UnixConn.Close()
+	_ = os.Remove(c.path)
+	return err
+}
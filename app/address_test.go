@@ -0,0 +1,112 @@
+package app
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func Test_splitAddress(t *testing.T) {
+	cases := []struct {
+		network string
+		address string
+		want    [2]string
+	}{
+		{TCP, "127.0.0.1:80", [2]string{TCP, "127.0.0.1:80"}},
+		{UDP, "[::1]:53", [2]string{UDP, "[::1]:53"}},
+		{TCP, "unix:///var/run/docker.sock", [2]string{"unix", "/var/run/docker.sock"}},
+		{UDP, "unix:///tmp/dns.sock", [2]string{"unixgram", "/tmp/dns.sock"}},
+	}
+	for _, c := range cases {
+		if network, address := splitAddress(c.network, c.address); [2]string{network, address} != c.want {
+			t.Errorf("%s %s: got %s %s", c.network, c.address, network, address)
+		}
+	}
+}
+
+func Test_listenStreamStaleSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix sockets are files only on unix")
+	}
+	path := filepath.Join(t.TempDir(), "web.sock")
+	// a socket file left behind by a run that crashed
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	_ = stale.Close()
+	listener, err := listenStream(UNIX_SCHEME + path)
+	if err != nil {
+		t.Fatalf("stale socket not replaced : %v", err)
+	}
+	defer listener.Close()
+	// a socket that still answers is kept
+	if _, err := listenStream(UNIX_SCHEME + path); err == nil {
+		t.Error("listened over a socket in use")
+	}
+	conn, err := dialStream(context.Background(), UNIX_SCHEME+path, time.Second)
+	if err != nil {
+		t.Fatalf("socket in use was removed : %v", err)
+	}
+	_ = conn.Close()
+	// other files are never removed
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenStream(UNIX_SCHEME + file); err == nil {
+		t.Error("listened over a regular file")
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("regular file removed : %v", err)
+	}
+}
+
+func Test_unixgramRoundTrip(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no unix datagram sockets on windows")
+	}
+	path := filepath.Join(t.TempDir(), "dns.sock")
+	server, err := listenPacket(UNIX_SCHEME + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	conn, err := dialPacket(UNIX_SCHEME + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("query")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	_ = server.SetReadDeadline(time.Now().Add(time.Second))
+	n, addr, err := server.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "query" {
+		t.Fatalf("server got %q : %v", buf[:n], err)
+	}
+	if !replyable(addr) {
+		t.Fatalf("cannot reply to %v", addr)
+	}
+	if _, err := server.WriteTo([]byte("answer"), addr); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "answer" {
+		t.Fatalf("client got %q : %v", buf[:n], err)
+	}
+	// the bound path of the client goes with its socket
+	bound := conn.LocalAddr().String()
+	_ = conn.Close()
+	if _, err := os.Stat(bound); !os.IsNotExist(err) {
+		t.Errorf("%v left behind : %v", bound, err)
+	}
+	if replyable(&net.UnixAddr{Net: "unixgram"}) {
+		t.Error("an unbound unix socket is replyable")
+	}
+}
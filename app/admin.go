@@ -0,0 +1,206 @@
+package app
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"ezturp/tools"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	ADMIN_BODY_LIMIT = 1 << 20
+)
+
+// Manager is the part of ClientManager and ServerManager the admin API controls
+type Manager interface {
+	States() []TunnelState
+	Metrics() []Metrics
+	Sessions() []SessionInfo
+	Totals() []TunnelTotals
+	Quotas() []QuotaState
+	Status() Status
+	KillSession(name string, id uint32) error
+	EnableTunnel(name, protocol string) error
+	DisableTunnel(name, protocol string) error
+	RemoveTunnel(name, protocol string) error
+	SetLimits(name, protocol string, limits *Limits) error
+	AddTunnelJson(p []byte) error
+}
+
+// AdminServer serves a JSON API to inspect and control a running manager.
+// Requests carry Token as a bearer token, it may only be left empty on a unix
+// socket address.
+type AdminServer struct {
+	Name    string
+	Token   string
+	Manager Manager
+	logger  tools.Logger
+
+	closeMutex sync.Mutex
+	closed     bool
+	server     *http.Server
+}
+
+func (s *AdminServer) Listen(address string) error {
+	if s.Token == "" && !strings.HasPrefix(address, UNIX_SCHEME) {
+		return errors.New("admin token is required")
+	}
+	listener, err := listenStream(address)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Serve answers admin requests on listener until Close
+func (s *AdminServer) Serve(listener net.Listener) error {
+	s.logger = tools.Logger{Service: "AdminServer", Name: s.Name}
+	server := &http.Server{Handler: s}
+	s.closeMutex.Lock()
+	s.server = server
+	closed := s.closed
+	s.closeMutex.Unlock()
+	if closed {
+		_ = listener.Close()
+		return errors.New("server closed")
+	}
+	s.logger.Info("listen admin connection %v", listener.Addr())
+	err := server.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (s *AdminServer) Close() error {
+	s.closeMutex.Lock()
+	defer s.closeMutex.Unlock()
+	s.closed = true
+	if s.server != nil {
+		return s.server.Close()
+	}
+	return nil
+}
+
+func (s *AdminServer) authorized(req *http.Request) bool {
+	if s.Token == "" {
+		return true
+	}
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) == 1
+}
+
+func (s *AdminServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !s.authorized(req) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJson(w, http.StatusUnauthorized, adminError("unauthorized"))
+		return
+	}
+	path := strings.Trim(req.URL.Path, "/")
+	protocol := req.URL.Query().Get("protocol")
+	switch {
+	case path == "tunnels" && req.Method == http.MethodGet:
+		writeJson(w, http.StatusOK, s.Manager.States())
+	case path == "tunnels" && req.Method == http.MethodPost:
+		p, err := io.ReadAll(io.LimitReader(req.Body, ADMIN_BODY_LIMIT))
+		if err == nil {
+			err = s.Manager.AddTunnelJson(p)
+		}
+		s.reply(w, req, err)
+	case path == "metrics" && req.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := WriteMetrics(w, s.Manager.Metrics()); err == nil {
+			_ = WriteQuotaMetrics(w, s.Manager.Quotas())
+		}
+	case path == "totals" && req.Method == http.MethodGet:
+		writeJson(w, http.StatusOK, s.Manager.Totals())
+	case path == "levels" && req.Method == http.MethodPut:
+		p, err := io.ReadAll(io.LimitReader(req.Body, ADMIN_BODY_LIMIT))
+		if err == nil {
+			err = tools.SetLevels(string(p))
+		}
+		s.reply(w, req, err)
+	case path == "status" && req.Method == http.MethodGet:
+		writeJson(w, http.StatusOK, s.Manager.Status())
+	case path == "quotas" && req.Method == http.MethodGet:
+		writeJson(w, http.StatusOK, s.Manager.Quotas())
+	case path == "sessions" && req.Method == http.MethodGet:
+		writeJson(w, http.StatusOK, sessionsOf(s.Manager, req))
+	case strings.HasPrefix(path, "sessions/") && req.Method == http.MethodDelete:
+		id, err := strconv.ParseUint(strings.TrimPrefix(path, "sessions/"), 10, 32)
+		if err != nil {
+			writeJson(w, http.StatusBadRequest, adminError("bad session id"))
+			return
+		}
+		s.reply(w, req, s.Manager.KillSession(req.URL.Query().Get("tunnel"), uint32(id)))
+	case strings.HasPrefix(path, "tunnels/") && strings.HasSuffix(path, "/enable") && req.Method == http.MethodPost:
+		name := strings.TrimSuffix(strings.TrimPrefix(path, "tunnels/"), "/enable")
+		s.reply(w, req, s.Manager.EnableTunnel(name, protocol))
+	case strings.HasPrefix(path, "tunnels/") && strings.HasSuffix(path, "/disable") && req.Method == http.MethodPost:
+		name := strings.TrimSuffix(strings.TrimPrefix(path, "tunnels/"), "/disable")
+		s.reply(w, req, s.Manager.DisableTunnel(name, protocol))
+	case strings.HasPrefix(path, "tunnels/") && strings.HasSuffix(path, "/limits") && req.Method == http.MethodPut:
+		name := strings.TrimSuffix(strings.TrimPrefix(path, "tunnels/"), "/limits")
+		var limits *Limits
+		err := json.NewDecoder(io.LimitReader(req.Body, ADMIN_BODY_LIMIT)).Decode(&limits)
+		if err == nil {
+			err = s.Manager.SetLimits(name, protocol, limits)
+		}
+		s.reply(w, req, err)
+	case strings.HasPrefix(path, "tunnels/") && req.Method == http.MethodDelete:
+		s.reply(w, req, s.Manager.RemoveTunnel(strings.TrimPrefix(path, "tunnels/"), protocol))
+	default:
+		writeJson(w, http.StatusNotFound, adminError("unknown request "+req.Method+" "+req.URL.Path))
+	}
+}
+
+// reply answers a request that changes the manager
+func (s *AdminServer) reply(w http.ResponseWriter, req *http.Request, err error) {
+	if err == nil {
+		s.logger.Info("%s %s from %v", req.Method, req.URL.Path, req.RemoteAddr)
+	}
+	writeReply(w, err)
+}
+
+// writeReply answers ok or the error of a request that changes the manager
+func writeReply(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		writeJson(w, http.StatusOK, map[string]bool{"ok": true})
+	case errors.Is(err, errNotFound):
+		writeJson(w, http.StatusNotFound, adminError(err.Error()))
+	default:
+		writeJson(w, http.StatusBadRequest, adminError(err.Error()))
+	}
+}
+
+// sessionsOf lists the sessions of manager, of the tunnel named by the query if any
+func sessionsOf(manager Manager, req *http.Request) []SessionInfo {
+	sessions := manager.Sessions()
+	if name := req.URL.Query().Get("tunnel"); name != "" {
+		filtered := sessions[:0]
+		for _, session := range sessions {
+			if session.Tunnel == name {
+				filtered = append(filtered, session)
+			}
+		}
+		sessions = filtered
+	}
+	return sessions
+}
+
+func adminError(msg string) map[string]string {
+	return map[string]string{"error": msg}
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
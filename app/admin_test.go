@@ -0,0 +1,104 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// adminManager records the calls that change it, the others are not used
+type adminManager struct {
+	Manager
+	calls []string
+}
+
+func (m *adminManager) States() []TunnelState {
+	return []TunnelState{{Name: "web", Protocol: TCP, State: TUNNEL_RUNNING}}
+}
+
+func (m *adminManager) Sessions() []SessionInfo {
+	return []SessionInfo{{Tunnel: "web", Id: 1}, {Tunnel: "dns", Id: 2}, {Tunnel: "web", Id: 3}}
+}
+
+func (m *adminManager) Metrics() []Metrics {
+	return []Metrics{{Tunnel: "web", Protocol: TCP, SessionsOpened: 5}}
+}
+
+func (m *adminManager) Quotas() []QuotaState {
+	return []QuotaState{{Tunnel: "web", Protocol: TCP, Used: 100}}
+}
+
+func (m *adminManager) KillSession(name string, id uint32) error {
+	m.calls = append(m.calls, fmt.Sprintf("kill %s %d", name, id))
+	if id != 1 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (m *adminManager) DisableTunnel(name, protocol string) error {
+	m.calls = append(m.calls, "disable "+name+" "+protocol)
+	return nil
+}
+
+func (m *adminManager) RemoveTunnel(name, protocol string) error {
+	m.calls = append(m.calls, "remove "+name+" "+protocol)
+	return nil
+}
+
+func Test_adminServer(t *testing.T) {
+	m := &adminManager{}
+	s := &AdminServer{Name: "test", Token: "t0ken", Manager: m}
+	cases := []struct {
+		method string
+		path   string
+		auth   string
+		status int
+		body   string
+	}{
+		{http.MethodGet, "/tunnels", "", 401, "unauthorized"},
+		{http.MethodGet, "/tunnels", "Bearer guess", 401, "unauthorized"},
+		{http.MethodGet, "/tunnels", "t0ken", 401, "unauthorized"},
+		{http.MethodDelete, "/tunnels/web", "Bearer t0ke", 401, "unauthorized"},
+		{http.MethodGet, "/tunnels", "Bearer t0ken", 200, `"name":"web"`},
+		{http.MethodGet, "/sessions?tunnel=web", "Bearer t0ken", 200, `"id":3`},
+		{http.MethodDelete, "/sessions/1?tunnel=web", "Bearer t0ken", 200, `"ok":true`},
+		{http.MethodDelete, "/sessions/9", "Bearer t0ken", 404, "not found"},
+		{http.MethodDelete, "/sessions/x", "Bearer t0ken", 400, "bad session id"},
+		{http.MethodPost, "/tunnels/web/disable?protocol=udp", "Bearer t0ken", 200, `"ok":true`},
+		{http.MethodDelete, "/tunnels/web", "Bearer t0ken", 200, `"ok":true`},
+		{http.MethodPatch, "/tunnels", "Bearer t0ken", 404, "unknown request"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.path, nil)
+		if c.auth != "" {
+			req.Header.Set("Authorization", c.auth)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		if w.Code != c.status || !strings.Contains(w.Body.String(), c.body) {
+			t.Errorf("%s %s: %d %s, want %d with %q", c.method, c.path, w.Code, w.Body, c.status, c.body)
+		}
+		if w.Code == 401 && w.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("%s %s: no bearer challenge", c.method, c.path)
+		}
+	}
+	if sessions := sessionsOf(m, httptest.NewRequest(http.MethodGet, "/sessions?tunnel=dns", nil)); len(sessions) != 1 || sessions[0].Id != 2 {
+		t.Errorf("sessions of dns : %+v", sessions)
+	}
+	// unauthorized requests change nothing
+	want := []string{"kill web 1", "kill  9", "disable web udp", "remove web "}
+	if !reflect.DeepEqual(m.calls, want) {
+		t.Errorf("calls %q, want %q", m.calls, want)
+	}
+}
+
+func Test_adminServerToken(t *testing.T) {
+	s := &AdminServer{Manager: &adminManager{}}
+	if err := s.Listen("127.0.0.1:0"); err == nil || !strings.Contains(err.Error(), "token") {
+		t.Errorf("listened on tcp without a token : %v", err)
+	}
+}
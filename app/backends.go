@@ -0,0 +1,163 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	BALANCE_RANDOM       = "random"
+	BALANCE_LEAST_CONN   = "least_conn"
+	BACKEND_FAIL_TIMEOUT = 10 * time.Second
+)
+
+// backend is one local address of a client tunnel
+type backend struct {
+	address   string
+	conns     int
+	downUntil time.Time
+	unhealthy bool
+}
+
+// backendPool spreads the sessions of a client over its local addresses. A
+// backend that failed is skipped for failTimeout, and one that fails its health
+// checks until it passes again, unless no other backend is left.
+type backendPool struct {
+	balance     string
+	failTimeout time.Duration
+
+	mutex    sync.Mutex
+	backends []*backend
+	next     int
+}
+
+func newBackendPool(addresses []string, balance string, failTimeout time.Duration) (*backendPool, error) {
+	if len(addresses) == 0 {
+		return nil, errors.New("no local address")
+	}
+	switch balance {
+	case "", BALANCE_ROUND_ROBIN, BALANCE_RANDOM, BALANCE_LEAST_CONN:
+	default:
+		return nil, fmt.Errorf("unsupported balance %q", balance)
+	}
+	if failTimeout <= 0 {
+		failTimeout = BACKEND_FAIL_TIMEOUT
+	}
+	p := &backendPool{balance: balance, failTimeout: failTimeout}
+	for _, address := range addresses {
+		p.backends = append(p.backends, &backend{address: address})
+	}
+	return p, nil
+}
+
+// pick chooses a backend that is not in tried, preferring backends that did not fail recently
+func (p *backendPool) pick(tried map[*backend]bool) *backend {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := time.Now()
+	var up, down []*backend
+	for _, b := range p.backends {
+		if tried[b] {
+			continue
+		}
+		if b.unhealthy || now.Before(b.downUntil) {
+			down = append(down, b)
+		} else {
+			up = append(up, b)
+		}
+	}
+	candidates := up
+	if len(candidates) == 0 {
+		candidates = down
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	var chosen *backend
+	switch p.balance {
+	case BALANCE_RANDOM:
+		chosen = candidates[rand.Intn(len(candidates))]
+	case BALANCE_LEAST_CONN:
+		for _, b := range candidates {
+			if chosen == nil || b.conns < chosen.conns {
+				chosen = b
+			}
+		}
+	default:
+		p.next++
+		chosen = candidates[p.next%len(candidates)]
+	}
+	chosen.conns++
+	return chosen
+}
+
+func (p *backendPool) release(b *backend) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	b.conns--
+}
+
+func (p *backendPool) fail(b *backend) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	b.downUntil = time.Now().Add(p.failTimeout)
+}
+
+func (p *backendPool) setHealthy(b *backend, healthy bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	b.unhealthy = !healthy
+}
+
+func (p *backendPool) anyHealthy() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, b := range p.backends {
+		if !b.unhealthy {
+			return true
+		}
+	}
+	return false
+}
+
+// dial connects to a backend with dialFn, trying the next backend when a dial fails
+func (p *backendPool) dial(dialFn func(string) (net.Conn, error)) (*backendConn, error) {
+	tried := make(map[*backend]bool)
+	var err error
+	for {
+		b := p.pick(tried)
+		if b == nil {
+			return nil, err
+		}
+		tried[b] = true
+		var conn net.Conn
+		conn, err = dialFn(b.address)
+		if err == nil {
+			return &backendConn{Conn: conn, pool: p, backend: b}, nil
+		}
+		p.release(b)
+		p.fail(b)
+	}
+}
+
+// backendConn is a connection to a backend, its session count drops when it is closed
+type backendConn struct {
+	net.Conn
+	pool      *backendPool
+	backend   *backend
+	closeOnce sync.Once
+}
+
+func (c *backendConn) Close() error {
+	c.closeOnce.Do(func() { c.pool.release(c.backend) })
+	return c.Conn.Close()
+}
+
+// failed marks the backend as down after the connection broke
+func (c *backendConn) failed() {
+	c.pool.fail(c.backend)
+}
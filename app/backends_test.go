@@ -0,0 +1,136 @@
+package app
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_newBackendPool(t *testing.T) {
+	if _, err := newBackendPool(nil, "", 0); err == nil {
+		t.Error("pool without a local address")
+	}
+	if _, err := newBackendPool([]string{"127.0.0.1:80"}, "fastest", 0); err == nil {
+		t.Error("accepted an unsupported balance")
+	}
+	p, err := newBackendPool([]string{"127.0.0.1:80"}, BALANCE_RANDOM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.failTimeout != BACKEND_FAIL_TIMEOUT {
+		t.Errorf("fail timeout %v, want %v", p.failTimeout, BACKEND_FAIL_TIMEOUT)
+	}
+}
+
+func Test_backendPoolPick(t *testing.T) {
+	addresses := []string{"a", "b", "c"}
+	p, _ := newBackendPool(addresses, BALANCE_ROUND_ROBIN, time.Minute)
+	var picked []string
+	for i := 0; i < 4; i++ {
+		picked = append(picked, p.pick(nil).address)
+	}
+	if want := []string{"b", "c", "a", "b"}; !reflect.DeepEqual(picked, want) {
+		t.Errorf("round robin picked %v, want %v", picked, want)
+	}
+	p, _ = newBackendPool(addresses, BALANCE_LEAST_CONN, time.Minute)
+	a, b := p.pick(nil), p.pick(nil)
+	if c := p.pick(nil); c.address != "c" {
+		t.Errorf("least conn picked %v with c idle", c.address)
+	}
+	p.release(b)
+	if next := p.pick(nil); next != b {
+		t.Errorf("least conn picked %v after b was released", next.address)
+	}
+	// a failed backend is skipped until its fail timeout is over
+	p.fail(a)
+	p.release(a)
+	for i := 0; i < 3; i++ {
+		if next := p.pick(nil); next == a {
+			t.Error("picked a failed backend")
+		}
+	}
+	// unless every other backend was tried
+	tried := map[*backend]bool{p.backends[1]: true, p.backends[2]: true}
+	if next := p.pick(tried); next != a {
+		t.Errorf("picked %v, want the failed backend as the last one left", next)
+	}
+	tried[a] = true
+	if next := p.pick(tried); next != nil {
+		t.Errorf("picked %v after every backend was tried", next.address)
+	}
+}
+
+func Test_backendPoolDial(t *testing.T) {
+	p, _ := newBackendPool([]string{"down", "up"}, BALANCE_ROUND_ROBIN, time.Minute)
+	var dialed []string
+	dial := func(address string) (net.Conn, error) {
+		dialed = append(dialed, address)
+		if address == "down" {
+			return nil, errors.New("refused")
+		}
+		conn, other := net.Pipe()
+		_ = other.Close()
+		return conn, nil
+	}
+	for i := 0; i < 2; i++ {
+		conn, err := p.dial(dial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn.backend.address != "up" {
+			t.Errorf("connected to %v", conn.backend.address)
+		}
+		_ = conn.Close()
+		_ = conn.Close()
+	}
+	// the failed backend is dialed once, then skipped
+	if want := []string{"up", "down", "up"}; !reflect.DeepEqual(dialed, want) {
+		t.Errorf("dialed %v, want %v", dialed, want)
+	}
+	for _, b := range p.backends {
+		if b.conns != 0 {
+			t.Errorf("%v has %d sessions after they were closed", b.address, b.conns)
+		}
+	}
+	p, _ = newBackendPool([]string{"down"}, "", time.Minute)
+	if _, err := p.dial(dial); err == nil {
+		t.Error("dialed without a backend up")
+	}
+}
+func Test_backendHealth(t *testing.T) {
+	pool, err := newBackendPool([]string{"127.0.0.1:1", "127.0.0.1:2"}, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var changes []bool
+	bh, err := newBackendHealth("test", pool, &HealthCheck{Type: TCP, Failures: 1}, func(healthy bool) {
+		changes = append(changes, healthy)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bh.checkers) != 2 {
+		t.Fatalf("%d checkers for 2 backends", len(bh.checkers))
+	}
+	failed := errors.New("refused")
+	bh.checkers[0].record(failed)
+	// sessions go to the backend that is left
+	for i := 0; i < 3; i++ {
+		if b := pool.pick(nil); b.address != "127.0.0.1:2" {
+			t.Errorf("picked unhealthy backend %v", b.address)
+		}
+	}
+	if !bh.Healthy() {
+		t.Error("client unhealthy with a healthy backend")
+	}
+	bh.checkers[1].record(failed)
+	if bh.Healthy() {
+		t.Error("client healthy without a healthy backend")
+	}
+	bh.checkers[1].record(nil)
+	if want := []bool{false, true}; !reflect.DeepEqual(changes, want) {
+		t.Errorf("changes %v, want %v", changes, want)
+	}
+}
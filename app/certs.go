@@ -0,0 +1,151 @@
+package app
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"ezturp/tools"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	CERT_CHECK_INTERVAL = time.Second
+	SELF_SIGNED_VALID   = 10 * 365 * 24 * time.Hour
+)
+
+// TlsConfig enables TLS termination on the external side of a server entry.
+// Without Cert and Key a self-signed certificate is generated at start.
+type TlsConfig struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+// certStore serves the certificate of a tunnel and reloads it when the
+// certificate or key file changes on disk
+type certStore struct {
+	certFile string
+	keyFile  string
+	logger   tools.Logger
+
+	mutex   sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertStore(name string, config *TlsConfig, hosts []string) (*certStore, error) {
+	c := &certStore{
+		certFile: config.Cert,
+		keyFile:  config.Key,
+		logger:   tools.Logger{Service: "CertStore", Name: name},
+	}
+	if c.certFile == "" && c.keyFile == "" {
+		cert, err := selfSignedCert(hosts)
+		if err != nil {
+			return nil, err
+		}
+		c.cert = cert
+		c.logger.Info("generated a self-signed certificate for %v", hosts)
+		return c, nil
+	}
+	if c.certFile == "" || c.keyFile == "" {
+		return nil, errors.New("tls needs both cert and key")
+	}
+	modTime, err := c.fileModTime()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	c.checked = time.Now()
+	return c, nil
+}
+
+func (c *certStore) fileModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (c *certStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.certFile != "" && time.Since(c.checked) >= CERT_CHECK_INTERVAL {
+		c.checked = time.Now()
+		c.reload()
+	}
+	return c.cert, nil
+}
+
+// reload loads the key pair again when the files changed, the old certificate
+// stays in use when the new one cannot be loaded
+func (c *certStore) reload() {
+	modTime, err := c.fileModTime()
+	if err != nil || !modTime.After(c.modTime) {
+		return
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		c.logger.Warn("failed to reload certificate %v : %v", c.certFile, err)
+		return
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	c.logger.Info("reloaded certificate %v", c.certFile)
+}
+
+func (c *certStore) tlsConfig() *tls.Config {
+	return &tls.Config{GetCertificate: c.GetCertificate}
+}
+
+func selfSignedCert(hosts []string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"ezturp"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(SELF_SIGNED_VALID),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
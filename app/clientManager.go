@@ -2,32 +2,103 @@ package app
 
 import (
 	"encoding/json"
+	"errors"
 	"ezturp/tools"
+	"fmt"
+	"time"
 )
 
 const (
-	TCP = "tcp"
-	UDP = "udp"
+	TCP     = "tcp"
+	UDP     = "udp"
+	TCP_UDP = "tcp+udp"
 )
 
 type ClientConfig struct {
-	Name            string `json:"name"`
-	Protocol        string `json:"protocol"`
-	LocalAddress    string `json:"local_address"`
-	InternalAddress string `json:"internal_address"`
+	Name            string         `json:"name"`
+	Protocol        string         `json:"protocol"`
+	LocalAddress    Addresses      `json:"local_address"`
+	LocalPorts      string         `json:"local_ports"`
+	InternalAddress string         `json:"internal_address"`
+	Mtu             int            `json:"mtu"`
+	IdleTimeout     Duration       `json:"idle_timeout"`
+	Key             string         `json:"key"`
+	Secret          string         `json:"secret"`
+	Restart         *RestartPolicy `json:"restart"`
+	ControlAddress  string         `json:"control_address"`
+	Token           string         `json:"token"`
+	RemotePort      int            `json:"remote_port"`
+	HealthCheck     *HealthCheck   `json:"health_check"`
+	Balance         string         `json:"balance"`
+	FailTimeout     Duration       `json:"fail_timeout"`
+	DialTimeout     Duration       `json:"dial_timeout"`
+	PendingLimit    int            `json:"pending_limit"`
+	Limits          *Limits        `json:"limits"`
+	Quota           *Quota         `json:"quota"`
+}
+
+// key identifies the client to the server, the name is used when no key is set
+func (config *ClientConfig) key() string {
+	if config.Key != "" {
+		return config.Key
+	}
+	return config.Name
+}
+
+// half is the tcp or udp part of a tcp+udp entry
+func (config *ClientConfig) half(protocol string) *ClientConfig {
+	c := *config
+	c.Protocol = protocol
+	return &c
+}
+
+// validate reports configuration mistakes before the tunnel of an entry starts
+func (config *ClientConfig) validate() error {
+	switch config.Protocol {
+	case TCP, UDP, TCP_UDP, HTTP, TLS:
+	default:
+		return fmt.Errorf("unsupported protocol %q", config.Protocol)
+	}
+	if len(config.LocalAddress) == 0 {
+		return errors.New("local_address is required")
+	}
+	if config.InternalAddress == "" && config.ControlAddress == "" {
+		return errors.New("internal_address or control_address is required")
+	}
+	if _, err := ParsePortRanges(config.LocalPorts); err != nil {
+		return fmt.Errorf("local_ports: %v", err)
+	}
+	if _, err := newBackendPool(config.LocalAddress, config.Balance, 0); err != nil {
+		return err
+	}
+	if config.HealthCheck != nil {
+		if _, err := newHealthChecker(config.Name, config.LocalAddress[0], config.HealthCheck, nil); err != nil {
+			return err
+		}
+	}
+	if err := config.Limits.validate(false, config.Protocol); err != nil {
+		return err
+	}
+	return config.Quota.validate()
 }
 
 func LoadClientConfigsFromJson(p []byte) []*ClientConfig {
-	var configs []*ClientConfig
-	err := json.Unmarshal(p, &configs)
+	configs, err := ParseClientConfigs(p)
 	if err != nil {
 		panic(err)
 	}
 	return configs
 }
 
+func ParseClientConfigs(p []byte) ([]*ClientConfig, error) {
+	var configs []*ClientConfig
+	err := json.Unmarshal(p, &configs)
+	return configs, err
+}
+
 type ClientManager struct {
 	logger tools.Logger
+	set    entrySet
 }
 
 func StartClientManager(name string, configs []*ClientConfig) *ClientManager {
@@ -35,40 +106,240 @@ func StartClientManager(name string, configs []*ClientConfig) *ClientManager {
 		Service: "ClientManager",
 		Name:    name,
 	}}
+	cm.set.logger = &cm.logger
+	cm.set.role = "client"
+	cm.set.started = time.Now()
 	var cnt int
-	for _, cfg := range configs {
-		switch cfg.Protocol {
-		case UDP:
-			go cm.runUdpClient(cfg)
-		case TCP:
-			go cm.runTcpClient(cfg)
-		default:
-			cm.logger.Error("unsupported protocol %s", cfg.Protocol)
-			panic(cfg.Protocol)
+	_ = cm.set.change(func() error {
+		cm.apply(configs)
+		for _, e := range cm.set.entries {
+			if !e.invalid {
+				cnt++
+			}
 		}
-		cnt++
-	}
+		return nil
+	})
 	cm.logger.Info("client manager started , %d clients running", cnt)
 	return cm
 }
 
-func (cm *ClientManager) runUdpClient(config *ClientConfig) {
-	for {
-		c := &UdpClient{Name: config.Name, LocalAddr: config.LocalAddress}
-		err := c.Connect(config.InternalAddress)
-		if err != nil {
-			cm.logger.Error("udp client %v error: %v ", config.Name, err)
+// Reload replaces the running configuration with configs. Entries are matched
+// by protocol and name: new entries are started, missing ones are stopped and
+// changed ones are restarted, the others keep running undisturbed. When an
+// entry of configs is invalid nothing changes and the error is returned.
+func (cm *ClientManager) Reload(configs []*ClientConfig) error {
+	return cm.set.change(func() error {
+		seen := make(map[string]int)
+		for _, cfg := range configs {
+			if cm.set.unchanged(entryKey(seen, cfg.Protocol, cfg.Name), cfg) != nil {
+				continue
+			}
+			if _, err := cm.prepare(cfg); err != nil {
+				return fmt.Errorf("%s %v: %v", cfg.Protocol, cfg.Name, err)
+			}
+		}
+		added, removed, restarted := cm.apply(configs)
+		cm.logger.Info("configuration reloaded , %d added , %d removed , %d restarted , %d unchanged",
+			added, removed, restarted, len(configs)-added-restarted)
+		return nil
+	})
+}
+
+// AddTunnel starts a tunnel for config next to the running ones
+func (cm *ClientManager) AddTunnel(config *ClientConfig) error {
+	return cm.set.change(func() error {
+		if _, err := cm.set.find(config.Name, config.Protocol); err == nil {
+			return fmt.Errorf("tunnel %s %v already exists", config.Protocol, config.Name)
+		}
+		if _, err := cm.prepare(config); err != nil {
+			return err
 		}
-		cm.logger.Info("udp client %v restart", config.Name)
+		cm.apply(append(cm.configs(), config))
+		cm.logger.Info("%s client %v added", config.Protocol, config.Name)
+		return nil
+	})
+}
+
+// AddTunnelJson starts a tunnel for a configuration entry written in JSON
+func (cm *ClientManager) AddTunnelJson(p []byte) error {
+	var config ClientConfig
+	if err := json.Unmarshal(p, &config); err != nil {
+		return err
 	}
+	return cm.AddTunnel(&config)
 }
-func (cm *ClientManager) runTcpClient(config *ClientConfig) {
-	for {
-		c := &TcpClient{Name: config.Name, LocalAddr: config.LocalAddress}
-		err := c.Connect(config.InternalAddress)
+
+// RemoveTunnel stops the tunnel called name and forgets its entry, protocol
+// may be left empty when no other tunnel has the same name
+func (cm *ClientManager) RemoveTunnel(name, protocol string) error {
+	return cm.set.change(func() error {
+		key, err := cm.set.find(name, protocol)
 		if err != nil {
-			cm.logger.Error("tcp client %v error: %v", config.Name, err)
+			return err
+		}
+		keys, entries := cm.set.without(key)
+		cm.set.replace(keys, entries, nil)
+		return nil
+	})
+}
+
+// EnableTunnel starts a tunnel that was stopped by DisableTunnel
+func (cm *ClientManager) EnableTunnel(name, protocol string) error {
+	return cm.set.setEnabled(name, protocol, true)
+}
+
+// DisableTunnel stops a tunnel and its sessions until EnableTunnel is called.
+// The entry stays in place, a reload keeps it disabled.
+func (cm *ClientManager) DisableTunnel(name, protocol string) error {
+	return cm.set.setEnabled(name, protocol, false)
+}
+
+// SetLimits changes the bandwidth limits of a tunnel and of its running
+// sessions, nil removes them. They hold until the next reload.
+func (cm *ClientManager) SetLimits(name, protocol string, limits *Limits) error {
+	cm.set.mutex.Lock()
+	defer cm.set.mutex.Unlock()
+	key, err := cm.set.find(name, protocol)
+	if err != nil {
+		return err
+	}
+	cfg := *cm.set.entries[key].config.(*ClientConfig)
+	cfg.Limits = limits
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	if cm.set.retune(key, &cfg, limits, cfg.Quota) == nil {
+		return fmt.Errorf("tunnel %q has an invalid configuration", name)
+	}
+	return nil
+}
+
+// Metrics returns the counters of every tunnel
+func (cm *ClientManager) Metrics() []Metrics {
+	return cm.set.snapshot()
+}
+
+// Totals returns the sessions and bytes of every tunnel
+func (cm *ClientManager) Totals() []TunnelTotals {
+	return sumTotals(cm.set.snapshot())
+}
+
+// Status returns the state and traffic of every tunnel
+func (cm *ClientManager) Status() Status {
+	return cm.set.status(cm.logger.Name)
+}
+
+// Quotas returns the quota of every tunnel that has one
+func (cm *ClientManager) Quotas() []QuotaState {
+	return cm.set.quotas()
+}
+
+// Close stops every tunnel, closing their sessions, logs the totals of each
+// tunnel and saves the quota state. The manager cannot be used afterwards.
+func (cm *ClientManager) Close() error {
+	cm.set.close()
+	logTotals(&cm.logger, cm.Totals())
+	return SaveQuotaState()
+}
+
+// Sessions lists the live sessions of every tunnel
+func (cm *ClientManager) Sessions() []SessionInfo {
+	return cm.set.sessions()
+}
+
+// KillSession closes session id of the tunnel called name, of any tunnel when name is empty
+func (cm *ClientManager) KillSession(name string, id uint32) error {
+	return cm.set.killSession(name, id)
+}
+
+func (cm *ClientManager) configs() []*ClientConfig {
+	configs := make([]*ClientConfig, 0, len(cm.set.keys))
+	for _, key := range cm.set.keys {
+		configs = append(configs, cm.set.entries[key].config.(*ClientConfig))
+	}
+	return configs
+}
+
+// apply replaces the entries with configs within a change of the set.
+// Invalid entries are kept as failed tunnels.
+func (cm *ClientManager) apply(configs []*ClientConfig) (added, removed, restarted int) {
+	keys := make([]string, len(configs))
+	next := make(map[string]*entry, len(configs))
+	seen := make(map[string]int)
+	for i, cfg := range configs {
+		keys[i] = entryKey(seen, cfg.Protocol, cfg.Name)
+		e := cm.set.unchanged(keys[i], cfg)
+		if e == nil {
+			e = cm.set.retune(keys[i], cfg, cfg.Limits, cfg.Quota)
+		}
+		if e == nil {
+			var err error
+			e, err = cm.prepare(cfg)
+			if err != nil {
+				e = &entry{kind: "client", start: failed(err), invalid: true}
+			} else {
+				e.limiter.SetQuota(cm.set.quotaKey(keys[i]), cfg.Quota)
+			}
+			e.name, e.protocol, e.config, e.restart = cfg.Name, cfg.Protocol, cfg, cfg.Restart
+		}
+		next[keys[i]] = e
+	}
+	return cm.set.replace(keys, next, nil)
+}
+
+// prepare checks an entry and builds the start function of its tunnel
+func (cm *ClientManager) prepare(cfg *ClientConfig) (*entry, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	e := &entry{limiter: NewLimiter(cfg.Limits)}
+	switch cfg.Protocol {
+	case UDP:
+		e.kind, e.start = "udp client", cm.udpClient(cfg, e.addMetrics(cfg.Name, UDP), e.limiter)
+	case TCP, HTTP, TLS:
+		e.kind, e.start = "tcp client", cm.tcpClient(cfg, e.addMetrics(cfg.Name, cfg.Protocol), e.limiter)
+	case TCP_UDP:
+		e.kind, e.start = "tcp+udp client", together(cm.tcpClient(cfg.half(TCP), e.addMetrics(cfg.Name, TCP), e.limiter),
+			cm.udpClient(cfg.half(UDP), e.addMetrics(cfg.Name, UDP), e.limiter))
+	}
+	return e, nil
+}
+
+// States returns the current state of every tunnel
+func (cm *ClientManager) States() []TunnelState {
+	return cm.set.states()
+}
+
+func (cm *ClientManager) udpClient(config *ClientConfig, metrics *Metrics, limiter *Limiter) func(*group) error {
+	ports, _ := ParsePortRanges(config.LocalPorts)
+	return func(g *group) error {
+		c := &UdpClient{Name: config.Name, Metrics: metrics, Limiter: limiter, LocalAddrs: config.LocalAddress, Mtu: config.Mtu, Idle: time.Duration(config.IdleTimeout),
+			Key: config.Key, Secret: config.Secret, Health: config.HealthCheck, Balance: config.Balance, FailTimeout: time.Duration(config.FailTimeout),
+			LocalPorts: ports}
+		g.add(c)
+		if config.ControlAddress != "" {
+			return runControlled(config, &cm.logger, c, func(addr, secret string) error {
+				c.Secret = secret
+				return c.Connect(addr)
+			})
+		}
+		return c.Connect(config.InternalAddress)
+	}
+}
+
+func (cm *ClientManager) tcpClient(config *ClientConfig, metrics *Metrics, limiter *Limiter) func(*group) error {
+	ports, _ := ParsePortRanges(config.LocalPorts)
+	return func(g *group) error {
+		c := &TcpClient{Name: config.Name, Metrics: metrics, Limiter: limiter, LocalAddrs: config.LocalAddress, Health: config.HealthCheck,
+			Balance: config.Balance, FailTimeout: time.Duration(config.FailTimeout), LocalPorts: ports,
+			DialTimeout: time.Duration(config.DialTimeout), PendingLimit: config.PendingLimit, Secret: config.Secret}
+		g.add(c)
+		if config.ControlAddress != "" {
+			return runControlled(config, &cm.logger, c, func(addr, secret string) error {
+				c.Secret = secret
+				return c.Connect(addr)
+			})
 		}
-		cm.logger.Info("tcp client %v restart", config.Name)
+		return c.Connect(config.InternalAddress)
 	}
 }
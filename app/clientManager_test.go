@@ -0,0 +1,86 @@
+package app
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_reloadDiff(t *testing.T) {
+	web := func(local string, limits *Limits, quota *Quota) *ClientConfig {
+		return &ClientConfig{Name: "web", Protocol: TCP, LocalAddress: Addresses{local},
+			InternalAddress: "127.0.0.1:1", Limits: limits, Quota: quota}
+	}
+	dns := &ClientConfig{Name: "dns", Protocol: UDP, LocalAddress: Addresses{"127.0.0.1:53"}, InternalAddress: "127.0.0.1:1"}
+	ssh := &ClientConfig{Name: "ssh", Protocol: TCP, LocalAddress: Addresses{"127.0.0.1:22"}, InternalAddress: "127.0.0.1:1"}
+	slow := &Limits{Session: &Limit{Upload: 1000}}
+	cases := []struct {
+		name                      string
+		configs                   []*ClientConfig
+		added, removed, restarted int
+		keeps                     bool // the web entry keeps running
+		limits                    Limits
+	}{
+		{"unchanged", []*ClientConfig{web("127.0.0.1:80", nil, nil), dns}, 0, 0, 0, true, Limits{}},
+		{"added", []*ClientConfig{web("127.0.0.1:80", nil, nil), dns, ssh}, 1, 0, 0, true, Limits{}},
+		{"removed", []*ClientConfig{web("127.0.0.1:80", nil, nil)}, 0, 1, 0, true, Limits{}},
+		{"restarted", []*ClientConfig{web("127.0.0.1:8080", nil, nil), dns}, 0, 0, 1, false, Limits{}},
+		{"retuned limits", []*ClientConfig{web("127.0.0.1:80", slow, nil), dns}, 0, 0, 0, true, *slow},
+		{"retuned quota", []*ClientConfig{web("127.0.0.1:80", nil, &Quota{Limit: 1 << 30, Period: QUOTA_DAY}), dns}, 0, 0, 0, true, Limits{}},
+		{"invalid entry", []*ClientConfig{web("", nil, nil), dns}, 0, 0, 1, false, Limits{}},
+	}
+	for _, c := range cases {
+		cm := StartClientManager("test", []*ClientConfig{web("127.0.0.1:80", nil, nil), dns})
+		before := cm.set.entries["tcp/web"]
+		var added, removed, restarted int
+		_ = cm.set.change(func() error {
+			added, removed, restarted = cm.apply(c.configs)
+			return nil
+		})
+		after := cm.set.entries["tcp/web"]
+		if added != c.added || removed != c.removed || restarted != c.restarted {
+			t.Errorf("%s: %d added , %d removed , %d restarted , want %d , %d , %d",
+				c.name, added, removed, restarted, c.added, c.removed, c.restarted)
+		}
+		if (before == after) != c.keeps {
+			t.Errorf("%s: web entry kept = %v", c.name, before == after)
+		}
+		if after.limiter != nil && !reflect.DeepEqual(after.limiter.limits, c.limits) {
+			t.Errorf("%s: limits %+v, want %+v", c.name, after.limiter.limits, c.limits)
+		}
+		if after.limiter != nil && after.limiter.quota != c.configs[0].Quota {
+			t.Errorf("%s: quota %+v, want %+v", c.name, after.limiter.quota, c.configs[0].Quota)
+		}
+		_ = cm.Close()
+	}
+}
+
+func Test_clientConfigValidate(t *testing.T) {
+	entry := func(protocol string, edit func(*ClientConfig)) *ClientConfig {
+		c := &ClientConfig{Name: "test", Protocol: protocol, LocalAddress: Addresses{"127.0.0.1:27015"}, InternalAddress: "127.0.0.1:9000"}
+		if edit != nil {
+			edit(c)
+		}
+		return c
+	}
+	cases := []struct {
+		name   string
+		config *ClientConfig
+		err    string
+	}{
+		{"tcp+udp", entry(TCP_UDP, nil), ""},
+		{"controlled", entry(UDP, func(c *ClientConfig) { c.InternalAddress = ""; c.ControlAddress = "127.0.0.1:7000" }), ""},
+		{"unknown protocol", entry("quic", nil), "unsupported protocol"},
+		{"no local address", entry(TCP_UDP, func(c *ClientConfig) { c.LocalAddress = nil }), "local_address"},
+		{"no server", entry(TCP, func(c *ClientConfig) { c.InternalAddress = "" }), "internal_address or control_address"},
+		{"bad port range", entry(TCP_UDP, func(c *ClientConfig) { c.LocalPorts = "a-b" }), "local_ports"},
+		{"bad balance", entry(TCP, func(c *ClientConfig) { c.Balance = "fastest" }), "balance"},
+		{"bad health check", entry(TCP, func(c *ClientConfig) { c.HealthCheck = &HealthCheck{Type: "icmp"} }), "health check"},
+	}
+	for _, c := range cases {
+		err := c.config.validate()
+		if c.err == "" && err != nil || c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("%s: error %v, want %q", c.name, err, c.err)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package app
+
+import (
+	"encoding/json"
+	"ezturp/tools"
+	"fmt"
+	"time"
+)
+
+// Duration is a time.Duration that is written in configuration files either as
+// a string such as "30s" or "5m", or as a number of seconds.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(p []byte) error {
+	var v any
+	if err := json.Unmarshal(p, &v); err != nil {
+		return err
+	}
+	switch value := v.(type) {
+	case float64:
+		*d = Duration(value * float64(time.Second))
+	case string:
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration %s", string(p))
+	}
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Addresses is a list of addresses that is written in configuration files
+// either as a single string or as a list of strings.
+type Addresses []string
+
+func (a *Addresses) UnmarshalJSON(p []byte) error {
+	var single string
+	if err := json.Unmarshal(p, &single); err == nil {
+		*a = Addresses{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(p, &list); err != nil {
+		return fmt.Errorf("invalid address list %s", string(p))
+	}
+	*a = list
+	return nil
+}
+
+func (a Addresses) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+// ByteSize is a number of bytes that is written in configuration files either
+// as a number or as a string such as "512KB" or "1.5MB", units are powers of 1024.
+type ByteSize int64
+
+func (b *ByteSize) UnmarshalJSON(p []byte) error {
+	var v any
+	if err := json.Unmarshal(p, &v); err != nil {
+		return err
+	}
+	switch value := v.(type) {
+	case float64:
+		*b = ByteSize(value)
+		return nil
+	case string:
+		n, err := tools.ParseSize(value)
+		if err != nil {
+			return err
+		}
+		*b = ByteSize(n)
+		return nil
+	}
+	return fmt.Errorf("invalid size %s", string(p))
+}
@@ -0,0 +1,443 @@
+package app
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"ezturp/protocol"
+	"ezturp/tools"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	CONTROL         = "control"
+	CONTROL_TIMEOUT = 10 * time.Second
+	CONTROL_TUNNELS = 32
+)
+
+// ControlClient is a client allowed to register tunnels on a ControlServer.
+// Ports lists the remote ports it may ask for, without Ports it may not choose
+// and its tunnels get a port picked by the system.
+type ControlClient struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	Ports string `json:"ports"`
+}
+
+type registerRequest struct {
+	Client     string `json:"client"`
+	Token      string `json:"token"`
+	Name       string `json:"name"`
+	Protocol   string `json:"protocol"`
+	RemotePort int    `json:"remote_port"`
+}
+
+type registerReply struct {
+	Name         string `json:"name"`
+	RemotePort   int    `json:"remote_port"`
+	InternalPort int    `json:"internal_port"`
+	Secret       string `json:"secret,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// ControlServer accepts control connections from clients and opens tunnels on
+// demand. A tunnel lives as long as the control connection that registered it.
+// The tunnels share Limiter, and count their traffic in the Metrics that
+// NewMetrics returns for each of them.
+type ControlServer struct {
+	Name          string
+	ExternalHost  string
+	InternalPorts string
+	Clients       []*ControlClient
+	Limiter       *Limiter
+	NewMetrics    func(tunnel, protocol string) *Metrics
+	logger        tools.Logger
+
+	internalPorts PortRanges
+	clientPorts   map[string]PortRanges
+
+	closeMutex sync.Mutex
+	closed     bool
+	listener   net.Listener
+	conns      map[net.Conn]struct{}
+	tunnels    map[io.Closer]struct{}
+}
+
+func (s *ControlServer) init() error {
+	s.logger = tools.Logger{Service: "ControlServer", Name: s.Name}
+	if s.NewMetrics == nil {
+		s.NewMetrics = newMetrics
+	}
+	s.conns = make(map[net.Conn]struct{})
+	s.tunnels = make(map[io.Closer]struct{})
+	s.clientPorts = make(map[string]PortRanges)
+	var err error
+	s.internalPorts, err = ParsePortRanges(s.InternalPorts)
+	if err != nil {
+		return err
+	}
+	for _, client := range s.Clients {
+		ports, err := ParsePortRanges(client.Ports)
+		if err != nil {
+			return fmt.Errorf("client %v: %v", client.Name, err)
+		}
+		s.clientPorts[client.Name] = ports
+	}
+	return nil
+}
+
+func (s *ControlServer) Listen(controlAddr string) error {
+	err := s.init()
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", controlAddr)
+	if err != nil {
+		return err
+	}
+	s.closeMutex.Lock()
+	s.listener = listener
+	closed := s.closed
+	s.closeMutex.Unlock()
+	if closed {
+		_ = listener.Close()
+		return errors.New("server closed")
+	}
+	defer s.Close()
+	s.logger.Info("listen control connection %v", listener.Addr())
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return nil
+			}
+			return err
+		}
+		if !s.track(conn) {
+			_ = conn.Close()
+			return nil
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *ControlServer) isClosed() bool {
+	s.closeMutex.Lock()
+	defer s.closeMutex.Unlock()
+	return s.closed
+}
+
+func (s *ControlServer) track(conn net.Conn) bool {
+	s.closeMutex.Lock()
+	defer s.closeMutex.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *ControlServer) untrack(conn net.Conn) {
+	s.closeMutex.Lock()
+	defer s.closeMutex.Unlock()
+	delete(s.conns, conn)
+}
+
+func (s *ControlServer) setTunnel(tunnel io.Closer, open bool) {
+	s.closeMutex.Lock()
+	defer s.closeMutex.Unlock()
+	if open {
+		s.tunnels[tunnel] = struct{}{}
+	} else {
+		delete(s.tunnels, tunnel)
+	}
+}
+
+func (s *ControlServer) holders() []sessionHolder {
+	s.closeMutex.Lock()
+	defer s.closeMutex.Unlock()
+	holders := make([]sessionHolder, 0, len(s.tunnels))
+	for t := range s.tunnels {
+		if h, ok := t.(sessionHolder); ok {
+			holders = append(holders, h)
+		}
+	}
+	return holders
+}
+
+// Sessions lists the sessions of every registered tunnel
+func (s *ControlServer) Sessions() []SessionInfo {
+	var sessions []SessionInfo
+	for _, h := range s.holders() {
+		sessions = append(sessions, h.Sessions()...)
+	}
+	return sessions
+}
+
+// KillSession closes session id of any registered tunnel
+func (s *ControlServer) KillSession(id uint32) bool {
+	for _, h := range s.holders() {
+		if h.KillSession(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// Close stops accepting control connections and closes every registered tunnel
+func (s *ControlServer) Close() error {
+	s.closeMutex.Lock()
+	defer s.closeMutex.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.listener != nil {
+		_ = s.listener.Close()
+	}
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	return nil
+}
+
+func (s *ControlServer) handle(conn net.Conn) {
+	var tunnels []io.Closer
+	defer func() {
+		for _, t := range tunnels {
+			_ = t.Close()
+			s.setTunnel(t, false)
+		}
+		_ = conn.Close()
+		s.untrack(conn)
+		s.logger.Info("control %v disconnected, %d tunnels closed", conn.RemoteAddr(), len(tunnels))
+	}()
+	s.logger.Info("control %v connected", conn.RemoteAddr())
+	for {
+		err := conn.SetReadDeadline(time.Now().Add(INTERNAL_CONN_IDLE))
+		if err != nil {
+			return
+		}
+		t, _, data, err := protocol.ReadFrame(conn)
+		if err != nil {
+			return
+		}
+		switch t {
+		case protocol.KEEP_ALIVE:
+			err = protocol.WriteFrame(conn, protocol.KEEP_ALIVE, 0, []byte{})
+		case protocol.REGISTER_TUNNEL:
+			if len(tunnels) >= CONTROL_TUNNELS {
+				p, _ := json.Marshal(registerReply{Error: fmt.Sprintf("at most %d tunnels per control connection", CONTROL_TUNNELS)})
+				err = protocol.WriteFrame(conn, protocol.TUNNEL_REGISTERED, 0, p)
+				break
+			}
+			reply, tunnel := s.register(data)
+			if tunnel != nil {
+				tunnels = append(tunnels, tunnel)
+				s.setTunnel(tunnel, true)
+			}
+			p, _ := json.Marshal(reply)
+			err = protocol.WriteFrame(conn, protocol.TUNNEL_REGISTERED, 0, p)
+		default:
+			s.logger.Warn("unknown message type %v from %v", t, conn.RemoteAddr())
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *ControlServer) authenticate(req *registerRequest) bool {
+	for _, client := range s.Clients {
+		if client.Name == req.Client {
+			return subtle.ConstantTimeCompare([]byte(client.Token), []byte(req.Token)) == 1
+		}
+	}
+	return false
+}
+
+func (s *ControlServer) register(p []byte) (reply registerReply, tunnel io.Closer) {
+	var req registerRequest
+	err := json.Unmarshal(p, &req)
+	if err != nil {
+		reply.Error = "bad request"
+		return
+	}
+	reply.Name = req.Name
+	if !s.authenticate(&req) {
+		s.logger.Warn("client %q failed to authenticate", req.Client)
+		reply.Error = "authentication failed"
+		return
+	}
+	name := req.Client + "/" + req.Name
+	reply.Secret = newLinkSecret()
+	tunnel, reply.RemotePort, reply.InternalPort, err = s.open(name, &req, reply.Secret)
+	if err != nil {
+		s.logger.Warn("failed to register tunnel %v : %v", name, err)
+		reply.Error = err.Error()
+		reply.Secret = ""
+		return
+	}
+	s.logger.Info("tunnel %v registered, %s remote port %d, internal port %d", name, req.Protocol, reply.RemotePort, reply.InternalPort)
+	return
+}
+
+// newLinkSecret returns the secret that a registered tunnel must present on its internal link
+func newLinkSecret() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func (s *ControlServer) open(name string, req *registerRequest, secret string) (io.Closer, int, int, error) {
+	allowed := s.clientPorts[req.Client]
+	if req.RemotePort != 0 && !allowed.Contains(req.RemotePort) {
+		return nil, 0, 0, fmt.Errorf("remote port %d is not allowed", req.RemotePort)
+	}
+	remotePorts := allowed
+	if req.RemotePort != 0 {
+		remotePorts = PortRanges{{req.RemotePort, req.RemotePort}}
+	}
+	externalHost := s.ExternalHost
+	if host, _, err := net.SplitHostPort(externalHost); err == nil {
+		externalHost = host
+	}
+	internalHost, _, _ := net.SplitHostPort(s.listener.Addr().String())
+	switch req.Protocol {
+	case TCP:
+		external, remotePort, err := listenAnyPort(TCP, externalHost, remotePorts)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		internal, internalPort, err := listenAnyPort(TCP, internalHost, s.internalPorts)
+		if err != nil {
+			_ = external.Close()
+			return nil, 0, 0, err
+		}
+		server := &TcpServer{Name: name, Secret: secret, Metrics: s.NewMetrics(name, TCP), Limiter: s.Limiter}
+		go server.Serve(internal.(net.Listener), external.(net.Listener))
+		return server, remotePort, internalPort, nil
+	case UDP:
+		external, remotePort, err := listenAnyPort(UDP, externalHost, remotePorts)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		internal, internalPort, err := listenAnyPort(UDP, internalHost, s.internalPorts)
+		if err != nil {
+			_ = external.Close()
+			return nil, 0, 0, err
+		}
+		server := &UdpServer{Name: name, ClientKeys: []string{req.Client}, Secret: secret,
+			Metrics: s.NewMetrics(name, UDP), Limiter: s.Limiter}
+		go server.Serve(internal.(*net.UDPConn), external.(net.PacketConn))
+		return server, remotePort, internalPort, nil
+	default:
+		return nil, 0, 0, fmt.Errorf("unsupported protocol %s", req.Protocol)
+	}
+}
+
+// listenAnyPort listens on the first free port of ranges, or on a port chosen by
+// the system when ranges is empty
+func listenAnyPort(protocol, host string, ranges PortRanges) (io.Closer, int, error) {
+	ports := ranges.Ports()
+	if len(ranges) == 0 {
+		ports = []int{0}
+	}
+	var err error
+	for _, port := range ports {
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		if protocol == UDP {
+			var udpAddr *net.UDPAddr
+			udpAddr, err = net.ResolveUDPAddr("udp", addr)
+			if err != nil {
+				return nil, 0, err
+			}
+			var conn *net.UDPConn
+			conn, err = net.ListenUDP("udp", udpAddr)
+			if err == nil {
+				return conn, conn.LocalAddr().(*net.UDPAddr).Port, nil
+			}
+		} else {
+			var listener net.Listener
+			listener, err = net.Listen("tcp", addr)
+			if err == nil {
+				return listener, listener.Addr().(*net.TCPAddr).Port, nil
+			}
+		}
+	}
+	if err == nil {
+		err = errors.New("no free port")
+	}
+	return nil, 0, err
+}
+
+// runControlled registers a tunnel through the control server at config.ControlAddress,
+// then runs connect against the internal address the server assigned, with the
+// secret of the link. The tunnel is closed when either the control connection
+// or the client stops.
+func runControlled(config *ClientConfig, logger *tools.Logger, client io.Closer, connect func(addr, secret string) error) error {
+	conn, err := net.DialTimeout("tcp", config.ControlAddress, CONTROL_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	req := registerRequest{
+		Client:     config.key(),
+		Token:      config.Token,
+		Name:       config.Name,
+		Protocol:   config.Protocol,
+		RemotePort: config.RemotePort,
+	}
+	p, _ := json.Marshal(req)
+	err = protocol.WriteFrame(conn, protocol.REGISTER_TUNNEL, 0, p)
+	if err != nil {
+		return err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(CONTROL_TIMEOUT))
+	t, _, data, err := protocol.ReadFrame(conn)
+	if err != nil {
+		return err
+	}
+	var reply registerReply
+	if t != protocol.TUNNEL_REGISTERED || json.Unmarshal(data, &reply) != nil {
+		return errors.New("bad reply from control server")
+	}
+	if reply.Error != "" {
+		return fmt.Errorf("control server refused tunnel: %s", reply.Error)
+	}
+	host, _, err := net.SplitHostPort(config.ControlAddress)
+	if err != nil {
+		return err
+	}
+	logger.Info("%s %v exposed on remote port %d", config.Protocol, config.Name, reply.RemotePort)
+
+	go func() {
+		ticker := time.NewTicker(KEEP_ALIVE)
+		defer ticker.Stop()
+		for range ticker.C {
+			if protocol.WriteFrame(conn, protocol.KEEP_ALIVE, 0, []byte{}) != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			_ = conn.SetReadDeadline(time.Now().Add(INTERNAL_CONN_IDLE))
+			if _, _, _, err := protocol.ReadFrame(conn); err != nil {
+				break
+			}
+		}
+		_ = conn.Close()
+		_ = client.Close()
+	}()
+	return connect(net.JoinHostPort(host, strconv.Itoa(reply.InternalPort)), reply.Secret)
+}
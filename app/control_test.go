@@ -0,0 +1,86 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// freePorts returns n ports that were free a moment ago
+func freePorts(t *testing.T, n int) []int {
+	var ports []int
+	for i := 0; i < n; i++ {
+		l, err := net.Listen(TCP, "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports = append(ports, l.Addr().(*net.TCPAddr).Port)
+		defer l.Close()
+	}
+	return ports
+}
+
+func Test_controlRegister(t *testing.T) {
+	ports := freePorts(t, 2)
+	s := &ControlServer{
+		Name:         "control",
+		ExternalHost: "127.0.0.1",
+		Clients: []*ControlClient{
+			{Name: "alice", Token: "alice-token", Ports: fmt.Sprintf("%d,%d", ports[0], ports[1])},
+			{Name: "bob", Token: "bob-token"},
+		},
+	}
+	if err := s.init(); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen(TCP, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	s.listener = listener
+	cases := []struct {
+		name string
+		req  registerRequest
+		err  string
+	}{
+		{"wrong token", registerRequest{Client: "alice", Token: "bob-token", Name: "web", Protocol: TCP}, "authentication failed"},
+		{"unknown client", registerRequest{Client: "carol", Token: "alice-token", Name: "web", Protocol: TCP}, "authentication failed"},
+		{"no token", registerRequest{Client: "bob", Name: "web", Protocol: TCP}, "authentication failed"},
+		{"port outside the list", registerRequest{Client: "alice", Token: "alice-token", Name: "web", Protocol: TCP, RemotePort: 1}, "not allowed"},
+		{"port without a list", registerRequest{Client: "bob", Token: "bob-token", Name: "web", Protocol: TCP, RemotePort: ports[0]}, "not allowed"},
+		{"unsupported protocol", registerRequest{Client: "alice", Token: "alice-token", Name: "web", Protocol: "sctp"}, "unsupported protocol"},
+		{"listed port", registerRequest{Client: "alice", Token: "alice-token", Name: "web", Protocol: TCP, RemotePort: ports[1]}, ""},
+		{"any listed port", registerRequest{Client: "alice", Token: "alice-token", Name: "dns", Protocol: UDP}, ""},
+		{"port picked by the system", registerRequest{Client: "bob", Token: "bob-token", Name: "web", Protocol: TCP}, ""},
+	}
+	for _, c := range cases {
+		p, _ := json.Marshal(c.req)
+		reply, tunnel := s.register(p)
+		if c.err != "" {
+			if tunnel != nil || !strings.Contains(reply.Error, c.err) {
+				t.Errorf("%s: got error %q, want %q", c.name, reply.Error, c.err)
+			}
+			if reply.Secret != "" {
+				t.Errorf("%s: a refused tunnel got a secret", c.name)
+			}
+			continue
+		}
+		if tunnel == nil {
+			t.Errorf("%s: refused : %v", c.name, reply.Error)
+			continue
+		}
+		_ = tunnel.Close()
+		if reply.Secret == "" || reply.InternalPort == 0 {
+			t.Errorf("%s: reply %+v lacks a secret or an internal port", c.name, reply)
+		}
+		switch {
+		case c.req.RemotePort != 0 && reply.RemotePort != c.req.RemotePort:
+			t.Errorf("%s: got remote port %d, want %d", c.name, reply.RemotePort, c.req.RemotePort)
+		case c.req.Client == "alice" && !s.clientPorts["alice"].Contains(reply.RemotePort):
+			t.Errorf("%s: remote port %d is not listed", c.name, reply.RemotePort)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package app
+
+import (
+	"errors"
+	"ezturp/tools"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errNotFound = errors.New("not found")
+
+// entry is the tunnel of one configuration entry of a manager
+type entry struct {
+	name     string
+	protocol string
+	config   interface{}
+	restart  *RestartPolicy
+	kind     string
+	start    func(*group) error
+	router   string
+	invalid  bool
+	disabled bool
+	tunnel   *tunnel
+	metrics  []*Metrics
+	limiter  *Limiter
+}
+
+// addMetrics creates the metrics of an endpoint of the entry, they outlive restarts of the tunnel
+func (e *entry) addMetrics(tunnel, protocol string) *Metrics {
+	m := newMetrics(tunnel, protocol)
+	e.metrics = append(e.metrics, m)
+	return m
+}
+
+// metricsOf returns the metrics of an endpoint that comes and goes while the
+// entry runs, the same tunnel gets back its metrics when it returns
+func (e *entry) metricsOf(tunnel, protocol string) *Metrics {
+	for _, m := range e.metrics {
+		if m.Tunnel == tunnel && m.Protocol == protocol {
+			return m
+		}
+	}
+	return e.addMetrics(tunnel, protocol)
+}
+
+// entrySet holds the entries of a manager in configuration order. Changes go
+// through change, which holds mutex while the entries are built and replaced,
+// and stops and starts their tunnels once mutex is released.
+type entrySet struct {
+	logger  *tools.Logger
+	role    string
+	started time.Time
+	changes sync.Mutex
+	mutex   sync.Mutex
+	keys    []string
+	entries map[string]*entry
+	pending pendingChange
+}
+
+// pendingChange is what is left of a change once the entries are replaced:
+// the tunnels to stop or disable, then update, then the tunnels to start
+type pendingChange struct {
+	stop    []*tunnel
+	disable []*tunnel
+	update  func(map[string]*entry)
+	next    map[string]*entry
+	start   []*entry
+}
+
+// change runs fn under mutex, then carries out the pending change fn left
+// without holding mutex. Changes run one at a time.
+func (s *entrySet) change(fn func() error) error {
+	s.changes.Lock()
+	defer s.changes.Unlock()
+	s.mutex.Lock()
+	err := fn()
+	pending := s.pending
+	s.pending = pendingChange{}
+	s.mutex.Unlock()
+	for _, t := range pending.stop {
+		t.stop()
+	}
+	for _, t := range pending.disable {
+		t.disable()
+	}
+	if pending.update != nil {
+		pending.update(pending.next)
+	}
+	for _, e := range pending.start {
+		go e.tunnel.run(e.start)
+	}
+	return err
+}
+
+// entryKey identifies a configuration entry across reloads by its protocol and
+// name, entries sharing both are told apart by their order
+func entryKey(seen map[string]int, protocol, name string) string {
+	key := protocol + "/" + name
+	seen[key]++
+	if n := seen[key]; n > 1 {
+		key = fmt.Sprintf("%s#%d", key, n)
+	}
+	return key
+}
+
+// unchanged returns the running entry of key when it was built from an equal config
+func (s *entrySet) unchanged(key string, config interface{}) *entry {
+	e, ok := s.entries[key]
+	if ok && !e.invalid && reflect.DeepEqual(e.config, config) {
+		return e
+	}
+	return nil
+}
+
+// retune changes the limits and the quota of the running entry of key, without
+// a restart, when its config differs from config only in those
+func (s *entrySet) retune(key string, config interface{}, limits *Limits, quota *Quota) *entry {
+	e, ok := s.entries[key]
+	if !ok || e.invalid || !reflect.DeepEqual(withoutTuning(e.config), withoutTuning(config)) {
+		return nil
+	}
+	if !reflect.DeepEqual(e.config, config) {
+		e.limiter.Set(limits)
+		e.limiter.SetQuota(s.quotaKey(key), quota)
+		s.logger.Info("%s %v limits changed", e.kind, e.name)
+	}
+	e.config = config
+	return e
+}
+
+// withoutTuning copies the config struct that config points to, clearing its Limits and Quota
+func withoutTuning(config interface{}) interface{} {
+	v := reflect.New(reflect.TypeOf(config).Elem()).Elem()
+	v.Set(reflect.ValueOf(config).Elem())
+	for _, name := range []string{"Limits", "Quota"} {
+		field := v.FieldByName(name)
+		field.Set(reflect.Zero(field.Type()))
+	}
+	return v.Interface()
+}
+
+// quotaKey names the entry of key in the quota state, which the managers of a process share
+func (s *entrySet) quotaKey(key string) string {
+	return s.role + " " + key
+}
+
+// replace makes next the running entries within change. Entries that are
+// missing from next or replaced by a new entry are stopped, then update is
+// called before the new entries start. A new entry stays disabled when the
+// one it replaces was.
+func (s *entrySet) replace(keys []string, next map[string]*entry, update func(map[string]*entry)) (added, removed, restarted int) {
+	for key, old := range s.entries {
+		if e, ok := next[key]; !ok || e != old {
+			s.pending.stop = append(s.pending.stop, old.tunnel)
+			if ok {
+				restarted++
+			} else {
+				removed++
+				s.logger.Info("%s %v removed", old.kind, old.name)
+			}
+		}
+	}
+	s.pending.update, s.pending.next = update, next
+	for _, key := range keys {
+		e := next[key]
+		if e.tunnel != nil {
+			continue
+		}
+		old, ok := s.entries[key]
+		if !ok {
+			added++
+		}
+		if ok && old.disabled {
+			e.disabled = true
+			e.tunnel = s.newTunnel(e)
+			e.tunnel.skip()
+			continue
+		}
+		s.run(e)
+	}
+	s.keys = keys
+	s.entries = next
+	return
+}
+
+func (s *entrySet) newTunnel(e *entry) *tunnel {
+	return newTunnel(e.kind, e.name, e.protocol, e.restart, s.logger)
+}
+
+// run starts the tunnel of e when the change is carried out
+func (s *entrySet) run(e *entry) {
+	e.tunnel = s.newTunnel(e)
+	s.pending.start = append(s.pending.start, e)
+}
+
+// find returns the key of the entry called name, protocol may be left empty
+// when no other entry has the same name
+func (s *entrySet) find(name, protocol string) (string, error) {
+	var found []string
+	for _, key := range s.keys {
+		e := s.entries[key]
+		if e.name == name && (protocol == "" || e.protocol == protocol) {
+			found = append(found, key)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("tunnel %q %w", name, errNotFound)
+	case 1:
+		return found[0], nil
+	}
+	return "", fmt.Errorf("tunnel %q is ambiguous, set its protocol", name)
+}
+
+// without returns the keys and entries of the set except key
+func (s *entrySet) without(key string) ([]string, map[string]*entry) {
+	keys := make([]string, 0, len(s.keys))
+	entries := make(map[string]*entry, len(s.entries))
+	for _, k := range s.keys {
+		if k != key {
+			keys = append(keys, k)
+			entries[k] = s.entries[k]
+		}
+	}
+	return keys, entries
+}
+
+// setEnabled stops a tunnel until it is enabled again, its entry stays in place
+func (s *entrySet) setEnabled(name, protocol string, enabled bool) error {
+	return s.change(func() error {
+		key, err := s.find(name, protocol)
+		if err != nil {
+			return err
+		}
+		e := s.entries[key]
+		if e.disabled == !enabled {
+			return nil
+		}
+		e.disabled = !enabled
+		if enabled {
+			s.run(e)
+			s.logger.Info("%s %v enabled", e.kind, e.name)
+		} else {
+			s.pending.disable = append(s.pending.disable, e.tunnel)
+			s.logger.Info("%s %v disabled", e.kind, e.name)
+		}
+		return nil
+	})
+}
+
+// close stops every tunnel of the set
+func (s *entrySet) close() {
+	_ = s.change(func() error {
+		for _, key := range s.keys {
+			s.pending.stop = append(s.pending.stop, s.entries[key].tunnel)
+		}
+		return nil
+	})
+}
+
+func (s *entrySet) states() []TunnelState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	states := make([]TunnelState, 0, len(s.keys))
+	for _, key := range s.keys {
+		states = append(states, s.entries[key].tunnel.State())
+	}
+	return states
+}
+
+func (s *entrySet) snapshot() []Metrics {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	metrics := []Metrics{}
+	for _, key := range s.keys {
+		for _, m := range s.entries[key].metrics {
+			metrics = append(metrics, m.Snapshot())
+		}
+	}
+	return metrics
+}
+
+// quotas reports the quota of every tunnel that has one
+func (s *entrySet) quotas() []QuotaState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	quotas := []QuotaState{}
+	for _, key := range s.keys {
+		e := s.entries[key]
+		if q, ok := e.limiter.quotaState(e.name, e.protocol); ok {
+			quotas = append(quotas, q)
+		}
+	}
+	return quotas
+}
+
+// sessions lists the live sessions of every tunnel, oldest first per tunnel
+func (s *entrySet) sessions() []SessionInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sessions := []SessionInfo{}
+	for _, key := range s.keys {
+		var list []SessionInfo
+		for _, h := range s.entries[key].tunnel.endpoints() {
+			list = append(list, h.Sessions()...)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Since.Before(list[j].Since) })
+		sessions = append(sessions, list...)
+	}
+	return sessions
+}
+
+// killSession closes session id of the tunnel called name, any tunnel when name is empty
+func (s *entrySet) killSession(name string, id uint32) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, key := range s.keys {
+		e := s.entries[key]
+		if name != "" && e.name != name {
+			continue
+		}
+		for _, h := range e.tunnel.endpoints() {
+			if h.KillSession(id) {
+				s.logger.Session(id, nil).Info("%s %v session killed", e.kind, e.name)
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("session %v %w", id, errNotFound)
+}
@@ -0,0 +1,278 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"ezturp/tools"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HEALTH_INTERVAL = 10 * time.Second
+	HEALTH_TIMEOUT  = 3 * time.Second
+	HEALTH_FAILURES = 3
+)
+
+// HealthCheck probes the local service of a client tunnel. Type is "tcp" (connect),
+// "http" (GET Path, expecting Status) or "udp" (send Send, expecting a reply
+// containing Expect). The service is reported unhealthy after Failures probes
+// in a row fail, and healthy again after the first probe that passes.
+type HealthCheck struct {
+	Type     string   `json:"type"`
+	Address  string   `json:"address"`
+	Interval Duration `json:"interval"`
+	Timeout  Duration `json:"timeout"`
+	Failures int      `json:"failures"`
+	Path     string   `json:"path"`
+	Status   int      `json:"status"`
+	Send     string   `json:"send"`
+	Expect   string   `json:"expect"`
+}
+
+// healthChecker runs the probes of a HealthCheck and calls onChange whenever
+// the health of the local service flips
+type healthChecker struct {
+	config   HealthCheck
+	logger   tools.Logger
+	onChange func(healthy bool)
+
+	mutex    sync.Mutex
+	healthy  bool
+	failures int
+}
+
+func newHealthChecker(name, localAddr string, config *HealthCheck, onChange func(bool)) (*healthChecker, error) {
+	h := &healthChecker{
+		config:   *config,
+		logger:   tools.Logger{Service: "HealthCheck", Name: name},
+		onChange: onChange,
+		healthy:  true,
+	}
+	if h.config.Address == "" {
+		h.config.Address = localAddr
+	}
+	if h.config.Interval <= 0 {
+		h.config.Interval = Duration(HEALTH_INTERVAL)
+	}
+	if h.config.Timeout <= 0 {
+		h.config.Timeout = Duration(HEALTH_TIMEOUT)
+	}
+	if h.config.Failures <= 0 {
+		h.config.Failures = HEALTH_FAILURES
+	}
+	switch h.config.Type {
+	case TCP, UDP:
+	case HTTP:
+		if h.config.Path == "" {
+			h.config.Path = "/"
+		}
+		if h.config.Status == 0 {
+			h.config.Status = http.StatusOK
+		}
+	default:
+		return nil, fmt.Errorf("unsupported health check type %q", h.config.Type)
+	}
+	return h, nil
+}
+
+func (h *healthChecker) Healthy() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.healthy
+}
+
+// run probes until done is closed, the first probe runs immediately
+func (h *healthChecker) run(done <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(h.config.Interval))
+	defer ticker.Stop()
+	for {
+		h.record(h.probe())
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+func (h *healthChecker) record(err error) {
+	h.mutex.Lock()
+	healthy := h.healthy
+	if err == nil {
+		h.failures = 0
+		h.healthy = true
+	} else {
+		h.failures++
+		h.logger.Debug("probe %v failed (%d/%d) : %v", h.config.Address, h.failures, h.config.Failures, err)
+		if h.failures >= h.config.Failures {
+			h.healthy = false
+		}
+	}
+	changed := healthy != h.healthy
+	healthy = h.healthy
+	h.mutex.Unlock()
+	if !changed {
+		return
+	}
+	if healthy {
+		h.logger.Info("local service %v is healthy", h.config.Address)
+	} else {
+		h.logger.Warn("local service %v is unhealthy : %v", h.config.Address, err)
+	}
+	if h.onChange != nil {
+		h.onChange(healthy)
+	}
+}
+
+func (h *healthChecker) probe() error {
+	timeout := time.Duration(h.config.Timeout)
+	switch h.config.Type {
+	case HTTP:
+		return h.probeHttp(timeout)
+	case UDP:
+		return h.probeUdp(timeout)
+	default:
+		network, address := splitAddress(TCP, h.config.Address)
+		conn, err := net.DialTimeout(network, address, timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+func (h *healthChecker) probeHttp(timeout time.Duration) error {
+	network, address := splitAddress(TCP, h.config.Address)
+	host := address
+	if network != TCP {
+		host = "localhost"
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, address)
+			},
+			DisableKeepAlives: true,
+		},
+	}
+	resp, err := client.Get("http://" + host + h.config.Path)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != h.config.Status {
+		return fmt.Errorf("status %d, expected %d", resp.StatusCode, h.config.Status)
+	}
+	return nil
+}
+
+func (h *healthChecker) probeUdp(timeout time.Duration) error {
+	conn, err := dialPacket(h.config.Address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	if _, err = conn.Write([]byte(h.config.Send)); err != nil {
+		return err
+	}
+	buf := make([]byte, UDP_BUF_SIZE)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return err
+	}
+	if !bytes.Contains(buf[:n], []byte(h.config.Expect)) {
+		return errors.New("unexpected reply " + strings.TrimSpace(string(buf[:n])))
+	}
+	return nil
+}
+
+// backendHealth probes every backend of a client, the sessions of a backend
+// that turns unhealthy go to the others. The client is unhealthy when none of
+// its backends is healthy. With Address set a single probe decides for all.
+type backendHealth struct {
+	checkers []*healthChecker
+	onChange func(healthy bool)
+
+	mutex   sync.Mutex
+	healthy bool
+}
+
+func newBackendHealth(name string, pool *backendPool, config *HealthCheck, onChange func(bool)) (*backendHealth, error) {
+	bh := &backendHealth{onChange: onChange, healthy: true}
+	if config.Address != "" {
+		h, err := newHealthChecker(name, "", config, bh.update)
+		if err != nil {
+			return nil, err
+		}
+		bh.checkers = append(bh.checkers, h)
+		return bh, nil
+	}
+	for _, b := range pool.backends {
+		b := b
+		h, err := newHealthChecker(name, b.address, config, func(healthy bool) {
+			pool.setHealthy(b, healthy)
+			bh.update(pool.anyHealthy())
+		})
+		if err != nil {
+			return nil, err
+		}
+		bh.checkers = append(bh.checkers, h)
+	}
+	return bh, nil
+}
+
+func (bh *backendHealth) Healthy() bool {
+	bh.mutex.Lock()
+	defer bh.mutex.Unlock()
+	return bh.healthy
+}
+
+func (bh *backendHealth) update(healthy bool) {
+	bh.mutex.Lock()
+	changed := bh.healthy != healthy
+	bh.healthy = healthy
+	bh.mutex.Unlock()
+	if changed && bh.onChange != nil {
+		bh.onChange(healthy)
+	}
+}
+
+// run probes every backend until done is closed
+func (bh *backendHealth) run(done <-chan struct{}) {
+	var wg sync.WaitGroup
+	for _, h := range bh.checkers {
+		h := h
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.run(done)
+		}()
+	}
+	wg.Wait()
+}
+
+// healthFrame is the payload of a HEALTH_STATUS frame: the status byte
+// followed by the key of the client, which UdpServer needs to find the sender
+func healthFrame(healthy bool, key string) []byte {
+	status := byte(0)
+	if healthy {
+		status = 1
+	}
+	return append([]byte{status}, key...)
+}
+
+func parseHealthFrame(data []byte) (healthy bool, key string, err error) {
+	if len(data) < 1 {
+		return false, "", errors.New("empty health status")
+	}
+	return data[0] == 1, string(data[1:]), nil
+}
@@ -0,0 +1,137 @@
+package app
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_healthFrame(t *testing.T) {
+	for _, c := range []struct {
+		healthy bool
+		key     string
+	}{{true, "client-1"}, {false, ""}} {
+		healthy, key, err := parseHealthFrame(healthFrame(c.healthy, c.key))
+		if err != nil || healthy != c.healthy || key != c.key {
+			t.Errorf("%v %q: parsed %v %q : %v", c.healthy, c.key, healthy, key, err)
+		}
+	}
+	if _, _, err := parseHealthFrame(nil); err == nil {
+		t.Error("parsed an empty health status")
+	}
+}
+
+func Test_healthCheckerFailures(t *testing.T) {
+	var changes []bool
+	h, err := newHealthChecker("test", "127.0.0.1:1", &HealthCheck{Type: TCP, Failures: 2}, func(healthy bool) {
+		changes = append(changes, healthy)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := errors.New("refused")
+	for i, c := range []struct {
+		err     error
+		healthy bool
+	}{
+		{failed, true},
+		{nil, true},
+		{failed, true},
+		{failed, false},
+		{failed, false},
+		{nil, true},
+	} {
+		h.record(c.err)
+		if h.Healthy() != c.healthy {
+			t.Errorf("probe %d: healthy = %v, want %v", i, h.Healthy(), c.healthy)
+		}
+	}
+	if want := []bool{false, true}; !reflect.DeepEqual(changes, want) {
+		t.Errorf("changes %v, want %v", changes, want)
+	}
+	if _, err := newHealthChecker("test", "", &HealthCheck{Type: "icmp"}, nil); err == nil {
+		t.Error("accepted an unsupported type")
+	}
+}
+
+func Test_healthProbes(t *testing.T) {
+	listener, err := net.Listen(TCP, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := listener.Addr().String()
+	_ = listener.Close()
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer web.Close()
+	webAddr := strings.TrimPrefix(web.URL, "http://")
+	echo, err := net.ListenPacket(UDP, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteTo(append([]byte("+"), buf[:n]...), addr)
+		}
+	}()
+	cases := []struct {
+		name   string
+		config HealthCheck
+		ok     bool
+	}{
+		{"tcp up", HealthCheck{Type: TCP, Address: webAddr}, true},
+		{"tcp down", HealthCheck{Type: TCP, Address: closed}, false},
+		{"http status", HealthCheck{Type: HTTP, Address: webAddr, Path: "/healthz"}, true},
+		{"http wrong status", HealthCheck{Type: HTTP, Address: webAddr}, false},
+		{"http expected status", HealthCheck{Type: HTTP, Address: webAddr, Status: 503}, true},
+		{"udp reply", HealthCheck{Type: UDP, Address: echo.LocalAddr().String(), Send: "PING", Expect: "+PING"}, true},
+		{"udp wrong reply", HealthCheck{Type: UDP, Address: echo.LocalAddr().String(), Send: "PING", Expect: "PONG"}, false},
+	}
+	for _, c := range cases {
+		c.config.Timeout = Duration(time.Second)
+		h, err := newHealthChecker("test", "", &c.config, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := h.probe(); (err == nil) != c.ok {
+			t.Errorf("%s: probe error %v", c.name, err)
+		}
+	}
+}
+
+func Test_tcpServerHealth(t *testing.T) {
+	s := &TcpServer{Name: "test"}
+	s.init()
+	conn, other := net.Pipe()
+	defer other.Close()
+	s.internalConn = conn
+	if !s.available() {
+		t.Fatal("connected client not available")
+	}
+	s.setHealth(healthFrame(false, ""))
+	if s.available() {
+		t.Error("unhealthy client available for new sessions")
+	}
+	s.setHealth(nil)
+	if s.available() {
+		t.Error("bad health status changed the health")
+	}
+	s.setHealth(healthFrame(true, ""))
+	if !s.available() {
+		t.Error("healthy client not available")
+	}
+}
@@ -0,0 +1,166 @@
+package app
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"ezturp/tools"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	AUTH_CACHE_TTL  = 5 * time.Minute
+	AUTH_CACHE_SIZE = 1024
+	AUTH_REALM      = "ezturp"
+)
+
+// AuthConfig puts a credential check in front of an http entry. Requests pass
+// with basic auth matching a bcrypt entry of the htpasswd file, or with the bearer token.
+type AuthConfig struct {
+	Htpasswd string `json:"htpasswd"`
+	Token    string `json:"token"`
+	Realm    string `json:"realm"`
+}
+
+type httpAuth struct {
+	config AuthConfig
+	logger tools.Logger
+
+	mutex   sync.Mutex
+	users   map[string][]byte
+	modTime time.Time
+	checked time.Time
+	// bcrypt is slow on purpose, credentials that passed recently are remembered
+	cache map[[32]byte]time.Time
+}
+
+func newHttpAuth(name string, config *AuthConfig) (*httpAuth, error) {
+	a := &httpAuth{
+		config: *config,
+		logger: tools.Logger{Service: "HttpAuth", Name: name},
+		cache:  make(map[[32]byte]time.Time),
+	}
+	if a.config.Realm == "" {
+		a.config.Realm = AUTH_REALM
+	}
+	if a.config.Htpasswd == "" && a.config.Token == "" {
+		return nil, errors.New("auth needs an htpasswd file or a token")
+	}
+	if a.config.Htpasswd != "" {
+		info, err := os.Stat(a.config.Htpasswd)
+		if err != nil {
+			return nil, err
+		}
+		a.users, err = loadHtpasswd(a.config.Htpasswd)
+		if err != nil {
+			return nil, err
+		}
+		a.modTime = info.ModTime()
+		a.checked = time.Now()
+	}
+	return a, nil
+}
+
+// loadHtpasswd reads "user:hash" lines, only bcrypt hashes are accepted
+func loadHtpasswd(path string) (map[string][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(text, ":")
+		if !ok || !strings.HasPrefix(hash, "$2") {
+			return nil, fmt.Errorf("%s:%d: expected user:bcrypt-hash", path, line)
+		}
+		users[user] = []byte(hash)
+	}
+	return users, scanner.Err()
+}
+
+// reloadUsers reads the htpasswd file again after it changed, the caller holds mutex
+func (a *httpAuth) reloadUsers() {
+	if a.config.Htpasswd == "" || time.Since(a.checked) < CERT_CHECK_INTERVAL {
+		return
+	}
+	a.checked = time.Now()
+	info, err := os.Stat(a.config.Htpasswd)
+	if err != nil || !info.ModTime().After(a.modTime) {
+		return
+	}
+	users, err := loadHtpasswd(a.config.Htpasswd)
+	if err != nil {
+		a.logger.Warn("failed to reload %v : %v", a.config.Htpasswd, err)
+		return
+	}
+	a.users = users
+	a.modTime = info.ModTime()
+	a.cache = make(map[[32]byte]time.Time)
+	a.logger.Info("reloaded %v", a.config.Htpasswd)
+}
+
+func (a *httpAuth) allow(req *http.Request) bool {
+	header := req.Header.Get("Authorization")
+	if a.config.Token != "" {
+		scheme, token, _ := strings.Cut(header, " ")
+		if strings.EqualFold(scheme, "Bearer") &&
+			subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(a.config.Token)) == 1 {
+			return true
+		}
+	}
+	if a.config.Htpasswd == "" {
+		return false
+	}
+	user, password, ok := req.BasicAuth()
+	if !ok {
+		return false
+	}
+	a.mutex.Lock()
+	a.reloadUsers()
+	hash, ok := a.users[user]
+	key := sha256.Sum256([]byte(user + "\x00" + password + "\x00" + string(hash)))
+	expiry, cached := a.cache[key]
+	a.mutex.Unlock()
+	if !ok {
+		return false
+	}
+	if cached && time.Now().Before(expiry) {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+	a.mutex.Lock()
+	if len(a.cache) >= AUTH_CACHE_SIZE {
+		a.cache = make(map[[32]byte]time.Time)
+	}
+	a.cache[key] = time.Now().Add(AUTH_CACHE_TTL)
+	a.mutex.Unlock()
+	return true
+}
+
+// challenge is the WWW-Authenticate header of the 401 page
+func (a *httpAuth) challenge() http.Header {
+	header := http.Header{}
+	if a.config.Htpasswd != "" {
+		header.Add("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", a.config.Realm))
+	}
+	if a.config.Token != "" {
+		header.Add("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", a.config.Realm))
+	}
+	return header
+}
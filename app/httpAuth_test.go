@@ -0,0 +1,138 @@
+package app
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func Test_httpAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	htpasswd := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(htpasswd, []byte("# users\nalice:"+string(hash)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	basic, err := newHttpAuth("web", &AuthConfig{Htpasswd: htpasswd})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := newHttpAuth("web", &AuthConfig{Token: "t0ken"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	both, err := newHttpAuth("web", &AuthConfig{Htpasswd: htpasswd, Token: "t0ken"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name   string
+		auth   *httpAuth
+		user   string
+		pass   string
+		header string
+		allow  bool
+	}{
+		{"basic", basic, "alice", "s3cret", "", true},
+		{"basic again from the cache", basic, "alice", "s3cret", "", true},
+		{"wrong password", basic, "alice", "guess", "", false},
+		{"unknown user", basic, "bob", "s3cret", "", false},
+		{"no credentials", basic, "", "", "", false},
+		{"bearer on basic only", basic, "", "", "Bearer t0ken", false},
+		{"bearer", token, "", "", "Bearer t0ken", true},
+		{"bearer any case", token, "", "", "bearer t0ken", true},
+		{"wrong bearer", token, "", "", "Bearer t0ke", false},
+		{"basic on token only", token, "alice", "s3cret", "", false},
+		{"both with basic", both, "alice", "s3cret", "", true},
+		{"both with bearer", both, "", "", "Bearer t0ken", true},
+		{"both with a wrong bearer", both, "", "", "Bearer nope", false},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+		if c.user != "" {
+			req.SetBasicAuth(c.user, c.pass)
+		}
+		if c.header != "" {
+			req.Header.Set("Authorization", c.header)
+		}
+		if got := c.auth.allow(req); got != c.allow {
+			t.Errorf("%s: allow = %v, want %v", c.name, got, c.allow)
+		}
+	}
+}
+
+func Test_httpAuthConfig(t *testing.T) {
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "plain")
+	if err := os.WriteFile(plain, []byte("alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name   string
+		config AuthConfig
+	}{
+		{"nothing to check", AuthConfig{}},
+		{"missing htpasswd", AuthConfig{Htpasswd: filepath.Join(dir, "missing")}},
+		{"hash that is not bcrypt", AuthConfig{Htpasswd: plain}},
+	}
+	for _, c := range cases {
+		if _, err := newHttpAuth("web", &c.config); err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+	}
+}
+
+func Test_httpConnUnauthorized(t *testing.T) {
+	auth, err := newHttpAuth("web", &AuthConfig{Token: "t0ken"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen(TCP, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial(TCP, listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// the second request on the keep-alive connection has no token
+	_, _ = io.WriteString(client, "GET /a HTTP/1.1\r\nHost: example.com\r\nAuthorization: Bearer t0ken\r\n\r\n"+
+		"GET /b HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	hc, _, err := sniffHttp(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc.filter(client.LocalAddr(), "http", routeOptions{auth: auth})
+	forwarded, err := io.ReadAll(hc)
+	if err != errUnauthorized {
+		t.Errorf("tunnel read ended with %v", err)
+	}
+	if !strings.Contains(string(forwarded), "GET /a ") || strings.Contains(string(forwarded), "GET /b ") {
+		t.Errorf("forwarded %q", forwarded)
+	}
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 401 || resp.Header.Get("WWW-Authenticate") != `Bearer realm="ezturp"` {
+		t.Errorf("answered %v with %q", resp.Status, resp.Header.Get("WWW-Authenticate"))
+	}
+}
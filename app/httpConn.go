@@ -0,0 +1,136 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	HTTP_HEADER_LIMIT = 64 * 1024
+)
+
+// httpConn is an external connection whose first request head has been read
+// ahead for routing. Reads return the request bytes as they will reach the client.
+type httpConn struct {
+	net.Conn
+	reader io.Reader
+	pipe   *io.PipeReader
+}
+
+func (c *httpConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *httpConn) Close() error {
+	if c.pipe != nil {
+		_ = c.pipe.Close()
+	}
+	return c.Conn.Close()
+}
+
+// sniffHttp reads ahead the head of the first request of conn without consuming it
+func sniffHttp(conn net.Conn) (*httpConn, *http.Request, error) {
+	br := bufio.NewReaderSize(conn, HTTP_HEADER_LIMIT)
+	var head []byte
+	for size := 1; ; size = br.Buffered() + 1 {
+		if size > HTTP_HEADER_LIMIT {
+			return nil, nil, errors.New("request header too large")
+		}
+		p, err := br.Peek(size)
+		if err != nil {
+			return nil, nil, err
+		}
+		p, _ = br.Peek(br.Buffered())
+		if i := bytes.Index(p, []byte("\r\n\r\n")); i >= 0 {
+			head = p[:i+4]
+			break
+		}
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+	if err != nil {
+		return nil, nil, err
+	}
+	return &httpConn{Conn: conn, reader: br}, req, nil
+}
+
+var errUnauthorized = errors.New("unauthorized request")
+
+// filter passes the connection on request by request: a request failing the
+// auth check is answered with 401 and ends the connection, and with xForwarded
+// every request gets X-Forwarded-For and X-Forwarded-Proto headers
+func (c *httpConn) filter(remote net.Addr, proto string, options routeOptions) {
+	br := c.reader.(*bufio.Reader)
+	pr, pw := io.Pipe()
+	c.reader = pr
+	c.pipe = pr
+	go func() {
+		for {
+			req, err := http.ReadRequest(br)
+			if err != nil {
+				_ = pw.CloseWithError(err)
+				return
+			}
+			if options.auth != nil && !options.auth.allow(req) {
+				// the client waits for an answer before it sends the next
+				// request, so the earlier responses are through
+				writeHttpError(c.Conn, 401, options.auth.challenge())
+				_ = pw.CloseWithError(errUnauthorized)
+				return
+			}
+			if options.xForwarded {
+				setForwarded(req, remote, proto)
+			}
+			if err = writeRequest(pw, req); err != nil {
+				_ = pw.CloseWithError(err)
+				return
+			}
+			if req.Method == http.MethodConnect || req.Header.Get("Upgrade") != "" {
+				// the rest of the connection is no longer http
+				_, err = io.Copy(pw, br)
+				_ = pw.CloseWithError(err)
+				return
+			}
+		}
+	}()
+}
+
+func setForwarded(req *http.Request, remote net.Addr, proto string) {
+	ip := remote.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	if prior := req.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+		ip = strings.Join(prior, ", ") + ", " + ip
+	}
+	req.Header.Set("X-Forwarded-For", ip)
+	req.Header.Set("X-Forwarded-Proto", proto)
+}
+
+func writeRequest(w io.Writer, req *http.Request) error {
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// keep Request.Write from adding its own user agent
+		req.Header["User-Agent"] = []string{""}
+	}
+	return req.Write(w)
+}
+
+// writeHttpError answers a connection with a small error page served by ezturp itself
+func writeHttpError(w io.Writer, status int, header http.Header) {
+	text := fmt.Sprintf("%d %s", status, http.StatusText(status))
+	body := fmt.Sprintf("<html><head><title>%s</title></head><body><h1>%s</h1><hr>ezturp</body></html>\n", text, text)
+	buf := bytes.Buffer{}
+	fmt.Fprintf(&buf, "HTTP/1.1 %s\r\n", text)
+	for key, values := range header {
+		for _, v := range values {
+			fmt.Fprintf(&buf, "%s: %s\r\n", key, v)
+		}
+	}
+	fmt.Fprintf(&buf, "Content-Type: text/html; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(body), body)
+	_, _ = w.Write(buf.Bytes())
+}
@@ -0,0 +1,112 @@
+package app
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	SHUTDOWN_POLL = 100 * time.Millisecond
+)
+
+// routines counts the goroutines of an endpoint so that it can wait for them to exit
+type routines struct {
+	mutex sync.Mutex
+	count int
+	idle  chan struct{}
+}
+
+func (r *routines) add() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.count == 0 {
+		r.idle = make(chan struct{})
+	}
+	r.count++
+}
+
+func (r *routines) done() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.count--
+	if r.count == 0 {
+		close(r.idle)
+	}
+}
+
+// start runs f in a counted goroutine
+func (r *routines) start(f func()) {
+	r.add()
+	go func() {
+		defer r.done()
+		f()
+	}()
+}
+
+// wait returns once every counted goroutine exited, or with the error of ctx
+func (r *routines) wait(ctx context.Context) error {
+	r.mutex.Lock()
+	if r.count == 0 {
+		r.mutex.Unlock()
+		return nil
+	}
+	idle := r.idle
+	r.mutex.Unlock()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// watch closes c when ctx is cancelled, until the returned function is called
+func watch(ctx context.Context, c io.Closer) (stop func()) {
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = c.Close()
+		case <-stopped:
+		}
+	}()
+	return func() {
+		close(stopped)
+	}
+}
+
+// runContext runs a blocking Listen or Connect call that ends when c is closed,
+// closing c when ctx is cancelled
+func runContext(ctx context.Context, c io.Closer, run func() error) error {
+	stop := watch(ctx, c)
+	defer stop()
+	err := run()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// shutdown stops new sessions with drain and waits until active reports that
+// the running sessions ended, or until ctx is done. The endpoint is closed in
+// either case, then shutdown waits for its goroutines to exit.
+func shutdown(ctx context.Context, c io.Closer, r *routines, drain func(), active func() int) error {
+	drain()
+	ticker := time.NewTicker(SHUTDOWN_POLL)
+	defer ticker.Stop()
+	var err error
+	for err == nil && active() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	_ = c.Close()
+	if waitErr := r.wait(ctx); err == nil {
+		err = waitErr
+	}
+	return err
+}
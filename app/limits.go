@@ -0,0 +1,273 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// directions of a limit, seen from the local service: uploads leave it towards
+// the external peers, downloads come in from them
+const (
+	UPLOAD = iota
+	DOWNLOAD
+)
+
+// Limits are the bandwidth limits of a tunnel. Tunnel is shared by all its
+// sessions, Session applies to each session and Ip to the sessions of each
+// external address together.
+type Limits struct {
+	Tunnel  *Limit `json:"tunnel,omitempty"`
+	Session *Limit `json:"session,omitempty"`
+	Ip      *Limit `json:"ip,omitempty"`
+}
+
+// Limit is a token bucket per direction, rates are in bytes per second and
+// zero means unlimited. Burst is the size of the buckets, one second of the
+// rate when left out.
+type Limit struct {
+	Upload   ByteSize `json:"upload,omitempty"`
+	Download ByteSize `json:"download,omitempty"`
+	Burst    ByteSize `json:"burst,omitempty"`
+}
+
+// validate checks the limits of a server or client entry of protocol. Each end
+// only holds back the TCP streams it reads, so a TCP server cannot limit
+// uploads and a TCP client cannot limit downloads.
+func (l *Limits) validate(server bool, protocol string) error {
+	if l == nil {
+		return nil
+	}
+	names := []string{"tunnel", "session", "ip"}
+	for i, limit := range []*Limit{l.Tunnel, l.Session, l.Ip} {
+		if limit == nil {
+			continue
+		}
+		if limit.Upload < 0 || limit.Download < 0 || limit.Burst < 0 {
+			return fmt.Errorf("limits.%s: negative limit", names[i])
+		}
+		if protocol == UDP {
+			continue
+		}
+		switch {
+		case server && limit.Upload > 0 && limit == l.Ip:
+			return fmt.Errorf("limits.ip.upload cannot be enforced on %s tunnels", protocol)
+		case server && limit.Upload > 0:
+			return fmt.Errorf("limits.%s.upload cannot be enforced by a %s server, set it on the client", names[i], protocol)
+		case !server && limit.Download > 0:
+			return fmt.Errorf("limits.%s.download cannot be enforced by a %s client, set it on the server", names[i], protocol)
+		}
+	}
+	if !server && l.Ip != nil {
+		return errors.New("limits.ip only applies to servers, a client does not know the external addresses")
+	}
+	return nil
+}
+
+// rate returns the rate and burst of direction dir, a zero rate is no limit
+func (l *Limit) rate(dir int) (rate, burst float64) {
+	if l == nil {
+		return 0, 0
+	}
+	rate = float64(l.Upload)
+	if dir == DOWNLOAD {
+		rate = float64(l.Download)
+	}
+	burst = float64(l.Burst)
+	if burst <= 0 {
+		burst = rate
+	}
+	return rate, burst
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) refill(rate, burst float64, now time.Time) {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+	}
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+}
+
+// Limiter applies the Limits and the Quota of a tunnel to its sessions.
+// Endpoints that are given the same Limiter share its buckets, Set and
+// SetQuota change the limits of the running sessions.
+type Limiter struct {
+	mutex     sync.Mutex
+	limits    Limits
+	tunnel    [2]bucket
+	ips       map[string]*ipBuckets
+	quota     *Quota
+	quotaKey  string
+	counter   *quotaCounter
+	exhausted bool
+	floor     [2]bucket
+}
+
+type ipBuckets struct {
+	buckets  [2]bucket
+	sessions int
+}
+
+func NewLimiter(limits *Limits) *Limiter {
+	l := &Limiter{ips: make(map[string]*ipBuckets)}
+	l.Set(limits)
+	return l
+}
+
+// Set replaces the limits, nil removes them
+func (l *Limiter) Set(limits *Limits) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.limits = Limits{}
+	if limits != nil {
+		l.limits = *limits
+	}
+}
+
+// open starts limiting a session of the external address ip, which is empty
+// when it is unknown. ok is false when the quota ran out and refuses sessions.
+func (l *Limiter) open(ip string) (f *flow, ok bool) {
+	if l == nil {
+		return nil, true
+	}
+	l.checkQuota()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.exhausted && l.quota != nil && !l.quota.throttles() {
+		return nil, false
+	}
+	if ip != "" {
+		b, ok := l.ips[ip]
+		if !ok {
+			b = &ipBuckets{}
+			l.ips[ip] = b
+		}
+		b.sessions++
+	}
+	return &flow{limiter: l, ip: ip}, true
+}
+
+// flow is the limited traffic of one session
+type flow struct {
+	limiter *Limiter
+	ip      string
+	session [2]bucket
+	closed  bool
+}
+
+func (f *flow) close() {
+	if f == nil {
+		return
+	}
+	l := f.limiter
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if f.closed {
+		return
+	}
+	f.closed = true
+	if b, ok := l.ips[f.ip]; ok {
+		b.sessions--
+		if b.sessions == 0 {
+			delete(l.ips, f.ip)
+		}
+	}
+}
+
+// count adds the traffic of the session to the quota of its tunnel
+func (f *flow) count(n int) {
+	if f != nil {
+		f.limiter.count(n)
+	}
+}
+
+// buckets calls take with every bucket that limits direction dir, the caller holds the mutex
+func (f *flow) buckets(dir int, take func(b *bucket, rate, burst float64)) {
+	l := f.limiter
+	if rate, burst := l.limits.Tunnel.rate(dir); rate > 0 {
+		take(&l.tunnel[dir], rate, burst)
+	}
+	if rate, burst := l.limits.Session.rate(dir); rate > 0 {
+		take(&f.session[dir], rate, burst)
+	}
+	if b, ok := l.ips[f.ip]; ok {
+		if rate, burst := l.limits.Ip.rate(dir); rate > 0 {
+			take(&b.buckets[dir], rate, burst)
+		}
+	}
+	if l.exhausted && l.quota != nil && l.quota.throttles() {
+		take(&l.floor[dir], float64(l.quota.Floor), float64(l.quota.Floor))
+	}
+}
+
+// wait takes n bytes from the buckets of direction dir, sleeping until they
+// are earned. Streams are held back this way.
+func (f *flow) wait(dir int, n int) {
+	if f == nil {
+		return
+	}
+	var delay time.Duration
+	f.limiter.mutex.Lock()
+	now := time.Now()
+	f.buckets(dir, func(b *bucket, rate, burst float64) {
+		b.refill(rate, burst, now)
+		b.tokens -= float64(n)
+		if b.tokens < 0 {
+			if d := time.Duration(-b.tokens / rate * float64(time.Second)); d > delay {
+				delay = d
+			}
+		}
+	})
+	f.limiter.mutex.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// allow takes n bytes from the buckets of direction dir when all of them hold
+// enough, datagrams that are not allowed are dropped. A full bucket lets any
+// datagram pass.
+func (f *flow) allow(dir int, n int) bool {
+	if f == nil {
+		return true
+	}
+	f.limiter.mutex.Lock()
+	defer f.limiter.mutex.Unlock()
+	now := time.Now()
+	allowed := true
+	f.buckets(dir, func(b *bucket, rate, burst float64) {
+		b.refill(rate, burst, now)
+		if b.tokens < float64(n) && b.tokens < burst {
+			allowed = false
+		}
+	})
+	if allowed {
+		f.buckets(dir, func(b *bucket, rate, burst float64) {
+			b.tokens -= float64(n)
+		})
+	}
+	return allowed
+}
+
+// ipOf returns the IP of an external address, empty for addresses without one
+func ipOf(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
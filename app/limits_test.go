@@ -0,0 +1,99 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_bucketRefill(t *testing.T) {
+	start := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name    string
+		bucket  bucket
+		elapsed time.Duration
+		want    float64
+	}{
+		{"starts full", bucket{}, 0, 1000},
+		{"earns the rate", bucket{last: start}, 100 * time.Millisecond, 50},
+		{"pays off a debt", bucket{tokens: -500, last: start}, time.Second, 0},
+		{"stops at the burst", bucket{tokens: 900, last: start}, time.Second, 1000},
+	}
+	for _, c := range cases {
+		c.bucket.refill(500, 1000, start.Add(c.elapsed))
+		if c.bucket.tokens != c.want {
+			t.Errorf("%s: %v tokens, want %v", c.name, c.bucket.tokens, c.want)
+		}
+	}
+}
+
+func Test_flowAllow(t *testing.T) {
+	cases := []struct {
+		name    string
+		limits  Limits
+		dir     int
+		sizes   []int
+		allowed []bool
+	}{
+		{"within the burst", Limits{Session: &Limit{Upload: 1000}}, UPLOAD,
+			[]int{400, 400, 400}, []bool{true, true, false}},
+		{"a full bucket lets a large datagram pass", Limits{Session: &Limit{Upload: 1000}}, UPLOAD,
+			[]int{1500, 10}, []bool{true, false}},
+		{"other direction unlimited", Limits{Session: &Limit{Upload: 1000}}, DOWNLOAD,
+			[]int{1500, 1500}, []bool{true, true}},
+		{"explicit burst", Limits{Tunnel: &Limit{Download: 1000, Burst: 3000}}, DOWNLOAD,
+			[]int{1000, 1000, 1000, 1000}, []bool{true, true, true, false}},
+		{"tightest bucket wins", Limits{Tunnel: &Limit{Upload: 10000}, Session: &Limit{Upload: 500}}, UPLOAD,
+			[]int{500, 500}, []bool{true, false}},
+		{"no limits", Limits{}, UPLOAD,
+			[]int{1 << 20, 1 << 20}, []bool{true, true}},
+	}
+	for _, c := range cases {
+		f, ok := NewLimiter(&c.limits).open("")
+		if !ok {
+			t.Fatalf("%s: session refused", c.name)
+		}
+		for i, n := range c.sizes {
+			if got := f.allow(c.dir, n); got != c.allowed[i] {
+				t.Errorf("%s: datagram %d of %d bytes allowed = %v", c.name, i, n, got)
+			}
+		}
+		f.close()
+	}
+}
+
+func Test_flowWait(t *testing.T) {
+	cases := []struct {
+		name     string
+		limits   Limits
+		sessions int
+		sizes    []int
+		min      time.Duration
+		max      time.Duration
+	}{
+		{"burst passes at once", Limits{Session: &Limit{Upload: 10000}}, 1, []int{10000}, 0, 50 * time.Millisecond},
+		{"beyond the burst waits", Limits{Session: &Limit{Upload: 10000, Burst: 1000}}, 1, []int{1000, 1000, 1000}, 180 * time.Millisecond, time.Second},
+		{"sessions have their own buckets", Limits{Session: &Limit{Upload: 10000, Burst: 1000}}, 2, []int{1000, 1000}, 0, 50 * time.Millisecond},
+		{"ip buckets are shared", Limits{Ip: &Limit{Upload: 10000, Burst: 1000}}, 2, []int{1000, 1000}, 80 * time.Millisecond, time.Second},
+		{"tunnel buckets are shared", Limits{Tunnel: &Limit{Upload: 10000, Burst: 1000}}, 2, []int{1000, 1000}, 80 * time.Millisecond, time.Second},
+	}
+	for _, c := range cases {
+		l := NewLimiter(&c.limits)
+		flows := make([]*flow, c.sessions)
+		for i := range flows {
+			flows[i], _ = l.open("203.0.113.7")
+		}
+		started := time.Now()
+		for i, n := range c.sizes {
+			flows[i%len(flows)].wait(UPLOAD, n)
+		}
+		if elapsed := time.Since(started); elapsed < c.min || elapsed > c.max {
+			t.Errorf("%s: took %v, want %v to %v", c.name, elapsed, c.min, c.max)
+		}
+		for _, f := range flows {
+			f.close()
+		}
+		if len(l.ips) != 0 {
+			t.Errorf("%s: ip buckets left after the sessions closed", c.name)
+		}
+	}
+}
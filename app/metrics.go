@@ -0,0 +1,163 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics are the counters of one endpoint of a tunnel. Bytes in are received
+// from the peer (external connections on a server, the local service on a
+// client) and bytes out are sent to it, frames are counted on the internal
+// link. Endpoints that are given the same Metrics keep counting across restarts.
+type Metrics struct {
+	Tunnel         string  `json:"tunnel"`
+	Protocol       string  `json:"protocol"`
+	BytesIn        int64   `json:"bytes_in"`
+	BytesOut       int64   `json:"bytes_out"`
+	FramesIn       int64   `json:"frames_in"`
+	FramesOut      int64   `json:"frames_out"`
+	SessionsOpened int64   `json:"sessions_opened"`
+	SessionsClosed int64   `json:"sessions_closed"`
+	DialFailures   int64   `json:"dial_failures"`
+	Reconnects     int64   `json:"reconnects"`
+	LinkUp         int64   `json:"link_up"`
+	KeepaliveRtt   float64 `json:"keepalive_rtt"`
+	Dropped        int64   `json:"dropped"`
+
+	rtt       int64
+	connected int32
+}
+
+func newMetrics(tunnel, protocol string) *Metrics {
+	return &Metrics{Tunnel: tunnel, Protocol: protocol}
+}
+
+func (m *Metrics) add(counter *int64, n int) {
+	atomic.AddInt64(counter, int64(n))
+}
+
+// linkUp records that the internal link is up, every time it comes up after
+// the first one is a reconnect
+func (m *Metrics) linkUp() {
+	if !atomic.CompareAndSwapInt64(&m.LinkUp, 0, 1) {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&m.connected, 0, 1) {
+		atomic.AddInt64(&m.Reconnects, 1)
+	}
+}
+
+func (m *Metrics) linkDown() {
+	atomic.StoreInt64(&m.LinkUp, 0)
+}
+
+func (m *Metrics) setRtt(rtt time.Duration) {
+	atomic.StoreInt64(&m.rtt, int64(rtt))
+}
+
+// Snapshot returns a copy of the counters
+func (m *Metrics) Snapshot() Metrics {
+	return Metrics{
+		Tunnel:         m.Tunnel,
+		Protocol:       m.Protocol,
+		BytesIn:        atomic.LoadInt64(&m.BytesIn),
+		BytesOut:       atomic.LoadInt64(&m.BytesOut),
+		FramesIn:       atomic.LoadInt64(&m.FramesIn),
+		FramesOut:      atomic.LoadInt64(&m.FramesOut),
+		SessionsOpened: atomic.LoadInt64(&m.SessionsOpened),
+		SessionsClosed: atomic.LoadInt64(&m.SessionsClosed),
+		DialFailures:   atomic.LoadInt64(&m.DialFailures),
+		Reconnects:     atomic.LoadInt64(&m.Reconnects),
+		LinkUp:         atomic.LoadInt64(&m.LinkUp),
+		KeepaliveRtt:   time.Duration(atomic.LoadInt64(&m.rtt)).Seconds(),
+		Dropped:        atomic.LoadInt64(&m.Dropped),
+	}
+}
+
+type metricFamily struct {
+	name  string
+	kind  string
+	help  string
+	label string
+	value func(m *Metrics) []float64
+}
+
+var metricFamilies = []metricFamily{
+	{"ezturp_bytes_total", "counter", "Bytes received from (in) and sent to (out) the peers of a tunnel.", "direction",
+		func(m *Metrics) []float64 { return []float64{float64(m.BytesIn), float64(m.BytesOut)} }},
+	{"ezturp_frames_total", "counter", "Frames received from (in) and sent to (out) the internal link.", "direction",
+		func(m *Metrics) []float64 { return []float64{float64(m.FramesIn), float64(m.FramesOut)} }},
+	{"ezturp_sessions_opened_total", "counter", "Sessions opened.", "",
+		func(m *Metrics) []float64 { return []float64{float64(m.SessionsOpened)} }},
+	{"ezturp_sessions_closed_total", "counter", "Sessions closed.", "",
+		func(m *Metrics) []float64 { return []float64{float64(m.SessionsClosed)} }},
+	{"ezturp_local_dial_failures_total", "counter", "Failed dials to the local service.", "",
+		func(m *Metrics) []float64 { return []float64{float64(m.DialFailures)} }},
+	{"ezturp_reconnects_total", "counter", "Times the internal link came up again.", "",
+		func(m *Metrics) []float64 { return []float64{float64(m.Reconnects)} }},
+	{"ezturp_link_up", "gauge", "Whether the internal link is up.", "",
+		func(m *Metrics) []float64 { return []float64{float64(m.LinkUp)} }},
+	{"ezturp_keepalive_rtt_seconds", "gauge", "Round trip time of the last keepalive on the internal link.", "",
+		func(m *Metrics) []float64 { return []float64{m.KeepaliveRtt} }},
+	{"ezturp_udp_dropped_total", "counter", "UDP datagrams dropped.", "",
+		func(m *Metrics) []float64 { return []float64{float64(m.Dropped)} }},
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// WriteMetrics writes metrics in the Prometheus text format
+func WriteMetrics(w io.Writer, metrics []Metrics) error {
+	var b strings.Builder
+	for _, f := range metricFamilies {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		for i := range metrics {
+			m := &metrics[i]
+			labels := fmt.Sprintf(`tunnel="%s",protocol="%s"`, labelEscaper.Replace(m.Tunnel), labelEscaper.Replace(m.Protocol))
+			values := f.value(m)
+			if f.label == "" {
+				fmt.Fprintf(&b, "%s{%s} %v\n", f.name, labels, values[0])
+				continue
+			}
+			fmt.Fprintf(&b, "%s{%s,%s=\"in\"} %v\n", f.name, labels, f.label, values[0])
+			fmt.Fprintf(&b, "%s{%s,%s=\"out\"} %v\n", f.name, labels, f.label, values[1])
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+var quotaFamilies = []struct {
+	name  string
+	help  string
+	value func(q *QuotaState) float64
+}{
+	{"ezturp_quota_limit_bytes", "Traffic allowed in the current quota period.",
+		func(q *QuotaState) float64 { return float64(q.Limit) }},
+	{"ezturp_quota_used_bytes", "Traffic used in the current quota period.",
+		func(q *QuotaState) float64 { return float64(q.Used) }},
+	{"ezturp_quota_exhausted", "Whether the quota of the current period ran out.",
+		func(q *QuotaState) float64 {
+			if q.Exhausted {
+				return 1
+			}
+			return 0
+		}},
+}
+
+// WriteQuotaMetrics writes the quotas of the tunnels in the Prometheus text format
+func WriteQuotaMetrics(w io.Writer, quotas []QuotaState) error {
+	var b strings.Builder
+	for _, f := range quotaFamilies {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", f.name, f.help, f.name)
+		for i := range quotas {
+			q := &quotas[i]
+			fmt.Fprintf(&b, "%s{tunnel=\"%s\",protocol=\"%s\"} %v\n", f.name,
+				labelEscaper.Replace(q.Tunnel), labelEscaper.Replace(q.Protocol), f.value(q))
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
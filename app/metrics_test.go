@@ -0,0 +1,166 @@
+package app
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_WriteMetrics(t *testing.T) {
+	var b strings.Builder
+	metrics := []Metrics{
+		{Tunnel: "web", Protocol: TCP, BytesIn: 120, BytesOut: 4096, SessionsOpened: 3, LinkUp: 1, KeepaliveRtt: 0.025},
+		{Tunnel: `say "hi"`, Protocol: UDP, Dropped: 2},
+	}
+	if err := WriteMetrics(&b, metrics); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"# HELP ezturp_bytes_total Bytes received from (in) and sent to (out) the peers of a tunnel.",
+		"# TYPE ezturp_bytes_total counter",
+		`ezturp_bytes_total{tunnel="web",protocol="tcp",direction="in"} 120`,
+		`ezturp_bytes_total{tunnel="web",protocol="tcp",direction="out"} 4096`,
+		`ezturp_sessions_opened_total{tunnel="web",protocol="tcp"} 3`,
+		"# TYPE ezturp_link_up gauge",
+		`ezturp_link_up{tunnel="web",protocol="tcp"} 1`,
+		`ezturp_keepalive_rtt_seconds{tunnel="web",protocol="tcp"} 0.025`,
+		`ezturp_udp_dropped_total{tunnel="say \"hi\"",protocol="udp"} 2`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("no line %s", line)
+		}
+	}
+	b.Reset()
+	if err := WriteQuotaMetrics(&b, []QuotaState{{Tunnel: "web", Protocol: TCP, Limit: 1 << 20, Used: 512, Exhausted: true}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`ezturp_quota_limit_bytes{tunnel="web",protocol="tcp"} 1.048576e+06`,
+		`ezturp_quota_used_bytes{tunnel="web",protocol="tcp"} 512`,
+		`ezturp_quota_exhausted{tunnel="web",protocol="tcp"} 1`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("no line %s in\n%s", line, b.String())
+		}
+	}
+}
+
+func Test_metricsLink(t *testing.T) {
+	m := newMetrics("web", TCP)
+	m.linkUp()
+	m.linkUp()
+	if s := m.Snapshot(); s.LinkUp != 1 || s.Reconnects != 0 {
+		t.Errorf("first link : %+v", s)
+	}
+	for i := 0; i < 2; i++ {
+		m.linkDown()
+		m.linkUp()
+	}
+	m.setRtt(40 * time.Millisecond)
+	if s := m.Snapshot(); s.LinkUp != 1 || s.Reconnects != 2 || s.KeepaliveRtt != 0.04 {
+		t.Errorf("after two reconnects : %+v", s)
+	}
+	// a tunnel that comes back gets its counters back
+	e := &entry{}
+	first := e.metricsOf("game", UDP)
+	if e.metricsOf("game", UDP) != first || e.metricsOf("game", TCP) == first {
+		t.Error("metrics not kept per tunnel and protocol")
+	}
+}
+
+func Test_tcpTunnelMetrics(t *testing.T) {
+	echo, err := net.Listen(TCP, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	internal, err := net.Listen(TCP, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	external, err := net.Listen(TCP, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &TcpServer{Name: "web", Metrics: newMetrics("web", TCP)}
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(internal, external)
+	}()
+	defer func() {
+		_ = s.Close()
+		<-served
+	}()
+	c := &TcpClient{Name: "web", LocalAddr: echo.Addr().String(), Metrics: newMetrics("web", TCP)}
+	connected := make(chan error, 1)
+	go func() {
+		connected <- c.Connect(internal.Addr().String())
+	}()
+	defer func() {
+		_ = c.Close()
+		<-connected
+	}()
+	for s.internalNil() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn, err := net.Dial(TCP, external.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 4)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+		t.Fatalf("echoed %q : %v", got, err)
+	}
+	_ = conn.Close()
+	for deadline := time.Now().Add(time.Second); s.Metrics.Snapshot().SessionsClosed == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("session not counted as closed")
+		}
+	}
+	server, client := s.Metrics.Snapshot(), c.Metrics.Snapshot()
+	if server.BytesIn != 4 || server.BytesOut != 4 || server.SessionsOpened != 1 || server.LinkUp != 1 || server.FramesOut == 0 {
+		t.Errorf("server counted %+v", server)
+	}
+	if client.BytesIn != 4 || client.BytesOut != 4 || client.SessionsOpened != 1 || client.LinkUp != 1 || client.FramesIn == 0 {
+		t.Errorf("client counted %+v", client)
+	}
+}
+
+func Test_adminMetrics(t *testing.T) {
+	s := &AdminServer{Token: "t0ken", Manager: &adminManager{}}
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer t0ken")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Fatalf("%d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	for _, line := range []string{
+		`ezturp_sessions_opened_total{tunnel="web",protocol="tcp"} 5`,
+		`ezturp_quota_used_bytes{tunnel="web",protocol="tcp"} 100`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("no line %s", line)
+		}
+	}
+}
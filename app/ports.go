@@ -0,0 +1,145 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+type portRange struct {
+	first int
+	last  int
+}
+
+// PortRanges is a list such as "20000-20100,30000"
+type PortRanges []portRange
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || port < 0 || port > 65535 {
+		return 0, fmt.Errorf("invalid port '%s'", s)
+	}
+	return port, nil
+}
+
+func ParsePortRanges(s string) (PortRanges, error) {
+	var ranges PortRanges
+	for _, part := range strings.Split(s, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		first, last, found := strings.Cut(part, "-")
+		from, err := parsePort(first)
+		if err != nil {
+			return nil, err
+		}
+		to := from
+		if found {
+			to, err = parsePort(last)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if to < from {
+			return nil, fmt.Errorf("invalid port range '%s'", part)
+		}
+		ranges = append(ranges, portRange{from, to})
+	}
+	return ranges, nil
+}
+
+func (r PortRanges) Contains(port int) bool {
+	for _, pr := range r {
+		if port >= pr.first && port <= pr.last {
+			return true
+		}
+	}
+	return false
+}
+
+// Ports lists every port of the ranges in order
+func (r PortRanges) Ports() []int {
+	var ports []int
+	for _, pr := range r {
+		for port := pr.first; port <= pr.last; port++ {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+// encodeSessionPort is the session metadata of a port-range tunnel: the external
+// port a session arrived on and the position of that port in the range
+func encodeSessionPort(port, index int) []byte {
+	return []byte{byte(port >> 8), byte(port), byte(index >> 8), byte(index)}
+}
+
+func decodeSessionPort(data []byte) (port, index int, err error) {
+	if len(data) < 4 {
+		return 0, 0, fmt.Errorf("bad session port metadata %v", data)
+	}
+	return int(data[0])<<8 | int(data[1]), int(data[2])<<8 | int(data[3]), nil
+}
+
+// hostOf strips the port from address, address may also be a bare host
+func hostOf(address string) string {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
+
+func portOf(addr net.Addr) int {
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+// listenPorts opens one listener per port with listen, closing them all on failure
+func listenPorts(host string, ranges PortRanges, listen func(string) (io.Closer, error)) ([]io.Closer, error) {
+	ports := ranges.Ports()
+	if len(ports) == 0 {
+		return nil, errors.New("empty port range")
+	}
+	var listeners []io.Closer
+	for _, port := range ports {
+		l, err := listen(net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			for _, opened := range listeners {
+				_ = opened.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// localDialer returns the dial function of a session. Sessions of a port-range
+// tunnel carry their external port in meta and dial the matching port of
+// localPorts, or the external port itself when localPorts is empty.
+func localDialer(dial func(string) (net.Conn, error), localPorts PortRanges, meta []byte) (func(string) (net.Conn, error), error) {
+	if len(meta) == 0 {
+		return dial, nil
+	}
+	port, index, err := decodeSessionPort(meta)
+	if err != nil {
+		return nil, err
+	}
+	if len(localPorts) > 0 {
+		ports := localPorts.Ports()
+		if index >= len(ports) {
+			return nil, fmt.Errorf("external port %d has no local port", port)
+		}
+		port = ports[index]
+	}
+	return func(address string) (net.Conn, error) {
+		return dial(net.JoinHostPort(hostOf(address), strconv.Itoa(port)))
+	}, nil
+}
@@ -0,0 +1,43 @@
+package app
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_ParsePortRanges(t *testing.T) {
+	cases := []struct {
+		spec  string
+		ports []int
+		ok    bool
+	}{
+		{"", nil, true},
+		{"8080", []int{8080}, true},
+		{"20000-20003", []int{20000, 20001, 20002, 20003}, true},
+		{" 30000 , 20000-20001 ,", []int{30000, 20000, 20001}, true},
+		{"5-5", []int{5}, true},
+		{"0", []int{0}, true},
+		{"65535", []int{65535}, true},
+		{"65536", nil, false},
+		{"-1", nil, false},
+		{"20003-20000", nil, false},
+		{"http", nil, false},
+		{"1-2-3", nil, false},
+	}
+	for _, c := range cases {
+		ranges, err := ParsePortRanges(c.spec)
+		if (err == nil) != c.ok {
+			t.Errorf("%q: error %v", c.spec, err)
+			continue
+		}
+		if ports := ranges.Ports(); c.ok && !reflect.DeepEqual(ports, c.ports) {
+			t.Errorf("%q: got ports %v, want %v", c.spec, ports, c.ports)
+		}
+	}
+	ranges, _ := ParsePortRanges("100-199,300")
+	for port, in := range map[int]bool{99: false, 100: true, 150: true, 199: true, 200: false, 300: true, 301: false} {
+		if ranges.Contains(port) != in {
+			t.Errorf("Contains(%d) = %v", port, !in)
+		}
+	}
+}
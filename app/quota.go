@@ -0,0 +1,334 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"ezturp/protocol"
+	"ezturp/tools"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	QUOTA_DAY      = "day"
+	QUOTA_MONTH    = "month"
+	QUOTA_REFUSE   = "refuse"
+	QUOTA_THROTTLE = "throttle"
+	QUOTA_SAVE     = 30 * time.Second
+)
+
+// Quota caps the traffic of a tunnel, in both directions together, over a
+// calendar day or month. When it runs out the tunnel refuses new sessions,
+// or with the throttle action its sessions are limited to Floor bytes per
+// second in each direction until the next period.
+type Quota struct {
+	Limit  ByteSize `json:"limit"`
+	Period string   `json:"period"`
+	Action string   `json:"action,omitempty"`
+	Floor  ByteSize `json:"floor,omitempty"`
+}
+
+func (q *Quota) validate() error {
+	if q == nil {
+		return nil
+	}
+	if q.Limit <= 0 {
+		return errors.New("quota.limit is required")
+	}
+	if q.Period != QUOTA_DAY && q.Period != QUOTA_MONTH {
+		return fmt.Errorf("quota.period must be %q or %q", QUOTA_DAY, QUOTA_MONTH)
+	}
+	switch q.Action {
+	case "", QUOTA_REFUSE:
+	case QUOTA_THROTTLE:
+		if q.Floor <= 0 {
+			return errors.New("quota.floor is required to throttle")
+		}
+	default:
+		return fmt.Errorf("quota.action must be %q or %q", QUOTA_REFUSE, QUOTA_THROTTLE)
+	}
+	return nil
+}
+
+func (q *Quota) throttles() bool {
+	return q.Action == QUOTA_THROTTLE
+}
+
+// quotaPeriod names the period of now and returns when it ends
+func quotaPeriod(period string, now time.Time) (string, time.Time) {
+	y, m, d := now.Date()
+	if period == QUOTA_DAY {
+		return now.Format("2006-01-02"), time.Date(y, m, d+1, 0, 0, 0, 0, now.Location())
+	}
+	return now.Format("2006-01"), time.Date(y, m+1, 1, 0, 0, 0, 0, now.Location())
+}
+
+// QuotaUsage is the traffic of a tunnel in the current period, as kept in the state file
+type QuotaUsage struct {
+	Period string `json:"period"`
+	Used   int64  `json:"used"`
+	Limit  int64  `json:"limit"`
+}
+
+// quotaCounter counts the usage of the quota of one tunnel. The limiters of
+// the tunnel share it across reloads, and it knows when its period ends so
+// that counting needs neither the store nor a date.
+type quotaCounter struct {
+	mutex  sync.Mutex
+	usage  QuotaUsage
+	resets time.Time
+	dirty  bool
+}
+
+// add counts n bytes of quota in the period of now, starting a new period
+// when the last one ended
+func (c *quotaCounter) add(quota *Quota, n int64, now time.Time) (QuotaUsage, time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !now.Before(c.resets) {
+		var period string
+		period, c.resets = quotaPeriod(quota.Period, now)
+		if c.usage.Period != period {
+			c.usage.Period, c.usage.Used = period, 0
+			c.dirty = true
+		}
+	}
+	if n > 0 {
+		c.usage.Used += n
+		c.dirty = true
+	}
+	return c.usage, c.resets
+}
+
+// quotaStore keeps the counter of every quota by tunnel, so that the usage
+// survives reloads, and with a state file restarts of the process
+var quotaStore struct {
+	mutex    sync.Mutex
+	path     string
+	counters map[string]*quotaCounter
+}
+
+// counterOf returns the counter of key, the caller holds the store mutex
+func counterOf(key string) *quotaCounter {
+	if quotaStore.counters == nil {
+		quotaStore.counters = make(map[string]*quotaCounter)
+	}
+	c, ok := quotaStore.counters[key]
+	if !ok {
+		c = &quotaCounter{}
+		quotaStore.counters[key] = c
+	}
+	return c
+}
+
+// ReadQuotaState reads the usage kept in a state file
+func ReadQuotaState(path string) (map[string]*QuotaUsage, error) {
+	usage := make(map[string]*QuotaUsage)
+	p, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(p, &usage); err != nil {
+		return nil, fmt.Errorf("quota state %v: %v", path, err)
+	}
+	return usage, nil
+}
+
+// OpenQuotaState loads the usage of the quotas from the file at path, which
+// may not exist yet, and saves it there every QUOTA_SAVE. Call it before the
+// managers start.
+func OpenQuotaState(path string) error {
+	usage, err := ReadQuotaState(path)
+	if errors.Is(err, os.ErrNotExist) {
+		usage, err = make(map[string]*QuotaUsage), nil
+	}
+	if err != nil {
+		return err
+	}
+	quotaStore.mutex.Lock()
+	quotaStore.path = path
+	for key, u := range usage {
+		c := counterOf(key)
+		c.mutex.Lock()
+		c.usage, c.resets = *u, time.Time{}
+		c.mutex.Unlock()
+	}
+	quotaStore.mutex.Unlock()
+	go func() {
+		logger := tools.Logger{Service: "Quota", Name: path}
+		for range time.Tick(QUOTA_SAVE) {
+			if err := SaveQuotaState(); err != nil {
+				logger.Error("failed to save the quota state : %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// SaveQuotaState writes the usage of the quotas to the state file when it changed
+func SaveQuotaState() error {
+	quotaStore.mutex.Lock()
+	path := quotaStore.path
+	if path == "" {
+		quotaStore.mutex.Unlock()
+		return nil
+	}
+	usage := make(map[string]*QuotaUsage, len(quotaStore.counters))
+	dirty := false
+	for key, c := range quotaStore.counters {
+		c.mutex.Lock()
+		u := c.usage
+		dirty = dirty || c.dirty
+		c.dirty = false
+		c.mutex.Unlock()
+		usage[key] = &u
+	}
+	quotaStore.mutex.Unlock()
+	if !dirty {
+		return nil
+	}
+	p, err := json.MarshalIndent(usage, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, p, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// WriteQuotaUsage prints the usage read from a state file
+func WriteQuotaUsage(w io.Writer, usage map[string]*QuotaUsage) {
+	keys := make([]string, 0, len(usage))
+	for key := range usage {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		u := usage[key]
+		state := ""
+		if u.Limit > 0 && u.Used >= u.Limit {
+			state = " exhausted"
+		}
+		fmt.Fprintf(w, "%-30s %-10s %12s of %-12s%s\n", key, u.Period,
+			protocol.BytesFormat(u.Used), protocol.BytesFormat(u.Limit), state)
+	}
+}
+
+// QuotaState is the quota of a running tunnel
+type QuotaState struct {
+	Tunnel    string    `json:"tunnel"`
+	Protocol  string    `json:"protocol"`
+	Period    string    `json:"period"`
+	Limit     int64     `json:"limit"`
+	Used      int64     `json:"used"`
+	Exhausted bool      `json:"exhausted"`
+	Action    string    `json:"action"`
+	Resets    time.Time `json:"resets"`
+}
+
+// SetQuota replaces the quota of the tunnel, nil removes it. key names the
+// tunnel in the state file.
+func (l *Limiter) SetQuota(key string, quota *Quota) {
+	var counter *quotaCounter
+	if quota != nil {
+		quotaStore.mutex.Lock()
+		counter = counterOf(key)
+		quotaStore.mutex.Unlock()
+		counter.mutex.Lock()
+		if counter.usage.Limit != int64(quota.Limit) {
+			counter.usage.Limit = int64(quota.Limit)
+			counter.dirty = true
+		}
+		counter.mutex.Unlock()
+	}
+	l.mutex.Lock()
+	l.quota, l.quotaKey, l.counter = quota, key, counter
+	l.mutex.Unlock()
+	l.checkQuota()
+}
+
+// usage returns the quota with its usage in the current period, after adding n bytes to it
+func (l *Limiter) usage(n int) (*Quota, QuotaUsage, time.Time) {
+	l.mutex.Lock()
+	quota, counter := l.quota, l.counter
+	l.mutex.Unlock()
+	if quota == nil {
+		return nil, QuotaUsage{}, time.Time{}
+	}
+	u, resets := counter.add(quota, int64(n), time.Now())
+	return quota, u, resets
+}
+
+// count adds n bytes of traffic to the quota
+func (l *Limiter) count(n int) {
+	if l == nil || n == 0 {
+		return
+	}
+	quota, u, _ := l.usage(n)
+	if quota == nil {
+		return
+	}
+	l.mutex.Lock()
+	changed := l.exhausted != (u.Used >= int64(quota.Limit))
+	l.mutex.Unlock()
+	if changed {
+		l.checkQuota()
+	}
+}
+
+// checkQuota notes whether the quota is exhausted, logging when it runs out or is renewed
+func (l *Limiter) checkQuota() {
+	quota, u, resets := l.usage(0)
+	exhausted := quota != nil && u.Used >= int64(quota.Limit)
+	l.mutex.Lock()
+	changed := exhausted != l.exhausted
+	l.exhausted = exhausted
+	key := l.quotaKey
+	l.mutex.Unlock()
+	if !changed {
+		return
+	}
+	logger := tools.Logger{Service: "Quota", Name: key}
+	switch {
+	case quota == nil:
+	case !exhausted:
+		logger.Info("quota renewed , %s of %s used", protocol.BytesFormat(u.Used), protocol.BytesFormat(int64(quota.Limit)))
+	case quota.throttles():
+		logger.Warn("quota of %s exhausted , throttled to %s/s until %v",
+			protocol.BytesFormat(int64(quota.Limit)), protocol.BytesFormat(int64(quota.Floor)), resets.Format(time.RFC3339))
+	default:
+		logger.Warn("quota of %s exhausted , refusing new sessions until %v",
+			protocol.BytesFormat(int64(quota.Limit)), resets.Format(time.RFC3339))
+	}
+}
+
+// quotaState reports the quota of the tunnel, ok is false when it has none
+func (l *Limiter) quotaState(tunnel, protocol string) (QuotaState, bool) {
+	if l == nil {
+		return QuotaState{}, false
+	}
+	quota, u, resets := l.usage(0)
+	if quota == nil {
+		return QuotaState{}, false
+	}
+	action := quota.Action
+	if action == "" {
+		action = QUOTA_REFUSE
+	}
+	return QuotaState{
+		Tunnel:    tunnel,
+		Protocol:  protocol,
+		Period:    u.Period,
+		Limit:     int64(quota.Limit),
+		Used:      u.Used,
+		Exhausted: u.Used >= int64(quota.Limit),
+		Action:    action,
+		Resets:    resets,
+	}, true
+}
@@ -0,0 +1,94 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_quotaPeriod(t *testing.T) {
+	cases := []struct {
+		period string
+		now    time.Time
+		name   string
+		end    time.Time
+	}{
+		{QUOTA_DAY, time.Date(2026, 10, 19, 13, 0, 0, 0, time.UTC), "2026-10-19", time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC)},
+		{QUOTA_DAY, time.Date(2026, 12, 31, 23, 59, 59, 0, time.UTC), "2026-12-31", time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{QUOTA_MONTH, time.Date(2026, 10, 19, 13, 0, 0, 0, time.UTC), "2026-10", time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)},
+		{QUOTA_MONTH, time.Date(2026, 12, 1, 0, 0, 0, 0, time.UTC), "2026-12", time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		name, end := quotaPeriod(c.period, c.now)
+		if name != c.name || !end.Equal(c.end) {
+			t.Errorf("%s of %v: got %s until %v, want %s until %v", c.period, c.now, name, end, c.name, c.end)
+		}
+	}
+}
+
+func Test_quotaCounterRollover(t *testing.T) {
+	quota := &Quota{Limit: 1000, Period: QUOTA_DAY}
+	day := time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)
+	counter := &quotaCounter{usage: QuotaUsage{Period: "2026-10-18", Used: 900}}
+	cases := []struct {
+		name   string
+		n      int64
+		now    time.Time
+		period string
+		used   int64
+	}{
+		{"usage of a past day is dropped", 100, day.Add(time.Hour), "2026-10-19", 100},
+		{"same day adds up", 400, day.Add(23 * time.Hour), "2026-10-19", 500},
+		{"last nanosecond of the day", 1, day.Add(24*time.Hour - 1), "2026-10-19", 501},
+		{"next day starts over", 50, day.Add(24 * time.Hour), "2026-10-20", 50},
+		{"reading counts nothing", 0, day.Add(25 * time.Hour), "2026-10-20", 50},
+	}
+	for _, c := range cases {
+		u, resets := counter.add(quota, c.n, c.now)
+		if u.Period != c.period || u.Used != c.used {
+			t.Errorf("%s: got %s %d, want %s %d", c.name, u.Period, u.Used, c.period, c.used)
+		}
+		if !c.now.Before(resets) {
+			t.Errorf("%s: resets at %v, before %v", c.name, resets, c.now)
+		}
+	}
+}
+
+func Test_limiterQuota(t *testing.T) {
+	cases := []struct {
+		name  string
+		quota *Quota
+		count int
+		open  bool
+	}{
+		{"under the quota", &Quota{Limit: 1000, Period: QUOTA_MONTH}, 999, true},
+		{"refused once exhausted", &Quota{Limit: 1000, Period: QUOTA_MONTH}, 1000, false},
+		{"throttled once exhausted", &Quota{Limit: 1000, Period: QUOTA_MONTH, Action: QUOTA_THROTTLE, Floor: 10}, 1000, true},
+		{"no quota", nil, 1 << 20, true},
+	}
+	quotaStore.mutex.Lock()
+	quotaStore.counters = nil
+	quotaStore.mutex.Unlock()
+	for _, c := range cases {
+		l := NewLimiter(nil)
+		l.SetQuota("test "+c.name, c.quota)
+		f, ok := l.open("")
+		if !ok {
+			t.Fatalf("%s: first session refused", c.name)
+		}
+		f.count(c.count)
+		f.close()
+		if _, ok := l.open(""); ok != c.open {
+			t.Errorf("%s: session open = %v, want %v", c.name, ok, c.open)
+		}
+		state, ok := l.quotaState("web", TCP)
+		if ok != (c.quota != nil) || (ok && state.Used != int64(c.count)) {
+			t.Errorf("%s: quota state %+v", c.name, state)
+		}
+		// a limiter of the same tunnel after a reload keeps counting where it was
+		again := NewLimiter(nil)
+		again.SetQuota("test "+c.name, c.quota)
+		if state2, _ := again.quotaState("web", TCP); state2 != state {
+			t.Errorf("%s: reloaded quota state %+v, want %+v", c.name, state2, state)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package app
+
+import (
+	"ezturp/tools"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const (
+	CONFIG_POLL = time.Second
+)
+
+// WatchConfig calls reload with the content of the file at path whenever the
+// file changes or the process receives SIGHUP. It never returns.
+func WatchConfig(path string, reload func([]byte) error) {
+	logger := tools.Logger{Service: "Config", Name: path}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(CONFIG_POLL)
+	defer ticker.Stop()
+	last, _ := os.Stat(path)
+	for {
+		select {
+		case <-hup:
+			logger.Info("SIGHUP received, reloading")
+		case <-ticker.C:
+			info, err := os.Stat(path)
+			if err != nil || (last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size()) {
+				continue
+			}
+			last = info
+			logger.Info("file changed, reloading")
+		}
+		p, err := os.ReadFile(path)
+		if err == nil {
+			err = reload(p)
+		}
+		if err != nil {
+			logger.Error("reload rejected, keeping the running configuration: %v", err)
+		}
+	}
+}
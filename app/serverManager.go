@@ -1,68 +1,540 @@
 package app
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"ezturp/tools"
+	"fmt"
+	"net"
+	"sync"
+	"time"
 )
 
 type ServerConfig struct {
-	Name            string `json:"name"`
-	Protocol        string `json:"protocol"`
-	InternalAddress string `json:"internal_address"`
-	ExternalAddress string `json:"external_address"`
+	Name            string           `json:"name"`
+	Protocol        string           `json:"protocol"`
+	InternalAddress string           `json:"internal_address"`
+	ExternalAddress string           `json:"external_address"`
+	ExternalPorts   string           `json:"external_ports"`
+	Mtu             int              `json:"mtu"`
+	IdleTimeout     Duration         `json:"idle_timeout"`
+	Balance         string           `json:"balance"`
+	ClientKeys      []string         `json:"client_keys"`
+	Secret          string           `json:"secret"`
+	Restart         *RestartPolicy   `json:"restart"`
+	Clients         []*ControlClient `json:"clients"`
+	InternalPorts   string           `json:"internal_ports"`
+	Host            string           `json:"host"`
+	XForwarded      bool             `json:"x_forwarded"`
+	Default         bool             `json:"default"`
+	Tls             *TlsConfig       `json:"tls"`
+	Auth            *AuthConfig      `json:"auth"`
+	Limits          *Limits          `json:"limits"`
+	Quota           *Quota           `json:"quota"`
 }
 
 type ServerManager struct {
 	logger tools.Logger
+	set    entrySet
+
+	routerMutex sync.Mutex
+	routers     map[string]*routerEntry
+}
+
+type routerEntry struct {
+	router *vhostRouter
+	tunnel *tunnel
 }
 
 func LoadServerConfigsFromJson(p []byte) []*ServerConfig {
-	var configs []*ServerConfig
-	err := json.Unmarshal(p, &configs)
+	configs, err := ParseServerConfigs(p)
 	if err != nil {
 		panic(err)
 	}
 	return configs
 }
 
+func ParseServerConfigs(p []byte) ([]*ServerConfig, error) {
+	var configs []*ServerConfig
+	err := json.Unmarshal(p, &configs)
+	return configs, err
+}
+
 func StartServerManager(name string, configs []*ServerConfig) *ServerManager {
 	cm := &ServerManager{logger: tools.Logger{
 		Service: "ServerManager",
 		Name:    name,
-	}}
+	}, routers: make(map[string]*routerEntry)}
+	cm.set.logger = &cm.logger
+	cm.set.role = "server"
+	cm.set.started = time.Now()
 	var cnt int
-	for _, cfg := range configs {
-		switch cfg.Protocol {
-		case UDP:
-			go cm.runUdpServer(cfg)
-		case TCP:
-			go cm.runTcpServer(cfg)
-		default:
-			cm.logger.Error("unsupported protocol %s", cfg.Protocol)
-			panic(cfg.Protocol)
+	_ = cm.set.change(func() error {
+		cm.apply(configs)
+		for _, e := range cm.set.entries {
+			if !e.invalid {
+				cnt++
+			}
 		}
-	}
+		return nil
+	})
 	cm.logger.Info("server manager started , %d servers running", cnt)
 	return cm
 }
 
-func (cm *ServerManager) runUdpServer(config *ServerConfig) {
-	for {
-		s := &UdpServer{Name: config.Name}
-		err := s.Listen(config.InternalAddress, config.ExternalAddress)
+// Reload replaces the running configuration with configs. Entries are matched
+// by protocol and name: new entries are started, missing ones are stopped and
+// changed ones are restarted, the others keep running undisturbed. When an
+// entry of configs is invalid nothing changes and the error is returned.
+func (cm *ServerManager) Reload(configs []*ServerConfig) error {
+	return cm.set.change(func() error {
+		seen := make(map[string]int)
+		for _, cfg := range configs {
+			if cm.set.unchanged(entryKey(seen, cfg.Protocol, cfg.Name), cfg) != nil {
+				continue
+			}
+			if _, err := cm.prepare(cfg); err != nil {
+				return fmt.Errorf("%s %v: %v", cfg.Protocol, cfg.Name, err)
+			}
+		}
+		conflicts := mixedTls(configs)
+		for i, cfg := range configs {
+			if err, ok := conflicts[i]; ok {
+				return fmt.Errorf("%s %v: %v", cfg.Protocol, cfg.Name, err)
+			}
+		}
+		added, removed, restarted := cm.apply(configs)
+		cm.logger.Info("configuration reloaded , %d added , %d removed , %d restarted , %d unchanged",
+			added, removed, restarted, len(configs)-added-restarted)
+		return nil
+	})
+}
+
+// AddTunnel starts a tunnel for config next to the running ones
+func (cm *ServerManager) AddTunnel(config *ServerConfig) error {
+	return cm.set.change(func() error {
+		if _, err := cm.set.find(config.Name, config.Protocol); err == nil {
+			return fmt.Errorf("tunnel %s %v already exists", config.Protocol, config.Name)
+		}
+		if _, err := cm.prepare(config); err != nil {
+			return err
+		}
+		configs := append(cm.configs(), config)
+		if err, ok := mixedTls(configs)[len(configs)-1]; ok {
+			return err
+		}
+		cm.apply(configs)
+		cm.logger.Info("%s server %v added", config.Protocol, config.Name)
+		return nil
+	})
+}
+
+// AddTunnelJson starts a tunnel for a configuration entry written in JSON
+func (cm *ServerManager) AddTunnelJson(p []byte) error {
+	var config ServerConfig
+	if err := json.Unmarshal(p, &config); err != nil {
+		return err
+	}
+	return cm.AddTunnel(&config)
+}
+
+// RemoveTunnel stops the tunnel called name and forgets its entry, protocol
+// may be left empty when no other tunnel has the same name
+func (cm *ServerManager) RemoveTunnel(name, protocol string) error {
+	return cm.set.change(func() error {
+		key, err := cm.set.find(name, protocol)
 		if err != nil {
-			cm.logger.Error("udp server %v error: %v ", config.Name, err)
+			return err
+		}
+		keys, entries := cm.set.without(key)
+		cm.set.replace(keys, entries, cm.updateRouters)
+		return nil
+	})
+}
+
+// EnableTunnel starts a tunnel that was stopped by DisableTunnel
+func (cm *ServerManager) EnableTunnel(name, protocol string) error {
+	return cm.set.setEnabled(name, protocol, true)
+}
+
+// DisableTunnel stops a tunnel and its sessions until EnableTunnel is called.
+// The entry stays in place, a reload keeps it disabled.
+func (cm *ServerManager) DisableTunnel(name, protocol string) error {
+	return cm.set.setEnabled(name, protocol, false)
+}
+
+// SetLimits changes the bandwidth limits of a tunnel and of its running
+// sessions, nil removes them. They hold until the next reload.
+func (cm *ServerManager) SetLimits(name, protocol string, limits *Limits) error {
+	cm.set.mutex.Lock()
+	defer cm.set.mutex.Unlock()
+	key, err := cm.set.find(name, protocol)
+	if err != nil {
+		return err
+	}
+	cfg := *cm.set.entries[key].config.(*ServerConfig)
+	cfg.Limits = limits
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	if cm.set.retune(key, &cfg, limits, cfg.Quota) == nil {
+		return fmt.Errorf("tunnel %q has an invalid configuration", name)
+	}
+	return nil
+}
+
+// Metrics returns the counters of every tunnel
+func (cm *ServerManager) Metrics() []Metrics {
+	return cm.set.snapshot()
+}
+
+// Totals returns the sessions and bytes of every tunnel
+func (cm *ServerManager) Totals() []TunnelTotals {
+	return sumTotals(cm.set.snapshot())
+}
+
+// Status returns the state and traffic of every tunnel
+func (cm *ServerManager) Status() Status {
+	return cm.set.status(cm.logger.Name)
+}
+
+// Quotas returns the quota of every tunnel that has one
+func (cm *ServerManager) Quotas() []QuotaState {
+	return cm.set.quotas()
+}
+
+// Close stops every tunnel, closing their sessions, logs the totals of each
+// tunnel and saves the quota state. The manager cannot be used afterwards.
+func (cm *ServerManager) Close() error {
+	cm.set.close()
+	cm.updateRouters(nil)
+	logTotals(&cm.logger, cm.Totals())
+	return SaveQuotaState()
+}
+
+// Sessions lists the live sessions of every tunnel
+func (cm *ServerManager) Sessions() []SessionInfo {
+	return cm.set.sessions()
+}
+
+// KillSession closes session id of the tunnel called name, of any tunnel when name is empty
+func (cm *ServerManager) KillSession(name string, id uint32) error {
+	return cm.set.killSession(name, id)
+}
+
+func (cm *ServerManager) configs() []*ServerConfig {
+	configs := make([]*ServerConfig, 0, len(cm.set.keys))
+	for _, key := range cm.set.keys {
+		configs = append(configs, cm.set.entries[key].config.(*ServerConfig))
+	}
+	return configs
+}
+
+// apply replaces the entries with configs within a change of the set.
+// Invalid entries are kept as failed tunnels.
+func (cm *ServerManager) apply(configs []*ServerConfig) (added, removed, restarted int) {
+	keys := make([]string, len(configs))
+	next := make(map[string]*entry, len(configs))
+	seen := make(map[string]int)
+	conflicts := mixedTls(configs)
+	for i, cfg := range configs {
+		keys[i] = entryKey(seen, cfg.Protocol, cfg.Name)
+		if err, ok := conflicts[i]; ok {
+			next[keys[i]] = &entry{kind: "server", start: failed(err), invalid: true,
+				name: cfg.Name, protocol: cfg.Protocol, config: cfg, restart: cfg.Restart}
+			continue
+		}
+		e := cm.set.unchanged(keys[i], cfg)
+		if e == nil {
+			e = cm.set.retune(keys[i], cfg, cfg.Limits, cfg.Quota)
 		}
-		cm.logger.Info("udp server %v restart", config.Name)
+		if e == nil {
+			var err error
+			e, err = cm.prepare(cfg)
+			if err != nil {
+				e = &entry{kind: "server", start: failed(err), invalid: true}
+			} else {
+				e.limiter.SetQuota(cm.set.quotaKey(keys[i]), cfg.Quota)
+			}
+			e.name, e.protocol, e.config, e.restart = cfg.Name, cfg.Protocol, cfg, cfg.Restart
+		}
+		next[keys[i]] = e
 	}
+	return cm.set.replace(keys, next, cm.updateRouters)
 }
-func (cm *ServerManager) runTcpServer(config *ServerConfig) {
-	for {
-		s := &TcpServer{Name: config.Name}
-		err := s.Listen(config.InternalAddress, config.ExternalAddress)
+
+// prepare checks an entry and builds the start function of its tunnel
+func (cm *ServerManager) prepare(cfg *ServerConfig) (*entry, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	e := &entry{kind: cfg.Protocol + " server", limiter: NewLimiter(cfg.Limits)}
+	switch cfg.Protocol {
+	case UDP:
+		e.start = cm.udpServer(cfg, e.addMetrics(cfg.Name, UDP), e.limiter)
+	case TCP:
+		start, err := cm.tcpServer(cfg, e.addMetrics(cfg.Name, TCP), e.limiter)
+		if err != nil {
+			return nil, err
+		}
+		e.start = start
+	case TCP_UDP:
+		tcp, err := cm.tcpServer(cfg, e.addMetrics(cfg.Name, TCP), e.limiter)
+		if err != nil {
+			return nil, err
+		}
+		e.start = together(tcp, cm.udpServer(cfg, e.addMetrics(cfg.Name, UDP), e.limiter))
+	case HTTP:
+		e.router = routerKey(HTTP, cfg.ExternalAddress)
+		var certs *certStore
+		if cfg.Tls != nil {
+			var err error
+			certs, err = newCertStore(cfg.Name, cfg.Tls, []string{cfg.Host})
+			if err != nil {
+				return nil, err
+			}
+		}
+		options := routeOptions{xForwarded: cfg.XForwarded, fallback: cfg.Default}
+		if cfg.Auth != nil {
+			auth, err := newHttpAuth(cfg.Name, cfg.Auth)
+			if err != nil {
+				return nil, err
+			}
+			options.auth = auth
+		}
+		e.start = cm.vhostServer(cfg, e.router, options, certs, e.addMetrics(cfg.Name, HTTP), e.limiter)
+	case TLS:
+		e.router = routerKey(TLS, cfg.ExternalAddress)
+		e.start = cm.vhostServer(cfg, e.router, routeOptions{fallback: cfg.Default}, nil, e.addMetrics(cfg.Name, TLS), e.limiter)
+	case CONTROL:
+		e.start = cm.controlServer(cfg, e)
+	}
+	return e, nil
+}
+
+// mixedTls finds the http entries that share an external address with an
+// earlier http entry of the other kind, one terminating TLS and one plain.
+// The router of an address either terminates TLS for all of them or for none.
+func mixedTls(configs []*ServerConfig) map[int]error {
+	first := make(map[string]*ServerConfig)
+	conflicts := make(map[int]error)
+	for i, cfg := range configs {
+		if cfg.Protocol != HTTP {
+			continue
+		}
+		other, ok := first[cfg.ExternalAddress]
+		if !ok {
+			first[cfg.ExternalAddress] = cfg
+			continue
+		}
+		if (other.Tls == nil) != (cfg.Tls == nil) {
+			conflicts[i] = fmt.Errorf("tls must be set on all http entries on %v or on none, unlike on %v", cfg.ExternalAddress, other.Name)
+		}
+	}
+	return conflicts
+}
+
+// validate reports configuration mistakes before the tunnel of an entry starts
+func (config *ServerConfig) validate() error {
+	switch config.Protocol {
+	case TCP, UDP, TCP_UDP, HTTP, TLS:
+		if config.ExternalAddress == "" {
+			return errors.New("external_address is required")
+		}
+	case CONTROL:
+	default:
+		return fmt.Errorf("unsupported protocol %q", config.Protocol)
+	}
+	if config.InternalAddress == "" {
+		return errors.New("internal_address is required")
+	}
+	if (config.Protocol == HTTP || config.Protocol == TLS) && config.Host == "" && !config.Default {
+		return errors.New("host is required")
+	}
+	if _, err := ParsePortRanges(config.ExternalPorts); err != nil {
+		return fmt.Errorf("external_ports: %v", err)
+	}
+	if config.ExternalPorts != "" && config.Protocol != TCP && config.Protocol != UDP && config.Protocol != TCP_UDP {
+		return fmt.Errorf("external_ports is not supported on %s entries", config.Protocol)
+	}
+	if config.Tls != nil {
+		switch {
+		case config.Protocol == TLS:
+			return errors.New("tls entries pass TLS through, use a tcp or http entry to terminate it")
+		case config.Protocol != TCP && config.Protocol != HTTP:
+			return fmt.Errorf("tls is not supported on %s entries", config.Protocol)
+		case config.ExternalPorts != "":
+			return errors.New("tls is not supported on external_ports")
+		}
+	}
+	if config.Auth != nil && config.Protocol != HTTP {
+		return fmt.Errorf("auth is not supported on %s entries", config.Protocol)
+	}
+	if err := config.Limits.validate(true, config.Protocol); err != nil {
+		return err
+	}
+	return config.Quota.validate()
+}
+
+// States returns the current state of every tunnel
+func (cm *ServerManager) States() []TunnelState {
+	cm.set.mutex.Lock()
+	defer cm.set.mutex.Unlock()
+	cm.routerMutex.Lock()
+	defer cm.routerMutex.Unlock()
+	states := make([]TunnelState, 0, len(cm.set.keys)+len(cm.routers))
+	listed := make(map[string]bool)
+	for _, key := range cm.set.keys {
+		e := cm.set.entries[key]
+		if r, ok := cm.routers[e.router]; ok && !listed[e.router] {
+			listed[e.router] = true
+			states = append(states, r.tunnel.State())
+		}
+		states = append(states, e.tunnel.State())
+	}
+	return states
+}
+
+func (cm *ServerManager) udpServer(config *ServerConfig, metrics *Metrics, limiter *Limiter) func(*group) error {
+	ports, _ := ParsePortRanges(config.ExternalPorts)
+	return func(g *group) error {
+		s := &UdpServer{Name: config.Name, Metrics: metrics, Limiter: limiter, Mtu: config.Mtu, Idle: time.Duration(config.IdleTimeout),
+			Balance: config.Balance, ClientKeys: config.ClientKeys, Secret: config.Secret}
+		g.add(s)
+		if len(ports) > 0 {
+			return s.ListenPorts(config.InternalAddress, hostOf(config.ExternalAddress), ports)
+		}
+		return s.Listen(config.InternalAddress, config.ExternalAddress)
+	}
+}
+
+func (cm *ServerManager) tcpServer(config *ServerConfig, metrics *Metrics, limiter *Limiter) (func(*group) error, error) {
+	ports, _ := ParsePortRanges(config.ExternalPorts)
+	if config.Tls == nil {
+		return func(g *group) error {
+			s := &TcpServer{Name: config.Name, Metrics: metrics, Limiter: limiter, Secret: config.Secret}
+			g.add(s)
+			if len(ports) > 0 {
+				return s.ListenPorts(config.InternalAddress, hostOf(config.ExternalAddress), ports)
+			}
+			return s.Listen(config.InternalAddress, config.ExternalAddress)
+		}, nil
+	}
+	host, _, _ := net.SplitHostPort(config.ExternalAddress)
+	certs, err := newCertStore(config.Name, config.Tls, []string{host})
+	if err != nil {
+		return nil, err
+	}
+	return func(g *group) error {
+		s := &TcpServer{Name: config.Name, Metrics: metrics, Limiter: limiter, Secret: config.Secret}
+		g.add(s)
+		internal, err := net.Listen("tcp", config.InternalAddress)
+		if err != nil {
+			return err
+		}
+		external, err := listenStream(config.ExternalAddress)
+		if err != nil {
+			_ = internal.Close()
+			return err
+		}
+		return s.Serve(internal, tls.NewListener(external, certs.tlsConfig()))
+	}, nil
+}
+
+// controlServer runs the control server of e, the tunnels it registers are
+// counted and limited under e
+func (cm *ServerManager) controlServer(config *ServerConfig, e *entry) func(*group) error {
+	metrics := func(tunnel, protocol string) *Metrics {
+		cm.set.mutex.Lock()
+		defer cm.set.mutex.Unlock()
+		return e.metricsOf(tunnel, protocol)
+	}
+	return func(g *group) error {
+		s := &ControlServer{Name: config.Name, ExternalHost: config.ExternalAddress,
+			InternalPorts: config.InternalPorts, Clients: config.Clients, Limiter: e.limiter, NewMetrics: metrics}
+		g.add(s)
+		return s.Listen(config.InternalAddress)
+	}
+}
+
+func routerKey(protocol, address string) string {
+	return protocol + " " + address
+}
+
+// updateRouters starts the routers shared by the vhost entries of entries and
+// stops the ones no entry uses anymore
+func (cm *ServerManager) updateRouters(entries map[string]*entry) {
+	used := make(map[string]*ServerConfig)
+	for _, e := range entries {
+		if e.router != "" {
+			used[e.router] = e.config.(*ServerConfig)
+		}
+	}
+	cm.routerMutex.Lock()
+	var unused []*routerEntry
+	for key, r := range cm.routers {
+		if _, ok := used[key]; !ok {
+			unused = append(unused, r)
+			delete(cm.routers, key)
+		}
+	}
+	for key, cfg := range used {
+		if _, ok := cm.routers[key]; !ok {
+			cm.routers[key] = cm.startRouter(cfg.Protocol, cfg.ExternalAddress)
+		}
+	}
+	cm.routerMutex.Unlock()
+	for _, r := range unused {
+		r.tunnel.stop()
+	}
+}
+
+// startRouter runs the router shared by every entry on the same external address
+func (cm *ServerManager) startRouter(protocol, address string) *routerEntry {
+	router := newVhostRouter(protocol, address)
+	t := newTunnel(protocol+" router", address, protocol, nil, &cm.logger)
+	go t.run(func(g *group) error {
+		listener, err := listenStream(address)
+		if err != nil {
+			return err
+		}
+		g.add(listener)
+		return router.Serve(listener)
+	})
+	return &routerEntry{router: router, tunnel: t}
+}
+
+func (cm *ServerManager) router(key string) *vhostRouter {
+	cm.routerMutex.Lock()
+	defer cm.routerMutex.Unlock()
+	if r, ok := cm.routers[key]; ok {
+		return r.router
+	}
+	return nil
+}
+
+func (cm *ServerManager) vhostServer(config *ServerConfig, key string, options routeOptions, certs *certStore, metrics *Metrics, limiter *Limiter) func(*group) error {
+	return func(g *group) error {
+		router := cm.router(key)
+		if router == nil {
+			return fmt.Errorf("router %v stopped", key)
+		}
+		if certs != nil {
+			router.setCertificate(config.Host, certs)
+			defer router.removeCertificate(config.Host, certs)
+		}
+		external, err := router.listen(config.Host, options)
+		if err != nil {
+			return err
+		}
+		internal, err := net.Listen("tcp", config.InternalAddress)
 		if err != nil {
-			cm.logger.Error("tcp server %v error: %v", config.Name, err)
+			_ = external.Close()
+			return err
 		}
-		cm.logger.Info("tcp server %v restart", config.Name)
+		s := &TcpServer{Name: config.Name, Metrics: metrics, Limiter: limiter, Secret: config.Secret}
+		g.add(s)
+		return s.Serve(internal, external)
 	}
 }
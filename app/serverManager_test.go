@@ -0,0 +1,61 @@
+package app
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_serverConfigValidate(t *testing.T) {
+	entry := func(protocol string, edit func(*ServerConfig)) *ServerConfig {
+		c := &ServerConfig{Name: "test", Protocol: protocol, ExternalAddress: ":8080", InternalAddress: ":9000"}
+		if edit != nil {
+			edit(c)
+		}
+		return c
+	}
+	cases := []struct {
+		name   string
+		config *ServerConfig
+		err    string
+	}{
+		{"tcp", entry(TCP, nil), ""},
+		{"tcp+udp", entry(TCP_UDP, nil), ""},
+		{"tcp+udp port ranges", entry(TCP_UDP, func(c *ServerConfig) { c.ExternalPorts = "27015-27020" }), ""},
+		{"control", entry(CONTROL, func(c *ServerConfig) { c.ExternalAddress = "" }), ""},
+		{"http default", entry(HTTP, func(c *ServerConfig) { c.Default = true }), ""},
+		{"unknown protocol", entry("sctp", nil), "unsupported protocol"},
+		{"no external address", entry(TCP_UDP, func(c *ServerConfig) { c.ExternalAddress = "" }), "external_address"},
+		{"no internal address", entry(UDP, func(c *ServerConfig) { c.InternalAddress = "" }), "internal_address"},
+		{"http without host", entry(HTTP, nil), "host is required"},
+		{"bad port range", entry(TCP, func(c *ServerConfig) { c.ExternalPorts = "9-1" }), "external_ports"},
+		{"port range on http", entry(HTTP, func(c *ServerConfig) { c.Host = "a.example"; c.ExternalPorts = "80" }), "not supported on http"},
+		{"tls passthrough", entry(TLS, func(c *ServerConfig) { c.Host = "a.example"; c.Tls = &TlsConfig{} }), "pass TLS through"},
+		{"tls on tcp+udp", entry(TCP_UDP, func(c *ServerConfig) { c.Tls = &TlsConfig{} }), "tls is not supported"},
+		{"auth on tcp", entry(TCP, func(c *ServerConfig) { c.Auth = &AuthConfig{} }), "auth is not supported"},
+	}
+	for _, c := range cases {
+		err := c.config.validate()
+		if c.err == "" && err != nil || c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("%s: error %v, want %q", c.name, err, c.err)
+		}
+	}
+}
+
+func Test_serverManagerInvalidEntry(t *testing.T) {
+	sm := StartServerManager("test", []*ServerConfig{{Name: "web", Protocol: HTTP, ExternalAddress: "127.0.0.1:0", InternalAddress: "127.0.0.1:0"}})
+	defer sm.Close()
+	// a misconfigured entry fails on its own instead of taking the process down
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		states := sm.States()
+		if len(states) == 1 && states[0].State == TUNNEL_FAILED {
+			if !strings.Contains(states[0].LastError, "host is required") {
+				t.Errorf("failed with %q", states[0].LastError)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("states %+v", states)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package app
+
+import (
+	"ezturp/tools"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// close reasons of a session summary
+const (
+	CLOSE_PEER    = "peer closed"   // the external connection on a server, the local service on a client
+	CLOSE_REMOTE  = "remote closed" // the other end of the tunnel removed the session
+	CLOSE_IDLE    = "idle"
+	CLOSE_KILLED  = "killed"
+	CLOSE_ERROR   = "error"
+	CLOSE_LINK    = "link lost"
+	CLOSE_STOPPED = "stopped"
+	CLOSE_QUOTA   = "quota exhausted"
+)
+
+// SessionInfo describes a live session. Peer is the external address on a
+// server and the local service on a client, BytesIn counts what the peer sent
+// and BytesOut what it received.
+type SessionInfo struct {
+	Tunnel   string    `json:"tunnel"`
+	Protocol string    `json:"protocol"`
+	Id       uint32    `json:"id"`
+	Peer     string    `json:"peer"`
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+	Since    time.Time `json:"since"`
+	Age      Duration  `json:"age"`
+}
+
+// sessionHolder is an endpoint whose live sessions can be listed and killed
+type sessionHolder interface {
+	Sessions() []SessionInfo
+	KillSession(id uint32) bool
+}
+
+// SessionSummary is recorded when a session closes. A server knows the
+// external Peer of a session and a client its Local service.
+type SessionSummary struct {
+	Tunnel   string    `json:"tunnel"`
+	Protocol string    `json:"protocol"`
+	Id       uint32    `json:"id"`
+	Peer     string    `json:"peer,omitempty"`
+	Local    string    `json:"local,omitempty"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Duration Duration  `json:"duration"`
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+	Reason   string    `json:"reason"`
+}
+
+// sessionStat counts the traffic of one session, adding it to the metrics of its endpoint
+type sessionStat struct {
+	since   time.Time
+	in      int64
+	out     int64
+	ended   int32
+	peer    string
+	local   string
+	metrics *Metrics
+	limit   *flow
+}
+
+func newSessionStat(metrics *Metrics, peer, local string) *sessionStat {
+	return &sessionStat{since: time.Now(), peer: peer, local: local, metrics: metrics}
+}
+
+func (s *sessionStat) addIn(n int) {
+	atomic.AddInt64(&s.in, int64(n))
+	s.metrics.add(&s.metrics.BytesIn, n)
+	s.limit.count(n)
+}
+
+func (s *sessionStat) addOut(n int) {
+	atomic.AddInt64(&s.out, int64(n))
+	s.metrics.add(&s.metrics.BytesOut, n)
+	s.limit.count(n)
+}
+
+func (s *sessionStat) info(tunnel, protocol string, id uint32, peer net.Addr) SessionInfo {
+	info := SessionInfo{
+		Tunnel:   tunnel,
+		Protocol: protocol,
+		Id:       id,
+		BytesIn:  atomic.LoadInt64(&s.in),
+		BytesOut: atomic.LoadInt64(&s.out),
+		Since:    s.since,
+		Age:      Duration(time.Since(s.since).Round(time.Second)),
+	}
+	if peer != nil {
+		info.Peer = peer.String()
+	}
+	return info
+}
+
+// end counts the session as closed and records its summary, only the first call has an effect
+func (s *sessionStat) end(logger *tools.Logger, id uint32, reason string) {
+	if !atomic.CompareAndSwapInt32(&s.ended, 0, 1) {
+		return
+	}
+	s.metrics.add(&s.metrics.SessionsClosed, 1)
+	s.limit.close()
+	now := time.Now()
+	recordSession(logger, SessionSummary{
+		Tunnel:   s.metrics.Tunnel,
+		Protocol: s.metrics.Protocol,
+		Id:       id,
+		Peer:     s.peer,
+		Local:    s.local,
+		Start:    s.since,
+		End:      now,
+		Duration: Duration(now.Sub(s.since).Round(time.Millisecond)),
+		BytesIn:  atomic.LoadInt64(&s.in),
+		BytesOut: atomic.LoadInt64(&s.out),
+		Reason:   reason,
+	})
+}
+
+// countedConn is the connection of a session, counting the bytes that pass
+// through it
+type countedConn struct {
+	net.Conn
+	stat *sessionStat
+}
+
+func newCountedConn(conn net.Conn, metrics *Metrics, peer, local string) *countedConn {
+	return &countedConn{Conn: conn, stat: newSessionStat(metrics, peer, local)}
+}
+
+func (c *countedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.stat.addIn(n)
+	return n, err
+}
+
+func (c *countedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.stat.addOut(n)
+	return n, err
+}
+
+// connSessions lists the sessions of an endpoint that keeps a connection per session
+func connSessions(tunnel, protocol string, conns map[uint32]net.Conn) []SessionInfo {
+	sessions := make([]SessionInfo, 0, len(conns))
+	for id, conn := range conns {
+		if c, ok := conn.(*countedConn); ok {
+			sessions = append(sessions, c.stat.info(tunnel, protocol, id, c.RemoteAddr()))
+		}
+	}
+	return sessions
+}
+
+// endSession ends the session of a connection made by newCountedConn
+func endSession(logger *tools.Logger, id uint32, conn net.Conn, reason string) {
+	if c, ok := conn.(*countedConn); ok {
+		c.stat.end(logger, id, reason)
+	}
+}
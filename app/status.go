@@ -0,0 +1,277 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"ezturp/protocol"
+	"ezturp/tools"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	STATUS_TIMEOUT = 5 * time.Second
+)
+
+// TunnelStatus is the state of a tunnel with the traffic of its endpoints.
+// Connected reports whether the internal link of every endpoint is up.
+type TunnelStatus struct {
+	TunnelState
+	Connected bool        `json:"connected"`
+	Sessions  int64       `json:"sessions"`
+	Active    int64       `json:"active"`
+	BytesIn   int64       `json:"bytes_in"`
+	BytesOut  int64       `json:"bytes_out"`
+	Quota     *QuotaState `json:"quota,omitempty"`
+}
+
+// Status describes a running manager and its tunnels
+type Status struct {
+	Name    string         `json:"name"`
+	Role    string         `json:"role"`
+	Started time.Time      `json:"started"`
+	Uptime  Duration       `json:"uptime"`
+	Tunnels []TunnelStatus `json:"tunnels"`
+}
+
+func (s *entrySet) status(name string) Status {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	status := Status{
+		Name:    name,
+		Role:    s.role,
+		Started: s.started,
+		Uptime:  Duration(time.Since(s.started).Round(time.Second)),
+		Tunnels: make([]TunnelStatus, 0, len(s.keys)),
+	}
+	for _, key := range s.keys {
+		e := s.entries[key]
+		t := TunnelStatus{TunnelState: e.tunnel.State(), Connected: len(e.metrics) > 0}
+		for _, m := range e.metrics {
+			snapshot := m.Snapshot()
+			t.Connected = t.Connected && snapshot.LinkUp == 1
+			t.Sessions += snapshot.SessionsOpened
+			t.Active += snapshot.SessionsOpened - snapshot.SessionsClosed
+			t.BytesIn += snapshot.BytesIn
+			t.BytesOut += snapshot.BytesOut
+		}
+		if q, ok := e.limiter.quotaState(e.name, e.protocol); ok {
+			t.Quota = &q
+		}
+		status.Tunnels = append(status.Tunnels, t)
+	}
+	return status
+}
+
+// StatusSocketPath is where a manager of role called name opens its status
+// socket unless it is told otherwise
+func StatusSocketPath(role, name string) string {
+	if name == "" {
+		return filepath.Join(statusDir(), "ezturp-"+role+".sock")
+	}
+	return filepath.Join(statusDir(), "ezturp-"+role+"-"+name+".sock")
+}
+
+// statusDir holds the status sockets of the user, no other user may enter it
+func statusDir() string {
+	if uid := os.Getuid(); uid >= 0 {
+		return filepath.Join(os.TempDir(), "ezturp-"+strconv.Itoa(uid))
+	}
+	// Windows has a temporary directory per user
+	return os.TempDir()
+}
+
+// privateDir creates dir for the user alone. It fails when dir exists but is
+// not a directory, or belongs to another user, who alone could change its mode.
+func privateDir(dir string) error {
+	if err := os.Mkdir(dir, 0700); err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%v is not a directory", dir)
+	}
+	return os.Chmod(dir, 0700)
+}
+
+// ListenStatus serves the status and sessions of manager without a token on
+// a unix socket at path, which only its owner may connect to. The socket
+// exists before it can be restricted, so the default path is in a directory
+// of the user's own.
+func ListenStatus(path, name string, manager Manager) error {
+	if dir := filepath.Dir(path); dir == statusDir() && dir != os.TempDir() {
+		if err := privateDir(dir); err != nil {
+			return err
+		}
+	}
+	listener, err := listenStream(UNIX_SCHEME + path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		_ = listener.Close()
+		return err
+	}
+	tools.Logger{Service: "StatusSocket", Name: name}.Info("listen status connection %v", path)
+	return http.Serve(listener, statusHandler{manager})
+}
+
+// statusHandler answers the requests of StatusSocket, the rest of the admin
+// API needs the token
+type statusHandler struct {
+	manager Manager
+}
+
+func (h statusHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.Trim(req.URL.Path, "/")
+	switch {
+	case path == "status" && req.Method == http.MethodGet:
+		writeJson(w, http.StatusOK, h.manager.Status())
+	case path == "sessions" && req.Method == http.MethodGet:
+		writeJson(w, http.StatusOK, sessionsOf(h.manager, req))
+	case strings.HasPrefix(path, "sessions/") && req.Method == http.MethodDelete:
+		id, err := strconv.ParseUint(strings.TrimPrefix(path, "sessions/"), 10, 32)
+		if err != nil {
+			writeJson(w, http.StatusBadRequest, adminError("bad session id"))
+			return
+		}
+		writeReply(w, h.manager.KillSession(req.URL.Query().Get("tunnel"), uint32(id)))
+	default:
+		writeJson(w, http.StatusNotFound, adminError("unknown request "+req.Method+" "+req.URL.Path))
+	}
+}
+
+// StatusSocket talks to the status socket of a running manager
+type StatusSocket struct {
+	Path   string
+	client *http.Client
+}
+
+func (c *StatusSocket) do(method, path string, query url.Values, v interface{}) error {
+	if c.client == nil {
+		c.client = &http.Client{
+			Timeout: STATUS_TIMEOUT,
+			Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", c.Path)
+			}},
+		}
+	}
+	u := url.URL{Scheme: "http", Host: "ezturp", Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("no manager listening on %v : %w", c.Path, errors.Unwrap(err))
+	}
+	defer resp.Body.Close()
+	p, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(p, &e) == nil && e.Error != "" {
+			return errors.New(e.Error)
+		}
+		return errors.New(resp.Status)
+	}
+	return json.Unmarshal(p, v)
+}
+
+// Status returns the state and traffic of every tunnel of the manager
+func (c *StatusSocket) Status() (Status, error) {
+	var status Status
+	err := c.do(http.MethodGet, "/status", nil, &status)
+	return status, err
+}
+
+// Sessions lists the live sessions of the tunnel called tunnel, of all when it is empty
+func (c *StatusSocket) Sessions(tunnel string) ([]SessionInfo, error) {
+	query := url.Values{}
+	if tunnel != "" {
+		query.Set("tunnel", tunnel)
+	}
+	var sessions []SessionInfo
+	err := c.do(http.MethodGet, "/sessions", query, &sessions)
+	return sessions, err
+}
+
+// KillSession closes session id of the tunnel called tunnel, of any tunnel when it is empty
+func (c *StatusSocket) KillSession(tunnel string, id uint32) error {
+	query := url.Values{}
+	if tunnel != "" {
+		query.Set("tunnel", tunnel)
+	}
+	var ok map[string]bool
+	return c.do(http.MethodDelete, "/sessions/"+strconv.FormatUint(uint64(id), 10), query, &ok)
+}
+
+// WriteStatus prints status as a table. The throughput of each tunnel is
+// measured against previous, taken interval earlier, and left out without it.
+func WriteStatus(w io.Writer, status Status, previous *Status, interval time.Duration) error {
+	fmt.Fprintf(w, "%s manager %s , up %v , %d tunnels\n\n", status.Role, orDash(status.Name),
+		time.Duration(status.Uptime), len(status.Tunnels))
+	before := make(map[string]TunnelStatus)
+	if previous != nil {
+		for _, t := range previous.Tunnels {
+			before[t.Protocol+"/"+t.Name] = t
+		}
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TUNNEL\tPROTOCOL\tSTATE\tLINK\tFOR\tSESSIONS\tIN\tOUT\tIN/S\tOUT/S\tQUOTA")
+	for _, t := range status.Tunnels {
+		link := "down"
+		if t.Connected {
+			link = "up"
+		}
+		rateIn, rateOut := "-", "-"
+		if b, ok := before[t.Protocol+"/"+t.Name]; ok && interval > 0 {
+			rateIn = protocol.BytesFormat(int64(float64(t.BytesIn-b.BytesIn)/interval.Seconds())) + "/s"
+			rateOut = protocol.BytesFormat(int64(float64(t.BytesOut-b.BytesOut)/interval.Seconds())) + "/s"
+		}
+		quota := "-"
+		if q := t.Quota; q != nil {
+			quota = fmt.Sprintf("%s of %s", protocol.BytesFormat(q.Used), protocol.BytesFormat(q.Limit))
+			if q.Exhausted {
+				quota += " exhausted"
+			}
+		}
+		state := t.State
+		if t.LastError != "" && t.State != TUNNEL_RUNNING {
+			state += " (" + t.LastError + ")"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%v\t%d/%d\t%s\t%s\t%s\t%s\t%s\n", t.Name, t.Protocol, state, link,
+			time.Since(t.Since).Round(time.Second), t.Active, t.Sessions,
+			protocol.BytesFormat(t.BytesIn), protocol.BytesFormat(t.BytesOut), rateIn, rateOut, quota)
+	}
+	return tw.Flush()
+}
+
+// WriteSessions prints sessions as a table
+func WriteSessions(w io.Writer, sessions []SessionInfo) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTUNNEL\tPROTOCOL\tPEER\tAGE\tIN\tOUT")
+	for _, s := range sessions {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%v\t%s\t%s\n", s.Id, s.Tunnel, s.Protocol, orDash(s.Peer),
+			time.Duration(s.Age), protocol.BytesFormat(s.BytesIn), protocol.BytesFormat(s.BytesOut))
+	}
+	return tw.Flush()
+}
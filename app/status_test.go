@@ -0,0 +1,83 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func Test_ListenStatus(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the status directory is the temporary directory of the user")
+	}
+	t.Setenv("TMPDIR", t.TempDir())
+	// a directory left open to others by an earlier run is closed again
+	if err := os.Mkdir(statusDir(), 0777); err != nil {
+		t.Fatal(err)
+	}
+	cm := StartClientManager("test", nil)
+	defer cm.Close()
+	path := StatusSocketPath("client", "test")
+	if filepath.Dir(path) != statusDir() {
+		t.Fatalf("socket %v is outside %v", path, statusDir())
+	}
+	listened := make(chan error, 1)
+	go func() {
+		listened <- ListenStatus(path, "test", cm)
+	}()
+	socket := StatusSocket{Path: path}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := socket.Status(); err == nil {
+			break
+		}
+		select {
+		case err := <-listened:
+			t.Fatal(err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("status socket does not answer")
+		}
+	}
+	for name, want := range map[string]os.FileMode{statusDir(): 0700, path: 0600} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != want {
+			t.Errorf("%v mode %v, want %v", name, info.Mode().Perm(), want)
+		}
+	}
+	if _, err := socket.Sessions(""); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_privateDir(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(dir, link); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		dir string
+		ok  bool
+	}{
+		{filepath.Join(dir, "new"), true},
+		{filepath.Join(dir, "new"), true},
+		{file, false},
+		{link, false},
+		{filepath.Join(dir, "missing", "new"), false},
+	}
+	for _, c := range cases {
+		if err := privateDir(c.dir); (err == nil) != c.ok {
+			t.Errorf("%v: error %v", c.dir, err)
+		}
+	}
+}
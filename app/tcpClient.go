@@ -1,6 +1,9 @@
 package app
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
 	"ezturp/protocol"
 	"ezturp/tools"
 	"net"
@@ -8,38 +11,223 @@ import (
 	"time"
 )
 
+const (
+	TCP_DIAL_TIMEOUT   = 10 * time.Second
+	PENDING_DATA_LIMIT = 256 * 1024
+)
+
 type TcpClient struct {
 	Name         string
+	Metrics      *Metrics
+	Limiter      *Limiter
+	Secret       string
 	logger       tools.Logger
 	LocalAddr    string
+	LocalAddrs   []string
+	LocalPorts   PortRanges
+	Balance      string
+	FailTimeout  time.Duration
+	DialTimeout  time.Duration
+	PendingLimit int
+	Health       *HealthCheck
+	backends     *backendPool
 	internalConn net.Conn
 	sessionMutex sync.Mutex
 	sessions     map[uint32]net.Conn
+	pending      map[uint32]*pendingSession
+	draining     bool
+	closeMutex   sync.Mutex
+	closed       bool
+	cancel       context.CancelFunc
+	routines     routines
+}
+
+// pendingSession holds the data the server sent for a session whose local
+// connection is still being dialed
+type pendingSession struct {
+	data [][]byte
+	size int
 }
 
 func (c *TcpClient) init() {
+	c.sessionMutex.Lock()
 	c.sessions = make(map[uint32]net.Conn)
-	c.logger = tools.Logger{"TcpClient", c.Name}
+	c.pending = make(map[uint32]*pendingSession)
+	c.sessionMutex.Unlock()
+	if c.DialTimeout <= 0 {
+		c.DialTimeout = TCP_DIAL_TIMEOUT
+	}
+	if c.PendingLimit <= 0 {
+		c.PendingLimit = PENDING_DATA_LIMIT
+	}
+	c.logger = tools.Logger{Service: "TcpClient", Name: c.Name}
+	if c.Metrics == nil {
+		c.Metrics = newMetrics(c.Name, TCP)
+	}
+}
+
+// localAddrs returns LocalAddrs, or LocalAddr when LocalAddrs is empty
+func (c *TcpClient) localAddrs() []string {
+	if len(c.LocalAddrs) > 0 {
+		return c.LocalAddrs
+	}
+	return []string{c.LocalAddr}
 }
 
 func (c *TcpClient) Connect(internalAddr string) error {
 	c.init()
+	var err error
+	c.backends, err = newBackendPool(c.localAddrs(), c.Balance, c.FailTimeout)
+	if err != nil {
+		return err
+	}
+	var checker *backendHealth
+	if c.Health != nil {
+		checker, err = newBackendHealth(c.Name, c.backends, c.Health, c.reportHealth)
+		if err != nil {
+			return err
+		}
+	}
 	conn, err := net.Dial("tcp", internalAddr)
 	if err != nil {
 		return err
 	}
+	if c.Secret != "" {
+		if err := protocol.WriteFrame(conn, protocol.LINK_AUTH, 0, []byte(c.Secret)); err != nil {
+			_ = conn.Close()
+			return err
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.closeMutex.Lock()
 	c.internalConn = conn
+	c.cancel = cancel
+	closed := c.closed
+	c.closeMutex.Unlock()
+	if closed {
+		cancel()
+		_ = conn.Close()
+		return errors.New("client closed")
+	}
 	c.logger.Info("connected to %v", internalAddr)
-	go c.keepAlive(conn)
-	err = c.handle(conn)
+	c.Metrics.linkUp()
+	c.routines.start(func() { c.keepAlive(ctx, conn) })
+	if checker != nil {
+		c.routines.start(func() { checker.run(ctx.Done()) })
+	}
+	err = c.handle(ctx, conn)
+	c.Metrics.linkDown()
+	cancel()
+	c.closeSessions(c.closeReason())
+	_ = c.routines.wait(context.Background())
 	return err
 }
 
-func (c *TcpClient) keepAlive(internalConn net.Conn) {
+// ConnectContext is Connect that stops when ctx is cancelled
+func (c *TcpClient) ConnectContext(ctx context.Context, internalAddr string) error {
+	return runContext(ctx, c, func() error {
+		return c.Connect(internalAddr)
+	})
+}
+
+// Shutdown refuses new sessions and waits for the running ones to end before
+// closing the client. When ctx is done first the remaining sessions are closed
+// and the error of ctx is returned.
+func (c *TcpClient) Shutdown(ctx context.Context) error {
+	return shutdown(ctx, c, &c.routines, c.drain, c.sessionCount)
+}
+
+func (c *TcpClient) drain() {
+	c.sessionMutex.Lock()
+	defer c.sessionMutex.Unlock()
+	c.draining = true
+}
+
+func (c *TcpClient) sessionCount() int {
+	c.sessionMutex.Lock()
+	defer c.sessionMutex.Unlock()
+	return len(c.sessions) + len(c.pending)
+}
+
+// Sessions lists the sessions connected to the local service
+func (c *TcpClient) Sessions() []SessionInfo {
+	c.sessionMutex.Lock()
+	defer c.sessionMutex.Unlock()
+	return connSessions(c.Name, TCP, c.sessions)
+}
+
+// KillSession closes session id and tells the server to close its external connection
+func (c *TcpClient) KillSession(id uint32) bool {
+	c.sessionMutex.Lock()
+	_, ok := c.sessions[id]
+	_, dialing := c.pending[id]
+	c.sessionMutex.Unlock()
+	if !ok && !dialing {
+		return false
+	}
+	c.sessionRemove(id, true, CLOSE_KILLED)
+	return true
+}
+
+// reportHealth tells the server whether it may open new sessions
+func (c *TcpClient) reportHealth(healthy bool) {
+	err := c.writeFrame(protocol.HEALTH_STATUS, 0, healthFrame(healthy, ""))
+	if err != nil {
+		c.logger.Warn("failed to report health : %v", err)
+	}
+}
+
+// Close disconnects the client from the server and closes every local connection
+func (c *TcpClient) Close() error {
+	c.closeMutex.Lock()
+	c.closed = true
+	if c.internalConn != nil {
+		_ = c.internalConn.Close()
+	}
+	if c.cancel != nil {
+		c.cancel()
+	}
+	c.closeMutex.Unlock()
+	c.closeSessions(CLOSE_STOPPED)
+	return nil
+}
+
+// closeReason tells why the sessions end when the internal connection is gone
+func (c *TcpClient) closeReason() string {
+	c.closeMutex.Lock()
+	defer c.closeMutex.Unlock()
+	if c.closed {
+		return CLOSE_STOPPED
+	}
+	return CLOSE_LINK
+}
+
+func (c *TcpClient) closeSessions(reason string) {
+	c.sessionMutex.Lock()
+	for id, conn := range c.sessions {
+		_ = conn.Close()
+		delete(c.sessions, id)
+		endSession(&c.logger, id, conn, reason)
+	}
+	for id := range c.pending {
+		delete(c.pending, id)
+	}
+	c.sessionMutex.Unlock()
+}
+
+func (c *TcpClient) keepAlive(ctx context.Context, internalConn net.Conn) {
 	ticker := time.NewTicker(KEEP_ALIVE)
 	for {
-		<-ticker.C
-		err := protocol.WriteFrame(internalConn, protocol.KEEP_ALIVE, 0, []byte{})
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			ticker.Stop()
+			return
+		}
+		// the server echoes the timestamp, which measures the round trip
+		stamp := make([]byte, 8)
+		binary.BigEndian.PutUint64(stamp, uint64(time.Now().UnixNano()))
+		err := c.writeFrame(protocol.KEEP_ALIVE, 0, stamp)
 		if err != nil {
 			break
 		}
@@ -48,22 +236,23 @@ func (c *TcpClient) keepAlive(internalConn net.Conn) {
 	_ = internalConn.Close()
 }
 
-func (c *TcpClient) handle(internalConn net.Conn) (err error) {
+func (c *TcpClient) handle(ctx context.Context, internalConn net.Conn) (err error) {
 	defer internalConn.Close()
 	for {
 		t, id, data, err := protocol.ReadFrame(internalConn)
 		if err != nil {
 			break
 		}
+		c.Metrics.add(&c.Metrics.FramesIn, 1)
 		switch t {
-		case protocol.NEW_SESSION:
-			err = c.sessionCreate(id)
-			if err != nil {
-				c.logger.Warn("failed to create session %v", id)
-				c.sessionRemove(id, true)
+		case protocol.KEEP_ALIVE:
+			if len(data) == 8 {
+				c.Metrics.setRtt(time.Since(time.Unix(0, int64(binary.BigEndian.Uint64(data)))))
 			}
+		case protocol.NEW_SESSION:
+			c.sessionCreate(ctx, id, data)
 		case protocol.REMOVE_SESSION:
-			c.sessionRemove(id, false)
+			c.sessionRemove(id, false, CLOSE_REMOTE)
 		case protocol.DATA:
 			c.dataDispatch(id, data)
 		default:
@@ -73,50 +262,121 @@ func (c *TcpClient) handle(internalConn net.Conn) (err error) {
 	return err
 }
 
-func (c *TcpClient) sessionCreate(id uint32) error {
+// sessionCreate dials the local connection of a session in the background, so
+// that a slow local service does not hold up the frames of other sessions
+func (c *TcpClient) sessionCreate(ctx context.Context, id uint32, meta []byte) {
 	c.sessionMutex.Lock()
-	defer c.sessionMutex.Unlock()
-	conn, err := net.Dial("tcp", c.LocalAddr)
+	if c.draining {
+		c.sessionMutex.Unlock()
+		c.sessionRemove(id, true, CLOSE_STOPPED)
+		return
+	}
+	c.sessionMutex.Unlock()
+	limit, ok := c.Limiter.open("")
+	if !ok {
+		c.logger.Session(id, nil).Debug("refused, the quota is exhausted")
+		c.sessionRemove(id, true, CLOSE_QUOTA)
+		return
+	}
+	c.sessionMutex.Lock()
+	c.pending[id] = &pendingSession{}
+	c.sessionMutex.Unlock()
+	c.routines.start(func() {
+		conn, err := c.dial(ctx, meta)
+		if err != nil {
+			c.logger.Session(id, nil).Warn("failed to create the session : %v", err)
+			c.Metrics.add(&c.Metrics.DialFailures, 1)
+			limit.close()
+			c.sessionRemove(id, true, CLOSE_ERROR)
+			return
+		}
+		counted := newCountedConn(conn, c.Metrics, "", conn.backend.address)
+		counted.stat.limit = limit
+		if c.flushPending(id, counted) {
+			c.logger.Session(id, conn.backend.address).Debug("created , local %v", conn.backend.address)
+			c.routines.start(func() { c.proxy(counted, id) })
+		} else {
+			limit.close()
+		}
+	})
+}
+
+func (c *TcpClient) dial(ctx context.Context, meta []byte) (*backendConn, error) {
+	dial, err := localDialer(func(address string) (net.Conn, error) {
+		return dialStream(ctx, address, c.DialTimeout)
+	}, c.LocalPorts, meta)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return c.backends.dial(dial)
+}
+
+// flushPending writes the data that arrived during the dial to conn, then
+// makes it the connection of the session. It returns false when the session
+// was removed in the meantime.
+func (c *TcpClient) flushPending(id uint32, conn net.Conn) bool {
+	for {
+		c.sessionMutex.Lock()
+		p, ok := c.pending[id]
+		if !ok {
+			c.sessionMutex.Unlock()
+			_ = conn.Close()
+			return false
+		}
+		data := p.data
+		p.data, p.size = nil, 0
+		if len(data) == 0 {
+			delete(c.pending, id)
+			c.sessions[id] = conn
+			c.sessionMutex.Unlock()
+			c.Metrics.add(&c.Metrics.SessionsOpened, 1)
+			return true
+		}
+		c.sessionMutex.Unlock()
+		for _, d := range data {
+			if _, err := conn.Write(d); err != nil {
+				_ = conn.Close()
+				c.sessionRemove(id, true, CLOSE_ERROR)
+				return false
+			}
+		}
 	}
-	c.sessions[id] = conn
-	c.logger.Debug("session %v created", id)
-	go c.proxy(conn, id)
-	return nil
 }
 
-func (c *TcpClient) sessionRemove(id uint32, notify bool) {
+func (c *TcpClient) sessionRemove(id uint32, notify bool, reason string) {
 	c.sessionMutex.Lock()
 	defer c.sessionMutex.Unlock()
+	delete(c.pending, id)
 	if conn, ok := c.sessions[id]; ok {
 		delete(c.sessions, id)
-		c.logger.Debug("session %v,address %v removed", id, conn.RemoteAddr())
+		endSession(&c.logger, id, conn, reason)
+		c.logger.Session(id, conn.RemoteAddr()).Debug("address %v removed", conn.RemoteAddr())
 		err := conn.Close()
 		if err != nil {
-			c.logger.Warn("connection %v did not close, session id: %v", conn.RemoteAddr().String(), id)
+			c.logger.Session(id, conn.RemoteAddr()).Warn("connection %v did not close", conn.RemoteAddr().String())
 		}
 	}
 	if notify {
-		err := protocol.WriteFrame(c.internalConn, protocol.REMOVE_SESSION, id, []byte{})
+		err := c.writeFrame(protocol.REMOVE_SESSION, id, []byte{})
 		if err != nil {
-			c.logger.Warn("failed to notify server to remove session %v : %v", id, err)
+			c.logger.Session(id, nil).Warn("failed to notify server to remove the session : %v", err)
 		}
 	}
 }
 
-func (c *TcpClient) proxy(conn net.Conn, id uint32) {
+func (c *TcpClient) proxy(conn *countedConn, id uint32) {
 	buf := make([]byte, BUF_SIZE)
 	for {
 		n, err := conn.Read(buf)
 		if err != nil {
-			c.sessionRemove(id, true)
+			c.sessionRemove(id, true, CLOSE_PEER)
 			c.logger.Info("local %v disconnected", conn.RemoteAddr())
 			break
 		}
-		err = protocol.WriteFrame(c.internalConn, protocol.DATA, id, buf[:n])
+		conn.stat.limit.wait(UPLOAD, n)
+		err = c.writeFrame(protocol.DATA, id, buf[:n])
 		if err != nil {
-			c.sessionRemove(id, false)
+			c.sessionRemove(id, false, CLOSE_ERROR)
 			c.logger.Error("internal connection error : %v", err)
 			break
 		}
@@ -124,16 +384,48 @@ func (c *TcpClient) proxy(conn net.Conn, id uint32) {
 	_ = conn.Close()
 }
 
+func (c *TcpClient) writeFrame(t byte, id uint32, data []byte) error {
+	err := protocol.WriteFrame(c.internalConn, t, id, data)
+	if err == nil {
+		c.Metrics.add(&c.Metrics.FramesOut, 1)
+	}
+	return err
+}
+
 func (c *TcpClient) dataDispatch(id uint32, data []byte) {
+	if queued, ok := c.queuePending(id, data); ok {
+		if !queued {
+			c.logger.Session(id, nil).Warn("sent more than %d bytes before its local connection was ready", c.PendingLimit)
+			c.sessionRemove(id, true, CLOSE_ERROR)
+		}
+		return
+	}
 	conn := c.sessionFind(id)
 	if conn != nil {
 		_, err := conn.Write(data)
 		if err != nil {
-			c.sessionRemove(id, true)
+			c.sessionRemove(id, true, CLOSE_ERROR)
 		}
 	} else {
-		c.sessionRemove(id, false)
+		c.sessionRemove(id, false, CLOSE_ERROR)
+	}
+}
+
+// queuePending keeps data for a session that is still dialing. ok is false
+// when the session is not pending, queued is false when the buffer is full.
+func (c *TcpClient) queuePending(id uint32, data []byte) (queued, ok bool) {
+	c.sessionMutex.Lock()
+	defer c.sessionMutex.Unlock()
+	p, ok := c.pending[id]
+	if !ok {
+		return false, false
+	}
+	if p.size+len(data) > c.PendingLimit {
+		return false, true
 	}
+	p.data = append(p.data, data)
+	p.size += len(data)
+	return true, true
 }
 
 func (c *TcpClient) sessionFind(id uint32) net.Conn {
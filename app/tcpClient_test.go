@@ -0,0 +1,131 @@
+package app
+
+import (
+	"bytes"
+	"ezturp/protocol"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// readFrameOf reads frames from conn until one of type t for session id arrives
+func readFrameOf(t *testing.T, conn net.Conn, frameType byte, id uint32) {
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		ft, fid, _, err := protocol.ReadFrame(conn)
+		if err != nil {
+			t.Fatalf("no frame of type %v for session %v : %v", frameType, id, err)
+		}
+		if ft == frameType && fid == id {
+			return
+		}
+	}
+}
+
+func Test_tcpClientPendingSessions(t *testing.T) {
+	local, err := net.Listen(TCP, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	internal, err := net.Listen(TCP, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer internal.Close()
+	c := &TcpClient{Name: "test", LocalAddr: local.Addr().String(), PendingLimit: 16}
+	connected := make(chan error, 1)
+	go func() {
+		connected <- c.Connect(internal.Addr().String())
+	}()
+	defer func() {
+		_ = c.Close()
+		<-connected
+	}()
+	server, err := internal.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	// session 7 is still dialing its local service
+	c.sessionMutex.Lock()
+	c.pending[7] = &pendingSession{}
+	c.sessionMutex.Unlock()
+	// the server sends data right behind NEW_SESSION, before the dial is done
+	for _, frame := range []struct {
+		t    byte
+		id   uint32
+		data string
+	}{
+		{protocol.NEW_SESSION, 1, ""},
+		{protocol.DATA, 1, "hello"},
+		{protocol.DATA, 7, "early"},
+		{protocol.DATA, 1, " world"},
+	} {
+		if err := protocol.WriteFrame(server, frame.t, frame.id, []byte(frame.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn, err := local.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	got := make([]byte, len("hello world"))
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "hello world" {
+		t.Fatalf("local service got %q : %v", got, err)
+	}
+	c.sessionMutex.Lock()
+	p, ok := c.pending[7]
+	pending := ok && p.size == len("early") && bytes.Equal(bytes.Join(p.data, nil), []byte("early"))
+	c.sessionMutex.Unlock()
+	if !pending {
+		t.Fatal("data of the dialing session not held")
+	}
+	// a dialing session that is sent more than the limit is removed
+	if err := protocol.WriteFrame(server, protocol.DATA, 7, []byte("more than limit")); err != nil {
+		t.Fatal(err)
+	}
+	readFrameOf(t, server, protocol.REMOVE_SESSION, 7)
+	c.sessionMutex.Lock()
+	_, ok = c.pending[7]
+	c.sessionMutex.Unlock()
+	if ok {
+		t.Error("session over the pending limit kept")
+	}
+}
+
+func Test_tcpClientFlushPending(t *testing.T) {
+	c := &TcpClient{Name: "test"}
+	c.init()
+	c.pending[3] = &pendingSession{data: [][]byte{[]byte("one "), []byte("two")}, size: 7}
+	local, remote := net.Pipe()
+	defer remote.Close()
+	read := make(chan []byte, 1)
+	go func() {
+		p, _ := io.ReadAll(remote)
+		read <- p
+	}()
+	if !c.flushPending(3, local) {
+		t.Fatal("pending session not flushed")
+	}
+	if c.sessionFind(3) != local || len(c.pending) != 0 {
+		t.Error("session not moved from pending to established")
+	}
+	_ = local.Close()
+	if p := <-read; string(p) != "one two" {
+		t.Errorf("flushed %q", p)
+	}
+	// a session removed during its dial closes the new connection
+	closed, other := net.Pipe()
+	defer other.Close()
+	if c.flushPending(4, closed) {
+		t.Error("flushed a session that is gone")
+	}
+	if _, err := closed.Write([]byte("x")); err == nil {
+		t.Error("connection of a removed session left open")
+	}
+}
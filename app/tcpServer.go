@@ -1,9 +1,12 @@
 package app
 
 import (
+	"context"
+	"crypto/subtle"
 	"errors"
 	"ezturp/protocol"
 	"ezturp/tools"
+	"io"
 	"log"
 	"math/rand"
 	"net"
@@ -16,10 +19,15 @@ const (
 	INTERNAL_CONN_IDLE       = 3 * time.Minute
 	KEEP_ALIVE               = INTERNAL_CONN_IDLE / 2
 	MAINTAIN_UDP_CLIENT_ADDR = 60
+	LINK_AUTH_TIMEOUT        = 2 * time.Second
+	LINK_AUTH_PENDING        = 32 // internal connections that may wait for their turn at once
 )
 
 type TcpServer struct {
 	Name                string
+	Metrics             *Metrics
+	Limiter             *Limiter
+	Secret              string
 	logger              tools.Logger
 	reacceptSig         chan interface{}
 	internalAcceptedSig chan interface{}
@@ -27,80 +35,362 @@ type TcpServer struct {
 	internalConnMutex   sync.Mutex
 	externalConns       map[uint32]net.Conn
 	internalConn        net.Conn
+	unhealthy           bool
+	ranged              bool
+
+	closeMutex sync.Mutex
+	done       chan struct{}
+	listeners  []net.Listener
+	externals  []net.Listener
+	routines   routines
 }
 
 func (s *TcpServer) init() {
 	s.reacceptSig = make(chan interface{}, 1)
 	s.internalAcceptedSig = make(chan interface{}, 1)
+	s.externalConnMutex.Lock()
 	s.externalConns = map[uint32]net.Conn{}
-	s.logger = tools.Logger{"TcpServer", s.Name}
+	s.externalConnMutex.Unlock()
+	s.logger = tools.Logger{Service: "TcpServer", Name: s.Name}
+	if s.Metrics == nil {
+		s.Metrics = newMetrics(s.Name, TCP)
+	}
 }
 
 func (s *TcpServer) Listen(internalAddr, externalAddr string) error {
-	s.init()
 	internalListener, err := net.Listen("tcp", internalAddr)
 	if err != nil {
 		return err
 	}
-	defer internalListener.Close()
-	externalListener, err := net.Listen("tcp", externalAddr)
+	externalListener, err := listenStream(externalAddr)
+	if err != nil {
+		_ = internalListener.Close()
+		return err
+	}
+	return s.Serve(internalListener, externalListener)
+}
+
+// ListenContext is Listen that stops when ctx is cancelled
+func (s *TcpServer) ListenContext(ctx context.Context, internalAddr, externalAddr string) error {
+	return runContext(ctx, s, func() error {
+		return s.Listen(internalAddr, externalAddr)
+	})
+}
+
+// Shutdown stops accepting external connections and waits for the running
+// sessions to end before closing the server. When ctx is done first the
+// remaining sessions are closed and the error of ctx is returned.
+func (s *TcpServer) Shutdown(ctx context.Context) error {
+	return shutdown(ctx, s, &s.routines, s.closeExternals, s.sessionCount)
+}
+
+func (s *TcpServer) closeExternals() {
+	s.closeMutex.Lock()
+	defer s.closeMutex.Unlock()
+	for _, l := range s.externals {
+		_ = l.Close()
+	}
+}
+
+func (s *TcpServer) sessionCount() int {
+	s.externalConnMutex.Lock()
+	defer s.externalConnMutex.Unlock()
+	return len(s.externalConns)
+}
+
+// Sessions lists the live external connections
+func (s *TcpServer) Sessions() []SessionInfo {
+	s.externalConnMutex.Lock()
+	defer s.externalConnMutex.Unlock()
+	return connSessions(s.Name, TCP, s.externalConns)
+}
+
+// KillSession closes the external connection of session id
+func (s *TcpServer) KillSession(id uint32) bool {
+	if s.sessionFind(id) == nil {
+		return false
+	}
+	s.sessionRemove(id, CLOSE_KILLED)
+	return true
+}
+
+// ListenPorts serves every port of ports on externalHost over a single internal
+// connection. The client learns the external port of each session.
+func (s *TcpServer) ListenPorts(internalAddr, externalHost string, ports PortRanges) error {
+	internalListener, err := net.Listen("tcp", internalAddr)
+	if err != nil {
+		return err
+	}
+	listeners, err := listenPorts(externalHost, ports, func(addr string) (io.Closer, error) {
+		return listenStream(addr)
+	})
 	if err != nil {
+		_ = internalListener.Close()
 		return err
 	}
-	defer externalListener.Close()
-	go s.listenInternal(internalListener)
-	go s.listenExternal(externalListener)
+	externalListeners := make([]net.Listener, 0, len(listeners))
+	for _, l := range listeners {
+		externalListeners = append(externalListeners, l.(net.Listener))
+	}
+	return s.ServePorts(internalListener, externalListeners)
+}
+
+// Serve runs the server on listeners that are already open, it returns after Close.
+// Both listeners are closed when Serve returns.
+func (s *TcpServer) Serve(internalListener, externalListener net.Listener) error {
+	return s.serve(internalListener, []net.Listener{externalListener}, false)
+}
+
+// ServePorts is Serve for a port-range tunnel, externalListeners are listed in
+// the order of the client's local port range
+func (s *TcpServer) ServePorts(internalListener net.Listener, externalListeners []net.Listener) error {
+	return s.serve(internalListener, externalListeners, true)
+}
+
+func (s *TcpServer) serve(internalListener net.Listener, externalListeners []net.Listener, ranged bool) error {
+	s.init()
+	s.ranged = ranged
+	if !s.track(append([]net.Listener{internalListener}, externalListeners...)...) {
+		return errors.New("server closed")
+	}
+	s.closeMutex.Lock()
+	s.externals = externalListeners
+	s.closeMutex.Unlock()
+	s.routines.start(func() { s.listenInternal(internalListener) })
+	for i, l := range externalListeners {
+		i, l := i, l
+		s.routines.start(func() { s.listenExternal(l, i) })
+	}
 	s.dispatch()
+	_ = s.Close()
+	return s.routines.wait(context.Background())
+}
+
+func (s *TcpServer) doneChan() chan struct{} {
+	s.closeMutex.Lock()
+	defer s.closeMutex.Unlock()
+	if s.done == nil {
+		s.done = make(chan struct{})
+	}
+	return s.done
+}
+
+func (s *TcpServer) closed() bool {
+	select {
+	case <-s.doneChan():
+		return true
+	default:
+		return false
+	}
+}
+
+// track remembers listeners so that Close can release them
+func (s *TcpServer) track(listeners ...net.Listener) bool {
+	done := s.doneChan()
+	s.closeMutex.Lock()
+	defer s.closeMutex.Unlock()
+	select {
+	case <-done:
+		for _, l := range listeners {
+			_ = l.Close()
+		}
+		return false
+	default:
+	}
+	s.listeners = append(s.listeners, listeners...)
+	return true
+}
+
+// Close stops the server, closing its listeners, the internal connection and every session
+func (s *TcpServer) Close() error {
+	done := s.doneChan()
+	s.closeMutex.Lock()
+	select {
+	case <-done:
+		s.closeMutex.Unlock()
+		return nil
+	default:
+	}
+	close(done)
+	for _, l := range s.listeners {
+		_ = l.Close()
+	}
+	s.closeMutex.Unlock()
+
+	s.internalConnMutex.Lock()
+	if s.internalConn != nil {
+		_ = s.internalConn.Close()
+	}
+	s.internalConnMutex.Unlock()
+
+	s.externalConnMutex.Lock()
+	for id, conn := range s.externalConns {
+		_ = conn.Close()
+		delete(s.externalConns, id)
+		endSession(&s.logger, id, conn, CLOSE_STOPPED)
+	}
+	s.externalConnMutex.Unlock()
 	return nil
 }
 
 func (s *TcpServer) listenInternal(listener net.Listener) {
+	done := s.doneChan()
+	authenticated := make(chan net.Conn)
+	s.routines.start(func() { s.acceptInternal(listener, authenticated) })
 	for {
 		s.logger.Info("listen internal connection %v", listener.Addr())
-		internalConn, err := listener.Accept()
-		if err != nil {
-			log.Println(err)
-			continue
+		var internalConn net.Conn
+		select {
+		case internalConn = <-authenticated:
+		case <-done:
+			return
 		}
 		s.internalConnMutex.Lock()
 		s.internalConn = internalConn
+		s.unhealthy = false
 		s.internalConnMutex.Unlock()
+		s.Metrics.linkUp()
 
 		s.internalAcceptedSig <- struct{}{}
 		s.logger.Info("internal %v connected", internalConn.RemoteAddr())
-		<-s.reacceptSig
+		select {
+		case <-s.reacceptSig:
+		case <-done:
+		}
 
 		s.internalConnMutex.Lock()
 		_ = internalConn.Close()
 		s.internalConn = nil
 		s.internalConnMutex.Unlock()
+		s.Metrics.linkDown()
 
 		s.logger.Info("internal %v disconnected", internalConn.RemoteAddr())
+		if s.closed() {
+			return
+		}
+	}
+}
+
+// acceptInternal authenticates each internal connection in its own goroutine,
+// so that one which sends nothing does not hold up the others, and hands the
+// connections that passed to listenInternal
+func (s *TcpServer) acceptInternal(listener net.Listener, authenticated chan<- net.Conn) {
+	done := s.doneChan()
+	pending := make(chan struct{}, LINK_AUTH_PENDING)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.closed() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.logger.Warn("accepting internal connection : %v", err)
+			time.Sleep(200 * time.Millisecond)
+			continue
+		}
+		select {
+		case pending <- struct{}{}:
+		default:
+			s.logger.Warn("internal %v rejected : too many connections waiting", conn.RemoteAddr())
+			_ = conn.Close()
+			continue
+		}
+		s.routines.start(func() {
+			defer func() { <-pending }()
+			if err := s.authenticate(conn); err != nil {
+				s.logger.Warn("internal %v rejected : %v", conn.RemoteAddr(), err)
+				_ = conn.Close()
+				return
+			}
+			select {
+			case authenticated <- conn:
+			case <-done:
+				_ = conn.Close()
+			}
+		})
 	}
 }
+
+// authenticate reads the LINK_AUTH frame that must open the internal connection
+// when the server has a Secret
+func (s *TcpServer) authenticate(conn net.Conn) error {
+	if s.Secret == "" {
+		return nil
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(LINK_AUTH_TIMEOUT))
+	t, _, data, err := protocol.ReadFrame(conn)
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return err
+	}
+	if t != protocol.LINK_AUTH || subtle.ConstantTimeCompare(data, []byte(s.Secret)) != 1 {
+		return errors.New("wrong secret")
+	}
+	return nil
+}
+
 func (s *TcpServer) internalNil() bool {
 	s.internalConnMutex.Lock()
 	defer s.internalConnMutex.Unlock()
 	return s.internalConn == nil
 }
-func (s *TcpServer) listenExternal(listener net.Listener) {
+
+// available reports whether a client is connected and its local service is healthy
+func (s *TcpServer) available() bool {
+	s.internalConnMutex.Lock()
+	defer s.internalConnMutex.Unlock()
+	return s.internalConn != nil && !s.unhealthy
+}
+
+func (s *TcpServer) setHealth(data []byte) {
+	healthy, _, err := parseHealthFrame(data)
+	if err != nil {
+		s.logger.Warn("bad health status : %v", err)
+		return
+	}
+	s.internalConnMutex.Lock()
+	s.unhealthy = !healthy
+	s.internalConnMutex.Unlock()
+	if healthy {
+		s.logger.Info("local service is healthy, accepting sessions")
+	} else {
+		s.logger.Warn("local service is unhealthy, refusing new sessions")
+	}
+}
+func (s *TcpServer) listenExternal(listener net.Listener, index int) {
 	s.logger.Info("listen external connection %v", listener.Addr())
+	var meta []byte
+	if s.ranged {
+		meta = encodeSessionPort(portOf(listener.Addr()), index)
+	}
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if s.closed() || errors.Is(err, net.ErrClosed) {
+				return
+			}
 			continue
 		}
-		if s.internalNil() {
+		if !s.available() {
 			_ = conn.Close()
 			continue
 		}
-		err, id := s.sessionCreate(conn)
+		limit, ok := s.Limiter.open(ipOf(conn.RemoteAddr()))
+		if !ok {
+			s.logger.Debug("%v refused, the quota is exhausted", conn.RemoteAddr())
+			_ = conn.Close()
+			continue
+		}
+		counted := newCountedConn(conn, s.Metrics, conn.RemoteAddr().String(), "")
+		counted.stat.limit = limit
+		err, id := s.sessionCreate(counted, meta)
 		if err != nil {
 			s.logger.Error("failed to accept external connection %v", err)
+			counted.stat.limit.close()
 			conn.Close()
+			continue
 		}
-		go s.proxy(conn, id)
-		s.logger.Info("%v connected", conn.RemoteAddr())
+		s.routines.start(func() { s.proxy(counted, id) })
+		s.logger.Session(id, conn.RemoteAddr()).Info("%v connected", conn.RemoteAddr())
 	}
 }
 
@@ -111,13 +401,14 @@ func (s *TcpServer) sessionFind(id uint32) (conn net.Conn) {
 	return conn
 }
 
-func (s *TcpServer) sessionRemove(id uint32) {
+func (s *TcpServer) sessionRemove(id uint32, reason string) {
 	s.externalConnMutex.Lock()
 	defer s.externalConnMutex.Unlock()
 	if conn, ok := s.externalConns[id]; ok {
 		_ = conn.Close()
-		s.logger.Debug("session %v,address %v removed", id, conn.RemoteAddr())
+		s.logger.Session(id, conn.RemoteAddr()).Debug("address %v removed", conn.RemoteAddr())
 		delete(s.externalConns, id)
+		endSession(&s.logger, id, conn, reason)
 		_ = s.internalWriteFrame(protocol.REMOVE_SESSION, id, []byte{})
 	}
 }
@@ -125,13 +416,16 @@ func (s *TcpServer) sessionRemove(id uint32) {
 func (s *TcpServer) internalWriteFrame(t byte, id uint32, data []byte) (err error) {
 	if !s.internalNil() {
 		err = protocol.WriteFrame(s.internalConn, t, id, data)
+		if err == nil {
+			s.Metrics.add(&s.Metrics.FramesOut, 1)
+		}
 	} else {
 		err = errors.New("internal connection is disabled")
 	}
 	return err
 }
 
-func (s *TcpServer) sessionCreate(conn net.Conn) (error, uint32) {
+func (s *TcpServer) sessionCreate(conn net.Conn, meta []byte) (error, uint32) {
 	var id uint32
 	s.externalConnMutex.Lock()
 	defer s.externalConnMutex.Unlock()
@@ -141,22 +435,26 @@ func (s *TcpServer) sessionCreate(conn net.Conn) (error, uint32) {
 			break
 		}
 	}
-	err := s.internalWriteFrame(protocol.NEW_SESSION, id, []byte{})
+	err := s.internalWriteFrame(protocol.NEW_SESSION, id, meta)
 	if err != nil {
 		return err, 0
 	}
 	s.externalConns[id] = conn
+	s.Metrics.add(&s.Metrics.SessionsOpened, 1)
 	return nil, id
 }
 
-func (s *TcpServer) proxy(conn net.Conn, id uint32) {
+func (s *TcpServer) proxy(conn *countedConn, id uint32) {
 	buf := make([]byte, BUF_SIZE)
+	reason := CLOSE_ERROR
 	for {
 		n, err := conn.Read(buf)
 		if err != nil {
 			log.Printf("external %v disconnected", conn.RemoteAddr())
+			reason = CLOSE_PEER
 			break
 		}
+		conn.stat.limit.wait(DOWNLOAD, n)
 		if s.internalConn == nil {
 			break
 		}
@@ -165,7 +463,7 @@ func (s *TcpServer) proxy(conn net.Conn, id uint32) {
 			break
 		}
 	}
-	s.sessionRemove(id)
+	s.sessionRemove(id, reason)
 }
 
 /*
@@ -191,17 +489,35 @@ func (s *TcpServer) internalReadFrame(timeout time.Time) (t byte, id uint32, dat
 }
 
 func (s *TcpServer) dispatch() {
+	done := s.doneChan()
 	for {
 		if s.internalNil() {
-			<-s.internalAcceptedSig
+			select {
+			case <-s.internalAcceptedSig:
+			case <-done:
+				return
+			}
 		}
 		t, id, data, err := s.internalReadFrame(time.Now().Add(INTERNAL_CONN_IDLE))
 		if err != nil {
-			s.reacceptSig <- struct{}{}
+			select {
+			case s.reacceptSig <- struct{}{}:
+			case <-done:
+				return
+			}
 			time.Sleep(200 * time.Millisecond)
 			continue
 		}
+		s.Metrics.add(&s.Metrics.FramesIn, 1)
 		if t == protocol.KEEP_ALIVE {
+			// clients that measure the round trip send a timestamp to echo
+			if len(data) > 0 {
+				_ = s.internalWriteFrame(protocol.KEEP_ALIVE, 0, data)
+			}
+			continue
+		}
+		if t == protocol.HEALTH_STATUS {
+			s.setHealth(data)
 			continue
 		}
 		conn := s.sessionFind(id)
@@ -218,12 +534,12 @@ func (s *TcpServer) handleInternalMsg(conn net.Conn, t byte, id uint32, data []b
 	case protocol.DATA:
 		_, err := conn.Write(data)
 		if err != nil {
-			s.sessionRemove(id)
+			s.sessionRemove(id, CLOSE_ERROR)
 		}
 	case protocol.REMOVE_SESSION:
-		s.sessionRemove(id)
+		s.sessionRemove(id, CLOSE_REMOTE)
 	default:
-		s.logger.Warn("unknown message type : %v in session %v", t, id)
-		s.sessionRemove(id)
+		s.logger.Session(id, nil).Warn("unknown message type : %v", t)
+		s.sessionRemove(id, CLOSE_ERROR)
 	}
 }
@@ -0,0 +1,70 @@
+package app
+
+import (
+	"ezturp/protocol"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_tcpServerLinkAuth(t *testing.T) {
+	internal, err := net.Listen(TCP, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	external, err := net.Listen(TCP, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &TcpServer{Name: "test", Secret: "s3cret"}
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(internal, external)
+	}()
+	defer func() {
+		_ = s.Close()
+		<-served
+	}()
+	dial := func(secret string) net.Conn {
+		conn, err := net.Dial(TCP, internal.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if secret != "" {
+			if err := protocol.WriteFrame(conn, protocol.LINK_AUTH, 0, []byte(secret)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return conn
+	}
+	// a connection that sends nothing does not hold up the client behind it
+	silent := dial("")
+	defer silent.Close()
+	wrong := dial("guess")
+	defer wrong.Close()
+	start := time.Now()
+	client := dial("s3cret")
+	defer client.Close()
+	for s.internalNil() {
+		if time.Since(start) > LINK_AUTH_TIMEOUT/2 {
+			t.Fatal("client not accepted while another connection is silent")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, c := range []struct {
+		name  string
+		conn  net.Conn
+		after time.Duration
+	}{
+		{"wrong secret", wrong, 0},
+		{"silent", silent, LINK_AUTH_TIMEOUT},
+	} {
+		_ = c.conn.SetReadDeadline(time.Now().Add(2 * LINK_AUTH_TIMEOUT))
+		if _, err := c.conn.Read(make([]byte, 1)); err == nil {
+			t.Errorf("%s: connection kept", c.name)
+		}
+		if waited := time.Since(start); waited < c.after || waited > c.after+LINK_AUTH_TIMEOUT/2 {
+			t.Errorf("%s: closed after %v, want %v", c.name, waited, c.after)
+		}
+	}
+}
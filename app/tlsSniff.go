@@ -0,0 +1,55 @@
+package app
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+var errHelloRead = errors.New("client hello read")
+
+// peekedConn replays the bytes read ahead from a connection before reading on
+type peekedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// readOnlyConn lets crypto/tls parse a ClientHello without answering it
+type readOnlyConn struct {
+	reader io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.reader.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// sniffTls reads the ClientHello of conn and returns the requested server name
+// together with a connection that replays the hello, TLS is not terminated
+func sniffTls(conn net.Conn) (net.Conn, string, error) {
+	var buf bytes.Buffer
+	var serverName string
+	var hello bool
+	err := tls.Server(readOnlyConn{io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = info.ServerName
+			hello = true
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if !hello {
+		return nil, "", err
+	}
+	return &peekedConn{Conn: conn, reader: io.MultiReader(&buf, conn)}, serverName, nil
+}
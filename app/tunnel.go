@@ -0,0 +1,317 @@
+package app
+
+import (
+	"errors"
+	"ezturp/tools"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	TUNNEL_RUNNING     = "running"
+	TUNNEL_BACKING_OFF = "backing_off"
+	TUNNEL_FAILED      = "failed"
+	TUNNEL_DISABLED    = "disabled"
+
+	RESTART_INITIAL_DELAY = time.Second
+	RESTART_MAX_DELAY     = time.Minute
+	RESTART_MULTIPLIER    = 2
+	RESTART_JITTER        = 0.2
+	RESTART_RESET_AFTER   = time.Minute
+)
+
+// RestartPolicy controls how a manager restarts a tunnel that stopped.
+// Zero values fall back to the defaults above, MaxAttempts 0 retries forever.
+type RestartPolicy struct {
+	InitialDelay Duration `json:"initial_delay"`
+	MaxDelay     Duration `json:"max_delay"`
+	Multiplier   float64  `json:"multiplier"`
+	Jitter       float64  `json:"jitter"`
+	MaxAttempts  int      `json:"max_attempts"`
+	ResetAfter   Duration `json:"reset_after"`
+}
+
+func (p *RestartPolicy) withDefaults() RestartPolicy {
+	var policy RestartPolicy
+	if p != nil {
+		policy = *p
+	}
+	if policy.InitialDelay <= 0 {
+		policy.InitialDelay = Duration(RESTART_INITIAL_DELAY)
+	}
+	if policy.MaxDelay <= 0 {
+		policy.MaxDelay = Duration(RESTART_MAX_DELAY)
+	}
+	if policy.MaxDelay < policy.InitialDelay {
+		policy.MaxDelay = policy.InitialDelay
+	}
+	if policy.Multiplier < 1 {
+		policy.Multiplier = RESTART_MULTIPLIER
+	}
+	if policy.Jitter <= 0 || policy.Jitter > 1 {
+		policy.Jitter = RESTART_JITTER
+	}
+	if policy.ResetAfter <= 0 {
+		policy.ResetAfter = Duration(RESTART_RESET_AFTER)
+	}
+	return policy
+}
+
+// delay returns the wait before the given restart attempt, counted from 1
+func (p RestartPolicy) delay(attempt int) time.Duration {
+	d := float64(p.InitialDelay)
+	for i := 1; i < attempt && d < float64(p.MaxDelay); i++ {
+		d *= p.Multiplier
+	}
+	if d > float64(p.MaxDelay) {
+		d = float64(p.MaxDelay)
+	}
+	d += d * p.Jitter * (rand.Float64()*2 - 1)
+	return time.Duration(d)
+}
+
+// TunnelState is a snapshot of one configured tunnel of a manager
+type TunnelState struct {
+	Name      string     `json:"name"`
+	Protocol  string     `json:"protocol"`
+	State     string     `json:"state"`
+	Attempts  int        `json:"attempts"`
+	LastError string     `json:"last_error,omitempty"`
+	Since     time.Time  `json:"since"`
+	NextRetry *time.Time `json:"next_retry,omitempty"`
+}
+
+type tunnel struct {
+	kind   string
+	mutex  sync.Mutex
+	state  TunnelState
+	policy RestartPolicy
+	logger *tools.Logger
+
+	current *group
+	stopped chan struct{}
+	exited  chan struct{}
+}
+
+func newTunnel(kind, name, protocol string, policy *RestartPolicy, logger *tools.Logger) *tunnel {
+	return &tunnel{
+		kind:    kind,
+		state:   TunnelState{Name: name, Protocol: protocol, State: TUNNEL_RUNNING, Since: time.Now()},
+		policy:  policy.withDefaults(),
+		logger:  logger,
+		stopped: make(chan struct{}),
+		exited:  make(chan struct{}),
+	}
+}
+
+func (t *tunnel) State() TunnelState {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.state
+}
+
+func (t *tunnel) setState(state string, attempts int, err error, next time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.state.State != state {
+		t.state.Since = time.Now()
+	}
+	t.state.State = state
+	t.state.Attempts = attempts
+	t.state.NextRetry = nil
+	if !next.IsZero() {
+		t.state.NextRetry = &next
+	}
+	if err != nil {
+		t.state.LastError = err.Error()
+	}
+}
+
+// run keeps calling start until the restart policy gives up or stop is called
+func (t *tunnel) run(start func(*group) error) {
+	defer close(t.exited)
+	var attempts int
+	for {
+		g := &group{}
+		t.mutex.Lock()
+		t.current = g
+		t.mutex.Unlock()
+		if t.isStopped() {
+			return
+		}
+		t.setState(TUNNEL_RUNNING, attempts, nil, time.Time{})
+		started := time.Now()
+		err := start(g)
+		g.close()
+		if t.isStopped() {
+			return
+		}
+		if err == nil {
+			err = errors.New("stopped")
+		}
+		var invalid configError
+		if errors.As(err, &invalid) {
+			t.setState(TUNNEL_FAILED, attempts, err, time.Time{})
+			t.logger.Error("%s %v is misconfigured: %v", t.kind, t.state.Name, err)
+			return
+		}
+		if time.Since(started) >= time.Duration(t.policy.ResetAfter) {
+			attempts = 0
+		}
+		attempts++
+		t.logger.Error("%s %v error: %v", t.kind, t.state.Name, err)
+		if t.policy.MaxAttempts > 0 && attempts >= t.policy.MaxAttempts {
+			t.setState(TUNNEL_FAILED, attempts, err, time.Time{})
+			t.logger.Error("%s %v failed after %d attempts", t.kind, t.state.Name, attempts)
+			return
+		}
+		delay := t.policy.delay(attempts)
+		t.setState(TUNNEL_BACKING_OFF, attempts, err, time.Now().Add(delay))
+		t.logger.Info("%s %v restart in %v", t.kind, t.state.Name, delay.Round(time.Millisecond))
+		select {
+		case <-time.After(delay):
+		case <-t.stopped:
+			return
+		}
+	}
+}
+
+func (t *tunnel) isStopped() bool {
+	select {
+	case <-t.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop closes the endpoints of the running attempt and waits for run to return
+func (t *tunnel) stop() {
+	t.mutex.Lock()
+	select {
+	case <-t.stopped:
+	default:
+		close(t.stopped)
+	}
+	g := t.current
+	t.mutex.Unlock()
+	if g != nil {
+		g.close()
+	}
+	<-t.exited
+}
+
+// disable stops the tunnel and reports it as disabled
+func (t *tunnel) disable() {
+	t.stop()
+	t.setState(TUNNEL_DISABLED, 0, nil, time.Time{})
+}
+
+// skip reports a tunnel that is never run as disabled
+func (t *tunnel) skip() {
+	close(t.exited)
+	t.disable()
+}
+
+// endpoints returns the endpoints of the running attempt that hold sessions
+func (t *tunnel) endpoints() []sessionHolder {
+	t.mutex.Lock()
+	g := t.current
+	t.mutex.Unlock()
+	if g == nil {
+		return nil
+	}
+	return g.endpoints()
+}
+
+// configError is returned by tunnels whose configuration cannot work, they are
+// not restarted
+type configError struct {
+	err error
+}
+
+func (e configError) Error() string { return e.err.Error() }
+func (e configError) Unwrap() error { return e.err }
+
+// failed is the start function of a tunnel whose configuration cannot work
+func failed(err error) func(*group) error {
+	return func(*group) error {
+		return configError{err}
+	}
+}
+
+// group holds the endpoints that run together for one entry, such as the tcp
+// and udp halves of a "tcp+udp" entry. Start functions add the endpoint they
+// create to the group they are given so that stopping the tunnel closes them.
+type group struct {
+	mutex   sync.Mutex
+	closers []io.Closer
+	closed  bool
+}
+
+// add registers an endpoint, it is closed at once when the group already stopped
+func (g *group) add(c io.Closer) {
+	if g == nil {
+		return
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.closed {
+		_ = c.Close()
+		return
+	}
+	g.closers = append(g.closers, c)
+}
+
+func (g *group) close() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.closed = true
+	for _, c := range g.closers {
+		_ = c.Close()
+	}
+	g.closers = nil
+}
+
+func (g *group) endpoints() []sessionHolder {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	var holders []sessionHolder
+	for _, c := range g.closers {
+		switch e := c.(type) {
+		case *group:
+			holders = append(holders, e.endpoints()...)
+		case sessionHolder:
+			holders = append(holders, e)
+		}
+	}
+	return holders
+}
+
+func (g *group) Close() error {
+	g.close()
+	return nil
+}
+
+// together is the start function of an entry whose endpoints share one
+// lifecycle: the first endpoint to stop closes the others
+func together(starts ...func(*group) error) func(*group) error {
+	return func(outer *group) error {
+		g := &group{}
+		outer.add(g)
+		errs := make(chan error, len(starts))
+		for _, start := range starts {
+			go func(start func(*group) error) {
+				errs <- start(g)
+			}(start)
+		}
+		err := <-errs
+		g.close()
+		for i := 1; i < len(starts); i++ {
+			<-errs
+		}
+		return err
+	}
+}
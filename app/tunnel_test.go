@@ -0,0 +1,127 @@
+package app
+
+import (
+	"errors"
+	"ezturp/tools"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_restartDelay(t *testing.T) {
+	cases := []struct {
+		name   string
+		policy RestartPolicy
+		delays []time.Duration
+	}{
+		{"doubles up to the cap",
+			RestartPolicy{InitialDelay: Duration(time.Second), MaxDelay: Duration(10 * time.Second), Multiplier: 2},
+			[]time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}},
+		{"triples",
+			RestartPolicy{InitialDelay: Duration(100 * time.Millisecond), MaxDelay: Duration(time.Minute), Multiplier: 3},
+			[]time.Duration{100 * time.Millisecond, 300 * time.Millisecond, 900 * time.Millisecond, 2700 * time.Millisecond}},
+	}
+	for _, c := range cases {
+		for i, want := range c.delays {
+			if got := c.policy.delay(i + 1); got != want {
+				t.Errorf("%s: attempt %d waits %v, want %v", c.name, i+1, got, want)
+			}
+		}
+	}
+	// the cap is raised to the first delay, jitter stays within its fraction
+	policy := (&RestartPolicy{InitialDelay: Duration(5 * time.Second), MaxDelay: Duration(time.Second)}).withDefaults()
+	if policy.MaxDelay != policy.InitialDelay || policy.Jitter != RESTART_JITTER {
+		t.Fatalf("defaults %+v", policy)
+	}
+	for attempt := 1; attempt < 50; attempt++ {
+		d := policy.delay(attempt)
+		if d < 4*time.Second || d > 6*time.Second {
+			t.Fatalf("attempt %d waits %v, outside 5s ± 20%%", attempt, d)
+		}
+	}
+	defaults := (*RestartPolicy)(nil).withDefaults()
+	if defaults.InitialDelay != Duration(RESTART_INITIAL_DELAY) || defaults.MaxDelay != Duration(RESTART_MAX_DELAY) ||
+		defaults.Multiplier != RESTART_MULTIPLIER {
+		t.Errorf("defaults %+v", defaults)
+	}
+}
+
+// testEndpoint stands for a server or client, Close ends its serve call
+type testEndpoint struct {
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (e *testEndpoint) Close() error {
+	e.once.Do(func() { close(e.closed) })
+	return nil
+}
+
+// serve is a start function that runs until the endpoint is closed or fail is closed
+func (e *testEndpoint) serve(fail chan struct{}) func(*group) error {
+	return func(g *group) error {
+		g.add(e)
+		select {
+		case <-e.closed:
+			return errors.New("closed")
+		case <-fail:
+			return errors.New("failed")
+		}
+	}
+}
+
+func Test_together(t *testing.T) {
+	tcp, udp := &testEndpoint{closed: make(chan struct{})}, &testEndpoint{closed: make(chan struct{})}
+	fail := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- together(tcp.serve(fail), udp.serve(nil))(&group{})
+	}()
+	// the udp half going down takes the tcp half with it
+	close(fail)
+	select {
+	case err := <-done:
+		if err == nil || err.Error() != "failed" {
+			t.Errorf("returned %v, want the error of the first half to stop", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("halves not stopped together")
+	}
+	for name, e := range map[string]*testEndpoint{"tcp": tcp, "udp": udp} {
+		select {
+		case <-e.closed:
+		default:
+			t.Errorf("%s half left open", name)
+		}
+	}
+	// stopping the tunnel closes both halves
+	tcp, udp = &testEndpoint{closed: make(chan struct{})}, &testEndpoint{closed: make(chan struct{})}
+	tn := newTunnel("tcp+udp server", "game", TCP_UDP, &RestartPolicy{MaxAttempts: 1}, &tools.Logger{})
+	go tn.run(together(tcp.serve(nil), udp.serve(nil)))
+	for !started(tn) {
+		time.Sleep(time.Millisecond)
+	}
+	tn.stop()
+	<-tcp.closed
+	<-udp.closed
+}
+
+// started reports whether the running attempt of a tunnel registered its endpoints
+func started(tn *tunnel) bool {
+	tn.mutex.Lock()
+	defer tn.mutex.Unlock()
+	if tn.current == nil {
+		return false
+	}
+	tn.current.mutex.Lock()
+	defer tn.current.mutex.Unlock()
+	return len(tn.current.closers) > 0
+}
+
+func Test_tunnelConfigError(t *testing.T) {
+	tn := newTunnel("server", "web", TCP, nil, &tools.Logger{})
+	tn.run(failed(errors.New("host is required")))
+	if state := tn.State(); state.State != TUNNEL_FAILED || state.Attempts != 0 || state.LastError != "host is required" {
+		t.Errorf("misconfigured tunnel %+v, want failed without a restart", state)
+	}
+}
@@ -1,42 +1,90 @@
 package app
 
 import (
+	"context"
+	"errors"
 	"ezturp/protocol"
 	"ezturp/tools"
 	"net"
 	"sync"
+	"syscall"
 	"time"
 )
 
 type UdpClient struct {
 	Name         string
+	Metrics      *Metrics
+	Limiter      *Limiter
+	Key          string
+	Secret       string
+	Mtu          int
+	Idle         time.Duration
 	logger       tools.Logger
 	LocalAddr    string
-	localAddr    *net.UDPAddr
+	LocalAddrs   []string
+	LocalPorts   PortRanges
+	Balance      string
+	FailTimeout  time.Duration
+	Health       *HealthCheck
+	backends     *backendPool
 	internalConn *net.UDPConn
+	health       *backendHealth
+	maintainNow  chan struct{}
 
 	sessionMutex      sync.Mutex
-	sessionConnMap    map[uint32]*net.UDPConn
+	sessionConnMap    map[uint32]net.Conn
 	sessionTimeoutMap map[uint32]*time.Timer
+
+	fragId      uint32
+	reassembler protocol.Reassembler
+
+	draining   bool
+	closeMutex sync.Mutex
+	closed     bool
+	routines   routines
 }
 
 const (
 	UDP_CLIENT_IDLE = 30 * time.Minute
+	UDP_ADDR_CHECK  = 5 * time.Second // how often the client checks that its local address still routes to the server
 )
 
 func (c *UdpClient) init() {
-	c.sessionConnMap = make(map[uint32]*net.UDPConn)
+	c.sessionMutex.Lock()
+	c.sessionConnMap = make(map[uint32]net.Conn)
 	c.sessionTimeoutMap = make(map[uint32]*time.Timer)
-	c.logger = tools.Logger{"UdpClient", c.Name}
+	c.sessionMutex.Unlock()
+	c.maintainNow = make(chan struct{}, 1)
+	if c.Idle <= 0 {
+		c.Idle = UDP_CLIENT_IDLE
+	}
+	c.logger = tools.Logger{Service: "UdpClient", Name: c.Name}
+	if c.Metrics == nil {
+		c.Metrics = newMetrics(c.Name, UDP)
+	}
+}
+
+// localAddrs returns LocalAddrs, or LocalAddr when LocalAddrs is empty
+func (c *UdpClient) localAddrs() []string {
+	if len(c.LocalAddrs) > 0 {
+		return c.LocalAddrs
+	}
+	return []string{c.LocalAddr}
 }
 
 func (c *UdpClient) Connect(internalAddr string) error {
 	c.init()
-	localAddr, err := net.ResolveUDPAddr("udp", c.LocalAddr)
-	c.localAddr = localAddr
+	var err error
+	c.backends, err = newBackendPool(c.localAddrs(), c.Balance, c.FailTimeout)
 	if err != nil {
 		return err
 	}
+	if c.Health != nil {
+		c.health, err = newBackendHealth(c.Name, c.backends, c.Health, c.reportHealth)
+		if err != nil {
+			return err
+		}
+	}
 	addr, err := net.ResolveUDPAddr("udp", internalAddr)
 	if err != nil {
 		return err
@@ -45,30 +93,215 @@ func (c *UdpClient) Connect(internalAddr string) error {
 	if err != nil {
 		return err
 	}
+	c.closeMutex.Lock()
 	c.internalConn = conn
-	go c.maintainClientAddr()
-	return c.handleInternal()
+	closed := c.closed
+	c.closeMutex.Unlock()
+	if closed {
+		_ = conn.Close()
+		return errors.New("client closed")
+	}
+	c.Metrics.linkUp()
+	defer c.Metrics.linkDown()
+	done := make(chan struct{})
+	c.routines.start(func() { c.maintainClientAddr(done) })
+	if c.health != nil {
+		c.routines.start(func() { c.health.run(done) })
+	}
+	err = c.handleInternal()
+	close(done)
+	c.closeSessions(c.closeReason())
+	_ = c.routines.wait(context.Background())
+	return err
+}
+
+// ConnectContext is Connect that stops when ctx is cancelled
+func (c *UdpClient) ConnectContext(ctx context.Context, internalAddr string) error {
+	return runContext(ctx, c, func() error {
+		return c.Connect(internalAddr)
+	})
+}
+
+// Shutdown refuses new sessions and waits for the running ones to end before
+// closing the client. UDP sessions only end by going idle, so ctx should carry
+// a deadline; when it is done the remaining sessions are closed and the error
+// of ctx is returned.
+func (c *UdpClient) Shutdown(ctx context.Context) error {
+	return shutdown(ctx, c, &c.routines, c.drain, c.sessionCount)
+}
+
+func (c *UdpClient) drain() {
+	c.sessionMutex.Lock()
+	defer c.sessionMutex.Unlock()
+	c.draining = true
+}
+
+func (c *UdpClient) sessionCount() int {
+	c.sessionMutex.Lock()
+	defer c.sessionMutex.Unlock()
+	return len(c.sessionConnMap)
+}
+
+// Sessions lists the sessions that have a local socket
+func (c *UdpClient) Sessions() []SessionInfo {
+	c.sessionMutex.Lock()
+	defer c.sessionMutex.Unlock()
+	return connSessions(c.Name, UDP, c.sessionConnMap)
+}
+
+// KillSession closes the local socket of session id and tells the server to forget it
+func (c *UdpClient) KillSession(id uint32) bool {
+	return c.removeSession(id, true, CLOSE_KILLED)
+}
+
+// Close disconnects the client from the server and closes every local socket
+func (c *UdpClient) Close() error {
+	c.closeMutex.Lock()
+	c.closed = true
+	if c.internalConn != nil {
+		_ = c.internalConn.Close()
+	}
+	c.closeMutex.Unlock()
+	c.closeSessions(CLOSE_STOPPED)
+	return nil
+}
+
+// closeReason tells why the sessions end when the internal socket is gone
+func (c *UdpClient) closeReason() string {
+	c.closeMutex.Lock()
+	defer c.closeMutex.Unlock()
+	if c.closed {
+		return CLOSE_STOPPED
+	}
+	return CLOSE_LINK
+}
+
+func (c *UdpClient) closeSessions(reason string) {
+	c.sessionMutex.Lock()
+	for id, conn := range c.sessionConnMap {
+		_ = conn.Close()
+		endSession(&c.logger, id, conn, reason)
+		c.sessionTimeoutMap[id].Stop()
+		delete(c.sessionConnMap, id)
+		delete(c.sessionTimeoutMap, id)
+	}
+	c.sessionMutex.Unlock()
 }
 
-func (c *UdpClient) maintainClientAddr() {
+// maintainClientAddr signs the address of the client every period, and at once
+// when the server asks for it, a send fails or the local address changed
+func (c *UdpClient) maintainClientAddr(done <-chan struct{}) {
 	ticker := time.NewTicker(MAINTAIN_UDP_CLIENT_ADDR * time.Second)
+	defer ticker.Stop()
+	check := time.NewTicker(UDP_ADDR_CHECK)
+	defer check.Stop()
+	var sent time.Time
+	send, failed := true, false
 	for {
-		err := protocol.WriteFrame(c.internalConn, protocol.MAINTAIN_UDP_CLIENT_ADDR, 0, []byte{})
-		if err != nil {
-			break
+		if send {
+			err := c.writeFrame(protocol.MAINTAIN_UDP_CLIENT_ADDR, 0, maintainFrame(c.key(), c.Secret, time.Now()))
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				// the server is gone, reconnect
+				break
+			}
+			// while the network is down, try again on the next address check
+			failed = err != nil
+			if failed {
+				c.logger.Warn("failed to maintain the client address : %v", err)
+			}
+			sent = time.Now()
+			if c.health != nil && !failed {
+				// health frames may be lost like any datagram, so repeat the current state
+				c.reportHealth(c.health.Healthy())
+			}
+		}
+		select {
+		case <-ticker.C:
+			send = true
+		case <-c.maintainNow:
+			// a failed send may come from a local address that is gone
+			send = c.rebind() || time.Since(sent) >= UDP_PROMPT_INTERVAL
+		case <-check.C:
+			send = c.rebind() || failed
+		case <-done:
+			return
 		}
-		<-ticker.C
 	}
-	ticker.Stop()
-	_ = c.internalConn.Close()
+	_ = c.conn().Close()
+}
+
+// promptMaintain has the maintain frame sent at once
+func (c *UdpClient) promptMaintain() {
+	select {
+	case c.maintainNow <- struct{}{}:
+	default:
+	}
+}
+
+// rebind moves the internal link to a new socket when the system would send
+// to the server from another address, such as after the client switched
+// networks. The sessions are kept, the server follows the signed new address.
+func (c *UdpClient) rebind() bool {
+	conn := c.conn()
+	probe, err := net.DialUDP("udp", nil, conn.RemoteAddr().(*net.UDPAddr))
+	if err != nil {
+		c.logger.Debug("failed to check the local address : %v", err)
+		return false
+	}
+	if probe.LocalAddr().(*net.UDPAddr).IP.Equal(conn.LocalAddr().(*net.UDPAddr).IP) {
+		_ = probe.Close()
+		return false
+	}
+	c.closeMutex.Lock()
+	if c.closed {
+		c.closeMutex.Unlock()
+		_ = probe.Close()
+		return false
+	}
+	c.internalConn = probe
+	c.closeMutex.Unlock()
+	_ = conn.Close()
+	c.logger.Info("local address moved from %v to %v", conn.LocalAddr(), probe.LocalAddr())
+	return true
+}
+
+// conn is the socket of the internal link, which rebind replaces
+func (c *UdpClient) conn() *net.UDPConn {
+	c.closeMutex.Lock()
+	defer c.closeMutex.Unlock()
+	return c.internalConn
+}
+
+// reportHealth tells the server whether new sessions may be given to this client
+func (c *UdpClient) reportHealth(healthy bool) {
+	err := c.writeFrame(protocol.HEALTH_STATUS, 0, healthFrame(healthy, c.key()))
+	if err != nil {
+		c.logger.Warn("failed to report health : %v", err)
+	}
+}
+
+// key identifies the client to the server, the name is used when no key is set
+func (c *UdpClient) key() string {
+	if c.Key != "" {
+		return c.Key
+	}
+	return c.Name
 }
 
 func (c *UdpClient) handleInternal() (err error) {
-	buf := make([]byte, BUF_SIZE)
-	c.logger.Info("waiting for message from %v", c.internalConn.RemoteAddr())
+	buf := make([]byte, UDP_BUF_SIZE)
+	c.logger.Info("waiting for message from %v", c.conn().RemoteAddr())
 	for {
-		n, _, err := c.internalConn.ReadFromUDP(buf)
+		conn := c.conn()
+		n, _, err := conn.ReadFromUDP(buf)
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) && c.conn() != conn {
+				// rebound to a new local address
+				continue
+			}
 			//log.Printf("udp client receiving data error : %v", err)
 			c.logger.Error("receiving data error : %v", err)
 			break
@@ -79,26 +312,64 @@ func (c *UdpClient) handleInternal() (err error) {
 			c.logger.Error("parsing frame error : %v", err)
 			break
 		}
+		c.Metrics.add(&c.Metrics.FramesIn, 1)
+		if t == protocol.DATA_FRAGMENT {
+			var ok bool
+			t, data, ok, err = c.reassembler.Add("", id, data)
+			if err != nil {
+				c.logger.Warn("handling fragment : %v", err)
+				c.Metrics.add(&c.Metrics.Dropped, 1)
+				continue
+			}
+			if !ok {
+				continue
+			}
+		}
 		switch t {
 		case protocol.DATA:
-			c.dispatch(id, data)
+			c.dispatch(id, nil, data)
+		case protocol.PORT_DATA:
+			if len(data) < 4 {
+				c.logger.Session(id, nil).Warn("bad port data")
+				continue
+			}
+			c.dispatch(id, data[:4], data[4:])
+		case protocol.REMOVE_SESSION:
+			if c.removeSession(id, false, CLOSE_REMOTE) {
+				c.logger.Session(id, nil).Info("removed by server")
+			}
+		case protocol.REQUEST_UDP_CLIENT_ADDR:
+			c.promptMaintain()
 		default:
-			c.logger.Warn("unknown message type : %v in session %v", t, id)
+			c.logger.Session(id, nil).Warn("unknown message type : %v", t)
 		}
 	}
-	c.internalConn.Close()
+	c.conn().Close()
 	return
 }
 
-func (c *UdpClient) dispatch(id uint32, data []byte) {
-	conn, err := c.getConn(id)
+func (c *UdpClient) dispatch(id uint32, meta, data []byte) {
+	conn, err := c.getConn(id, meta)
 	if err != nil {
 		c.logger.Warn("getting udp connection error %v", err)
+		c.Metrics.add(&c.Metrics.Dropped, 1)
+		_ = c.writeFrame(protocol.REMOVE_SESSION, id, []byte{})
+		return
 	}
-	c.logger.Debug("session %v <- %d bytes", id, len(data))
 	c.resetSessionTimeout(id)
+	if !conn.stat.limit.allow(DOWNLOAD, len(data)) {
+		if c.logger.Enabled(tools.DEBUG) {
+			c.logger.Session(id, nil).Debug("over its limit, dropped %d bytes", len(data))
+		}
+		c.Metrics.add(&c.Metrics.Dropped, 1)
+		return
+	}
+	if c.logger.Enabled(tools.DEBUG) {
+		c.logger.Session(id, nil).Debug("<- %d bytes", len(data))
+	}
 	_, err = conn.Write(data)
 	if err != nil {
+		c.Metrics.add(&c.Metrics.Dropped, 1)
 		_ = conn.Close()
 	}
 }
@@ -107,56 +378,107 @@ func (c *UdpClient) resetSessionTimeout(id uint32) {
 	defer c.sessionMutex.Unlock()
 	tm, ok := c.sessionTimeoutMap[id]
 	if ok {
-		tm.Reset(UDP_CLIENT_IDLE)
+		tm.Reset(c.Idle)
 	}
 }
 
-func (c *UdpClient) getConn(id uint32) (*net.UDPConn, error) {
+func (c *UdpClient) getConn(id uint32, meta []byte) (*countedConn, error) {
 	c.sessionMutex.Lock()
 	defer c.sessionMutex.Unlock()
 	if conn, ok := c.sessionConnMap[id]; ok {
-		return conn, nil
+		return conn.(*countedConn), nil
+	}
+	if c.draining {
+		return nil, errors.New("client is shutting down")
+	}
+	dial, err := localDialer(dialPacket, c.LocalPorts, meta)
+	if err != nil {
+		return nil, err
+	}
+	limit, ok := c.Limiter.open("")
+	if !ok {
+		return nil, errors.New("the quota is exhausted")
 	}
 
-	newConn, err := net.DialUDP("udp", nil, c.localAddr)
+	// a session keeps the backend it was given, so its datagrams all reach the same service
+	newConn, err := c.backends.dial(dial)
 	if err != nil {
+		c.Metrics.add(&c.Metrics.DialFailures, 1)
+		limit.close()
 		return nil, err
 	}
-	c.sessionConnMap[id] = newConn
-	c.sessionTimeoutMap[id] = time.AfterFunc(UDP_CLIENT_IDLE, func() {
-		c.removeSession(id)
-		c.logger.Info("session %v is idle", id)
+	conn := newCountedConn(newConn, c.Metrics, "", newConn.backend.address)
+	conn.stat.limit = limit
+	c.Metrics.add(&c.Metrics.SessionsOpened, 1)
+	c.sessionConnMap[id] = conn
+	c.sessionTimeoutMap[id] = time.AfterFunc(c.Idle, func() {
+		if c.removeSession(id, true, CLOSE_IDLE) {
+			c.logger.Session(id, nil).Info("idle, removed")
+		}
 	})
-	go c.proxy(newConn, id)
-	c.logger.Info("created a new session %v,address %v", id, newConn.LocalAddr().String())
-	return newConn, nil
+	c.routines.start(func() { c.proxy(conn, newConn, id) })
+	c.logger.Session(id, newConn.backend.address).Info("created , address %v , local %v", newConn.LocalAddr().String(), newConn.backend.address)
+	return conn, nil
 }
 
-func (c *UdpClient) proxy(newConn *net.UDPConn, id uint32) {
-	buf := make([]byte, BUF_SIZE)
+func (c *UdpClient) proxy(newConn *countedConn, backend *backendConn, id uint32) {
+	buf := make([]byte, UDP_BUF_SIZE)
 	for {
 		n, err := newConn.Read(buf)
 		c.resetSessionTimeout(id)
 		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				backend.failed()
+			}
 			//c.logger.Error("receiving data from server error :%v", err)
 			break
 		}
-		err = protocol.WriteFrame(c.internalConn, protocol.DATA, id, buf[:n])
+		if !newConn.stat.limit.allow(UPLOAD, n) {
+			c.Metrics.add(&c.Metrics.Dropped, 1)
+			continue
+		}
+		err = c.writeFrame(protocol.DATA, id, buf[:n])
 		if err != nil {
-			c.logger.Error("sending data to server error :%v", err)
-			break
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			// the link may have moved, sign the address again and keep the session
+			if c.logger.Enabled(tools.DEBUG) {
+				c.logger.Session(id, nil).Debug("sending data to server error :%v", err)
+			}
+			c.Metrics.add(&c.Metrics.Dropped, 1)
+			c.promptMaintain()
+			continue
+		}
+		if c.logger.Enabled(tools.DEBUG) {
+			c.logger.Session(id, backend.backend.address).Debug("%v sent %v to server", newConn.LocalAddr(), n)
 		}
-		c.logger.Debug("session %v , %v sent %v to server", id, newConn.LocalAddr(), n)
 	}
 	_ = newConn.Close()
+	c.removeSession(id, true, CLOSE_ERROR)
 }
 
-func (c *UdpClient) removeSession(id uint32) {
+func (c *UdpClient) writeFrame(t byte, id uint32, data []byte) error {
+	frames, err := encodeUdpFrames(t, id, data, c.Mtu, &c.fragId)
+	if err != nil {
+		return err
+	}
+	conn := c.conn()
+	for _, frame := range frames {
+		if _, err = conn.Write(frame); err != nil {
+			return err
+		}
+		c.Metrics.add(&c.Metrics.FramesOut, 1)
+	}
+	return nil
+}
+
+func (c *UdpClient) removeSession(id uint32, notify bool, reason string) bool {
 	c.sessionMutex.Lock()
-	defer c.sessionMutex.Unlock()
 	conn, ok := c.sessionConnMap[id]
 	if ok {
 		delete(c.sessionConnMap, id)
+		endSession(&c.logger, id, conn, reason)
 		tm, ok1 := c.sessionTimeoutMap[id]
 		if ok1 {
 			tm.Stop()
@@ -164,4 +486,12 @@ func (c *UdpClient) removeSession(id uint32) {
 		}
 		conn.Close()
 	}
+	c.sessionMutex.Unlock()
+	if ok && notify {
+		err := c.writeFrame(protocol.REMOVE_SESSION, id, []byte{})
+		if err != nil {
+			c.logger.Session(id, nil).Warn("failed to notify server to remove the session : %v", err)
+		}
+	}
+	return ok
 }
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package app
+
+import "syscall"
+
+// transientErrnos fail a single datagram, not the socket
+var transientErrnos = []syscall.Errno{syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.EMSGSIZE}
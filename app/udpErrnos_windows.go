@@ -0,0 +1,11 @@
+package app
+
+import "syscall"
+
+// transientErrnos fail a single datagram, not the socket. Windows reports an
+// ICMP port unreachable for an earlier send as a reset on the next read.
+var transientErrnos = []syscall.Errno{
+	syscall.WSAECONNRESET,
+	syscall.Errno(10052), // WSAENETRESET
+	syscall.Errno(10040), // WSAEMSGSIZE
+}
@@ -0,0 +1,65 @@
+package app
+
+import (
+	"errors"
+	"ezturp/tools"
+	"syscall"
+	"time"
+)
+
+const (
+	UDP_READ_ERROR_BURST   = 10 // consecutive read errors before the reads slow down
+	UDP_READ_ERROR_BACKOFF = 200 * time.Millisecond
+	UDP_READ_ERROR_LOG     = 10 * time.Second // read errors are logged at most once per period
+)
+
+// readErrors paces a read loop over a socket that keeps failing. An error of
+// one datagram, such as the reset Windows reports after an ICMP port
+// unreachable, does not stop the socket and the next read goes on at once.
+type readErrors struct {
+	count  int
+	logged time.Time
+	quiet  int
+}
+
+// failed handles an error of a read that did not close the socket
+func (r *readErrors) failed(logger *tools.Logger, what string, err error) {
+	if transientError(err) {
+		if logger.Enabled(tools.DEBUG) {
+			logger.Debug("%s : %v", what, err)
+		}
+		return
+	}
+	r.count++
+	if now := time.Now(); now.Sub(r.logged) >= UDP_READ_ERROR_LOG {
+		if r.quiet > 0 {
+			logger.Warn("%s : %v , %d more errors since the last one logged", what, err, r.quiet)
+		} else {
+			logger.Warn("%s : %v", what, err)
+		}
+		r.logged, r.quiet = now, 0
+	} else {
+		r.quiet++
+	}
+	if r.count >= UDP_READ_ERROR_BURST {
+		time.Sleep(UDP_READ_ERROR_BACKOFF)
+	}
+}
+
+// ok ends a run of errors after a successful read
+func (r *readErrors) ok() {
+	r.count = 0
+}
+
+func transientError(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	for _, e := range transientErrnos {
+		if errno == e {
+			return true
+		}
+	}
+	return false
+}
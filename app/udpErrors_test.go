@@ -0,0 +1,44 @@
+package app
+
+import (
+	"errors"
+	"ezturp/tools"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_readErrors(t *testing.T) {
+	logger := tools.Logger{Service: "UdpServer", Name: "test"}
+	var r readErrors
+	reset := &net.OpError{Op: "read", Net: "udp", Err: os.NewSyscallError("recvfrom", transientErrnos[0])}
+	start := time.Now()
+	for i := 0; i < 3*UDP_READ_ERROR_BURST; i++ {
+		r.failed(&logger, "reading", reset)
+	}
+	if r.count != 0 || time.Since(start) >= UDP_READ_ERROR_BACKOFF {
+		t.Errorf("resets counted %d times and took %v", r.count, time.Since(start))
+	}
+	broken := errors.New("broken")
+	for i := 1; i < UDP_READ_ERROR_BURST; i++ {
+		r.failed(&logger, "reading", broken)
+	}
+	if time.Since(start) >= UDP_READ_ERROR_BACKOFF {
+		t.Errorf("backed off before %d errors", UDP_READ_ERROR_BURST)
+	}
+	if r.quiet != UDP_READ_ERROR_BURST-2 {
+		t.Errorf("%d errors not logged, want %d", r.quiet, UDP_READ_ERROR_BURST-2)
+	}
+	start = time.Now()
+	r.failed(&logger, "reading", broken)
+	if time.Since(start) < UDP_READ_ERROR_BACKOFF {
+		t.Error("no backoff after a burst of errors")
+	}
+	r.ok()
+	start = time.Now()
+	r.failed(&logger, "reading", broken)
+	if time.Since(start) >= UDP_READ_ERROR_BACKOFF {
+		t.Error("backed off after a successful read")
+	}
+}
@@ -0,0 +1,20 @@
+package app
+
+import (
+	"ezturp/protocol"
+	"sync/atomic"
+)
+
+const (
+	UDP_BUF_SIZE = 64 * 1024
+	UDP_MTU      = 1400
+)
+
+// encodeUdpFrames splits frames larger than mtu so that every datagram on the
+// internal link fits into the path MTU.
+func encodeUdpFrames(t byte, id uint32, data []byte, mtu int, fragId *uint32) ([][]byte, error) {
+	if mtu <= 0 {
+		mtu = UDP_MTU
+	}
+	return protocol.EncodeFrames(t, id, data, mtu, atomic.AddUint32(fragId, 1))
+}
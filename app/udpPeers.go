@@ -0,0 +1,257 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"ezturp/protocol"
+	"net"
+	"sort"
+	"time"
+)
+
+const (
+	BALANCE_ROUND_ROBIN = "round_robin"
+	BALANCE_STANDBY     = "standby"
+	UDP_CLIENT_ALIVE    = 3 * MAINTAIN_UDP_CLIENT_ADDR * time.Second
+	UDP_PROMPT_INTERVAL = time.Second // an address is asked to sign again at most once per interval
+	UDP_MAX_PROMPTED    = 1024
+)
+
+// udpPeer is a UdpClient known to the server, identified by the key it sends
+// in MAINTAIN_UDP_CLIENT_ADDR frames. Its address follows the client when it
+// roams, which takes a MAINTAIN_UDP_CLIENT_ADDR frame signed with the secret.
+type udpPeer struct {
+	key       string
+	addr      *net.UDPAddr
+	lastSeen  time.Time
+	stamp     int64
+	order     uint64
+	unhealthy bool
+}
+
+// maintainFrame is the payload of a MAINTAIN_UDP_CLIENT_ADDR frame: the time it
+// was sent, an HMAC-SHA256 of the time and the key under secret, then the key
+func maintainFrame(key, secret string, now time.Time) []byte {
+	p := make([]byte, 8, 8+sha256.Size+len(key))
+	binary.BigEndian.PutUint64(p, uint64(now.UnixNano()))
+	p = append(p, maintainMac(p[:8], key, secret)...)
+	return append(p, key...)
+}
+
+func maintainMac(stamp []byte, key, secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(stamp)
+	mac.Write([]byte(key))
+	return mac.Sum(nil)
+}
+
+// parseMaintainFrame checks the signature and the age of a MAINTAIN_UDP_CLIENT_ADDR
+// frame, and returns the key of the client with the time the frame was sent
+func parseMaintainFrame(data []byte, secret string, now time.Time) (string, int64, error) {
+	if len(data) < 8+sha256.Size {
+		return "", 0, errors.New("short maintain frame")
+	}
+	stamp, mac, key := data[:8], data[8:8+sha256.Size], string(data[8+sha256.Size:])
+	if !hmac.Equal(mac, maintainMac(stamp, key, secret)) {
+		return key, 0, errors.New("bad signature")
+	}
+	sent := int64(binary.BigEndian.Uint64(stamp))
+	if age := now.Sub(time.Unix(0, sent)); age > UDP_CLIENT_ALIVE || age < -UDP_CLIENT_ALIVE {
+		return key, 0, errors.New("stale or early timestamp")
+	}
+	return key, sent, nil
+}
+
+func (p *udpPeer) alive(now time.Time) bool {
+	return now.Sub(p.lastSeen) < UDP_CLIENT_ALIVE
+}
+
+func (s *UdpServer) keyAllowed(key string) bool {
+	if len(s.ClientKeys) == 0 {
+		return true
+	}
+	for _, k := range s.ClientKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// maintainClient registers a client or keeps it alive. Without a Secret the
+// frames cannot be told from forged ones, so a live client does not move.
+func (s *UdpServer) maintainClient(data []byte, addr *net.UDPAddr) {
+	now := time.Now()
+	key, stamp, err := parseMaintainFrame(data, s.Secret, now)
+	if err != nil {
+		s.logger.Warn("rejected maintain frame of udp client %q from %v : %v", key, addr, err)
+		return
+	}
+	if !s.keyAllowed(key) {
+		s.logger.Warn("rejected udp client %q from %v", key, addr)
+		return
+	}
+	s.clientMutex.Lock()
+	defer s.clientMutex.Unlock()
+	peer, ok := s.clients[key]
+	if !ok {
+		s.clientOrder++
+		peer = &udpPeer{key: key, order: s.clientOrder}
+		s.clients[key] = peer
+		s.logger.Info("udp client %q registered at %v", key, addr)
+	}
+	if stamp <= peer.stamp {
+		s.logger.Warn("rejected a replayed maintain frame of udp client %q from %v", key, addr)
+		return
+	}
+	if s.Secret == "" && peer.addr != nil && peer.addr.String() != addr.String() && peer.alive(now) {
+		s.logger.Warn("udp client %q is alive at %v, ignored it at %v", key, peer.addr, addr)
+		return
+	}
+	peer.stamp = stamp
+	s.movePeer(peer, addr)
+	peer.lastSeen = now
+	s.Metrics.linkUp()
+}
+
+// movePeer updates the address of a client, the caller must hold clientMutex
+func (s *UdpServer) movePeer(peer *udpPeer, addr *net.UDPAddr) {
+	addrStr := addr.String()
+	if peer.addr != nil {
+		if peer.addr.String() == addrStr {
+			return
+		}
+		delete(s.addrClientMap, peer.addr.String())
+		s.logger.Info("udp client %q roamed from %v to %v", peer.key, peer.addr, addr)
+	}
+	if old, ok := s.addrClientMap[addrStr]; ok && old != peer.key {
+		s.clients[old].addr = nil
+	}
+	peer.addr = addr
+	s.addrClientMap[addrStr] = peer.key
+}
+
+// checkSender reports whether a frame of a session owned by key may come from addr,
+// which is the address of the client's last maintain frame
+func (s *UdpServer) checkSender(key string, addr *net.UDPAddr) bool {
+	s.clientMutex.Lock()
+	defer s.clientMutex.Unlock()
+	peer, ok := s.clients[key]
+	if !ok || peer.addr == nil || peer.addr.String() != addr.String() {
+		return false
+	}
+	peer.lastSeen = time.Now()
+	return true
+}
+
+// promptClient asks addr, which no client holds, to send a maintain frame. A
+// client that roamed answers at once instead of at its next maintain period.
+// Without a Secret a live client does not move, so no prompt is sent.
+func (s *UdpServer) promptClient(addr *net.UDPAddr) {
+	if s.Secret == "" {
+		return
+	}
+	addrStr := addr.String()
+	now := time.Now()
+	s.clientMutex.Lock()
+	if now.Sub(s.prompted[addrStr]) < UDP_PROMPT_INTERVAL {
+		s.clientMutex.Unlock()
+		return
+	}
+	if len(s.prompted) >= UDP_MAX_PROMPTED {
+		for a, t := range s.prompted {
+			if now.Sub(t) >= UDP_PROMPT_INTERVAL {
+				delete(s.prompted, a)
+			}
+		}
+	}
+	full := len(s.prompted) >= UDP_MAX_PROMPTED
+	if !full {
+		s.prompted[addrStr] = now
+	}
+	s.clientMutex.Unlock()
+	if full {
+		return
+	}
+	if err := s.internalWriteFrame(addr, protocol.REQUEST_UDP_CLIENT_ADDR, 0, []byte{}); err != nil {
+		s.logger.Debug("failed to ask %v for its maintain frame : %v", addr, err)
+	}
+}
+
+// knownSender reports whether addr is the address of a client
+func (s *UdpServer) knownSender(addr *net.UDPAddr) bool {
+	s.clientMutex.Lock()
+	defer s.clientMutex.Unlock()
+	_, ok := s.addrClientMap[addr.String()]
+	return ok
+}
+
+func (s *UdpServer) clientAddr(key string) *net.UDPAddr {
+	s.clientMutex.Lock()
+	defer s.clientMutex.Unlock()
+	if peer, ok := s.clients[key]; ok {
+		return peer.addr
+	}
+	return nil
+}
+
+func (s *UdpServer) clientAlive(key string) bool {
+	s.clientMutex.Lock()
+	defer s.clientMutex.Unlock()
+	peer, ok := s.clients[key]
+	return ok && peer.addr != nil && peer.alive(time.Now())
+}
+
+// setClientHealth records the health a client reported for its local service,
+// unhealthy clients keep their sessions but get no new ones
+func (s *UdpServer) setClientHealth(data []byte, addr *net.UDPAddr) {
+	healthy, key, err := parseHealthFrame(data)
+	if err != nil || !s.checkSender(key, addr) {
+		return
+	}
+	s.clientMutex.Lock()
+	peer := s.clients[key]
+	changed := peer.unhealthy == healthy
+	peer.unhealthy = !healthy
+	s.clientMutex.Unlock()
+	if !changed {
+		return
+	}
+	if healthy {
+		s.logger.Info("udp client %q is healthy", key)
+	} else {
+		s.logger.Warn("udp client %q is unhealthy", key)
+	}
+}
+
+// pickClient chooses the client that serves a new session according to Balance
+func (s *UdpServer) pickClient() (string, bool) {
+	s.clientMutex.Lock()
+	defer s.clientMutex.Unlock()
+	now := time.Now()
+	var alive []*udpPeer
+	linked := false
+	for _, peer := range s.clients {
+		if peer.addr != nil && peer.alive(now) {
+			linked = true
+			if !peer.unhealthy {
+				alive = append(alive, peer)
+			}
+		}
+	}
+	if !linked {
+		// no client maintained its address lately
+		s.Metrics.linkDown()
+	}
+	if len(alive) == 0 {
+		return "", false
+	}
+	sort.Slice(alive, func(i, j int) bool { return alive[i].order < alive[j].order })
+	if s.Balance == BALANCE_STANDBY {
+		return alive[0].key, true
+	}
+	s.roundRobin++
+	return alive[s.roundRobin%uint64(len(alive))].key, true
+}
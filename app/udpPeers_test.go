@@ -0,0 +1,166 @@
+package app
+
+import (
+	"ezturp/protocol"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_parseMaintainFrame(t *testing.T) {
+	now := time.Now()
+	frame := maintainFrame("home", "s3cret", now)
+	tampered := append([]byte{}, frame...)
+	tampered[len(tampered)-1] = 'x'
+	cases := []struct {
+		name   string
+		data   []byte
+		secret string
+		ok     bool
+	}{
+		{"signed", frame, "s3cret", true},
+		{"wrong secret", frame, "other", false},
+		{"tampered key", tampered, "s3cret", false},
+		{"stale", maintainFrame("home", "s3cret", now.Add(-UDP_CLIENT_ALIVE-time.Second)), "s3cret", false},
+		{"early", maintainFrame("home", "s3cret", now.Add(UDP_CLIENT_ALIVE+time.Second)), "s3cret", false},
+		{"short", frame[:20], "s3cret", false},
+	}
+	for _, c := range cases {
+		key, stamp, err := parseMaintainFrame(c.data, c.secret, now)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: error %v", c.name, err)
+		}
+		if c.ok && (key != "home" || stamp != now.UnixNano()) {
+			t.Errorf("%s: got key %q stamp %v", c.name, key, stamp)
+		}
+	}
+}
+
+func Test_maintainClientRoaming(t *testing.T) {
+	home := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000}
+	roamed := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 5000}
+	for _, secret := range []string{"s3cret", ""} {
+		s := &UdpServer{Name: "test", Secret: secret}
+		s.init()
+		now := time.Now()
+		s.maintainClient(maintainFrame("home", secret, now), home)
+		if !s.checkSender("home", home) {
+			t.Fatalf("secret %q: client not registered", secret)
+		}
+		// a replayed frame does not move the client
+		s.maintainClient(maintainFrame("home", secret, now), roamed)
+		if !s.checkSender("home", home) {
+			t.Errorf("secret %q: a replayed frame moved the client", secret)
+		}
+		s.maintainClient(maintainFrame("home", secret, now.Add(time.Second)), roamed)
+		if moved := s.checkSender("home", roamed); moved != (secret != "") {
+			t.Errorf("secret %q: live client moved = %v", secret, moved)
+		}
+		if s.checkSender("home", home) == (secret != "") {
+			t.Errorf("secret %q: old address kept = %v", secret, secret != "")
+		}
+		// a frame signed with another secret is ignored
+		s.maintainClient(maintainFrame("home", "forged", now.Add(2*time.Second)), home)
+		if secret != "" && !s.checkSender("home", roamed) {
+			t.Errorf("secret %q: a forged frame moved the client", secret)
+		}
+	}
+}
+
+// readFrame reads frames from conn until one of type t arrives
+func readFrame(conn *net.UDPConn, t byte, timeout time.Duration) ([]byte, bool) {
+	buf := make([]byte, UDP_BUF_SIZE)
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, false
+		}
+		if frameType, _, data, err := protocol.ParseFrame(buf[:n]); err == nil && frameType == t {
+			return data, true
+		}
+	}
+}
+
+func Test_promptRoamedClient(t *testing.T) {
+	s := newTestUdpServer(t, time.Minute)
+	s.Secret = "s3cret"
+	id, _, _, ok := s.getSession(0, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000})
+	if !ok {
+		t.Fatal("no session")
+	}
+	// the client roamed and sends data for its session from a new address
+	roamed, err := net.DialUDP("udp", nil, s.internalConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer roamed.Close()
+	from := roamed.LocalAddr().(*net.UDPAddr)
+	s.dispatch(from, id, []byte("hello"))
+	if _, ok := readFrame(roamed, protocol.REQUEST_UDP_CLIENT_ADDR, time.Second); !ok {
+		t.Fatal("roamed client not asked for its address")
+	}
+	s.dispatch(from, id, []byte("hello"))
+	if _, ok := readFrame(roamed, protocol.REQUEST_UDP_CLIENT_ADDR, 100*time.Millisecond); ok {
+		t.Error("asked twice within the prompt interval")
+	}
+	s.maintainClient(maintainFrame("client", s.Secret, time.Now()), from)
+	if !s.checkSender("client", from) {
+		t.Error("client not moved by its signed frame")
+	}
+	// without a secret nobody is asked
+	s.Secret = ""
+	other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: from.Port + 1}
+	s.promptClient(other)
+	if len(s.prompted) != 1 {
+		t.Errorf("prompted %v without a secret", s.prompted)
+	}
+}
+
+func Test_udpClientPrompted(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	c := &UdpClient{Name: "test", Key: "home", Secret: "s3cret", LocalAddr: "127.0.0.1:9"}
+	connected := make(chan error, 1)
+	go func() {
+		connected <- c.Connect(server.LocalAddr().String())
+	}()
+	defer func() {
+		_ = c.Close()
+		<-connected
+	}()
+	buf := make([]byte, UDP_BUF_SIZE)
+	_ = server.SetReadDeadline(time.Now().Add(time.Second))
+	n, clientAddr, err := server.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frameType, _, _, _ := protocol.ParseFrame(buf[:n]); frameType != protocol.MAINTAIN_UDP_CLIENT_ADDR {
+		t.Fatalf("first frame of type %v", frameType)
+	}
+	// a prompt right after a maintain frame is not answered, a later one is
+	prompt := protocol.EncodeFrame(protocol.REQUEST_UDP_CLIENT_ADDR, 0, nil)
+	if _, err := server.WriteToUDP(prompt, clientAddr); err != nil {
+		t.Fatal(err)
+	}
+	_ = server.SetReadDeadline(time.Now().Add(UDP_PROMPT_INTERVAL / 2))
+	if _, _, err := server.ReadFromUDP(buf); err == nil {
+		t.Error("answered a prompt right after a maintain frame")
+	}
+	time.Sleep(UDP_PROMPT_INTERVAL / 2)
+	if _, err := server.WriteToUDP(prompt, clientAddr); err != nil {
+		t.Fatal(err)
+	}
+	_ = server.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err = server.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("no maintain frame after the prompt : %v", err)
+	}
+	frameType, _, data, _ := protocol.ParseFrame(buf[:n])
+	if key, _, err := parseMaintainFrame(data, "s3cret", time.Now()); frameType != protocol.MAINTAIN_UDP_CLIENT_ADDR || err != nil || key != "home" {
+		t.Errorf("answered with a frame of type %v for %q : %v", frameType, key, err)
+	}
+}
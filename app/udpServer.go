@@ -1,117 +1,409 @@
 package app
 
 import (
+	"context"
+	"errors"
 	"ezturp/protocol"
 	"ezturp/tools"
+	"io"
 	"math/rand"
 	"net"
+	"strconv"
 	"sync"
+	"time"
+)
+
+const (
+	UDP_SERVER_IDLE = UDP_CLIENT_IDLE
 )
 
 type UdpServer struct {
-	Name            string
-	logger          tools.Logger
-	clientAddr      *net.UDPAddr
-	clientAddrMutex sync.Mutex
-	internalConn    *net.UDPConn
-	externalConn    *net.UDPConn
+	Name          string
+	Metrics       *Metrics
+	Limiter       *Limiter
+	Mtu           int
+	Idle          time.Duration
+	Balance       string
+	ClientKeys    []string
+	Secret        string
+	logger        tools.Logger
+	internalConn  *net.UDPConn
+	externalConns []net.PacketConn
+	ranged        bool
+
+	clientMutex   sync.Mutex
+	clients       map[string]*udpPeer
+	addrClientMap map[string]string
+	prompted      map[string]time.Time
+	clientOrder   uint64
+	roundRobin    uint64
+
+	addrSessionMap    map[string]uint32
+	sessionAddrMap    map[uint32]net.Addr
+	sessionConnMap    map[uint32]int
+	sessionClientMap  map[uint32]string
+	sessionTimeoutMap map[uint32]*time.Timer
+	sessionActiveMap  map[uint32]time.Time
+	sessionStatMap    map[uint32]*sessionStat
+	nextSessionId     uint32
+	sessionMutex      sync.Mutex
+
+	fragId      uint32
+	reassembler protocol.Reassembler
 
-	addrSessionMap map[string]uint32
-	sessionAddrMap map[uint32]string
-	sessionMutex   sync.Mutex
+	draining   bool
+	closeMutex sync.Mutex
+	done       chan struct{}
+	routines   routines
 }
 
 func (s *UdpServer) init() {
+	s.sessionMutex.Lock()
 	s.addrSessionMap = make(map[string]uint32)
-	s.sessionAddrMap = make(map[uint32]string)
-	s.logger = tools.Logger{"UdpServer", s.Name}
+	s.sessionAddrMap = make(map[uint32]net.Addr)
+	s.sessionConnMap = make(map[uint32]int)
+	s.sessionClientMap = make(map[uint32]string)
+	s.sessionTimeoutMap = make(map[uint32]*time.Timer)
+	s.sessionActiveMap = make(map[uint32]time.Time)
+	s.sessionStatMap = make(map[uint32]*sessionStat)
+	s.nextSessionId = rand.Uint32()
+	s.sessionMutex.Unlock()
+	s.clientMutex.Lock()
+	s.clients = make(map[string]*udpPeer)
+	s.addrClientMap = make(map[string]string)
+	s.prompted = make(map[string]time.Time)
+	s.clientMutex.Unlock()
+	if s.Idle <= 0 {
+		s.Idle = UDP_SERVER_IDLE
+	}
+	s.logger = tools.Logger{Service: "UdpServer", Name: s.Name}
+	if s.Metrics == nil {
+		s.Metrics = newMetrics(s.Name, UDP)
+	}
 }
 
 func (s *UdpServer) Listen(internalAddr, externalAddr string) error {
-	s.init()
+	s.logger = tools.Logger{Service: "UdpServer", Name: s.Name}
 	internalUdpAddr, err := net.ResolveUDPAddr("udp", internalAddr)
 	if err != nil {
 		return err
 	}
-	externalUdpAddr, err := net.ResolveUDPAddr("udp", externalAddr)
+	internalConn, err := s.listenInternal(internalUdpAddr)
 	if err != nil {
 		return err
 	}
-	err = s.listenInternal(internalUdpAddr)
+	externalConn, err := s.listenExternal(externalAddr)
+	if err != nil {
+		_ = internalConn.Close()
+		return err
+	}
+	return s.Serve(internalConn, externalConn)
+}
+
+// ListenContext is Listen that stops when ctx is cancelled
+func (s *UdpServer) ListenContext(ctx context.Context, internalAddr, externalAddr string) error {
+	return runContext(ctx, s, func() error {
+		return s.Listen(internalAddr, externalAddr)
+	})
+}
+
+// Shutdown stops creating sessions and waits for the running ones to end
+// before closing the server. UDP sessions only end by going idle, so ctx
+// should carry a deadline; when it is done the remaining sessions are dropped
+// and the error of ctx is returned.
+func (s *UdpServer) Shutdown(ctx context.Context) error {
+	return shutdown(ctx, s, &s.routines, s.drain, s.sessionCount)
+}
+
+func (s *UdpServer) drain() {
+	s.sessionMutex.Lock()
+	defer s.sessionMutex.Unlock()
+	s.draining = true
+}
+
+func (s *UdpServer) sessionCount() int {
+	s.sessionMutex.Lock()
+	defer s.sessionMutex.Unlock()
+	return len(s.sessionAddrMap)
+}
+
+// Sessions lists the external addresses that have a session
+func (s *UdpServer) Sessions() []SessionInfo {
+	s.sessionMutex.Lock()
+	defer s.sessionMutex.Unlock()
+	sessions := make([]SessionInfo, 0, len(s.sessionAddrMap))
+	for id, addr := range s.sessionAddrMap {
+		sessions = append(sessions, s.sessionStatMap[id].info(s.Name, UDP, id, addr))
+	}
+	return sessions
+}
+
+// KillSession forgets session id and tells its client to close the local socket
+func (s *UdpServer) KillSession(id uint32) bool {
+	return s.removeSession(id, true, CLOSE_KILLED)
+}
+
+// ListenPorts serves every port of ports on externalHost over a single internal
+// socket. The client learns the external port of each session.
+func (s *UdpServer) ListenPorts(internalAddr, externalHost string, ports PortRanges) error {
+	s.logger = tools.Logger{Service: "UdpServer", Name: s.Name}
+	internalUdpAddr, err := net.ResolveUDPAddr("udp", internalAddr)
 	if err != nil {
 		return err
 	}
-	go s.handleInternalMsg()
-	err = s.listenExternal(externalUdpAddr)
-	s.recvExternalMsg()
+	internalConn, err := s.listenInternal(internalUdpAddr)
+	if err != nil {
+		return err
+	}
+	conns, err := listenPorts(externalHost, ports, func(addr string) (io.Closer, error) {
+		return s.listenExternal(addr)
+	})
+	if err != nil {
+		_ = internalConn.Close()
+		return err
+	}
+	externalConns := make([]net.PacketConn, 0, len(conns))
+	for _, conn := range conns {
+		externalConns = append(externalConns, conn.(net.PacketConn))
+	}
+	return s.ServePorts(internalConn, externalConns)
+}
+
+// Serve runs the server on sockets that are already open, it returns after Close.
+// Both sockets are closed when Serve returns.
+func (s *UdpServer) Serve(internalConn *net.UDPConn, externalConn net.PacketConn) error {
+	return s.serve(internalConn, []net.PacketConn{externalConn}, false)
+}
+
+// ServePorts is Serve for a port-range tunnel, externalConns are listed in the
+// order of the client's local port range
+func (s *UdpServer) ServePorts(internalConn *net.UDPConn, externalConns []net.PacketConn) error {
+	return s.serve(internalConn, externalConns, true)
+}
+
+func (s *UdpServer) serve(internalConn *net.UDPConn, externalConns []net.PacketConn, ranged bool) error {
+	s.init()
+	s.ranged = ranged
+	s.closeMutex.Lock()
+	s.internalConn = internalConn
+	s.externalConns = externalConns
+	s.closeMutex.Unlock()
+	if s.closed() {
+		_ = internalConn.Close()
+		for _, conn := range externalConns {
+			_ = conn.Close()
+		}
+		return errors.New("server closed")
+	}
+	if s.Secret == "" {
+		s.logger.Info("no secret is set, a live udp client cannot move to a new address")
+	}
+	// the server stops as soon as one of its sockets fails
+	s.routines.start(func() {
+		s.handleInternalMsg()
+		_ = s.Close()
+	})
+	for i := range externalConns {
+		i := i
+		s.routines.start(func() {
+			s.recvExternalMsg(i)
+			_ = s.Close()
+		})
+	}
+	<-s.doneChan()
+	return s.routines.wait(context.Background())
+}
+
+func (s *UdpServer) doneChan() chan struct{} {
+	s.closeMutex.Lock()
+	defer s.closeMutex.Unlock()
+	if s.done == nil {
+		s.done = make(chan struct{})
+	}
+	return s.done
+}
+
+func (s *UdpServer) closed() bool {
+	select {
+	case <-s.doneChan():
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops the server, closing both sockets and forgetting every session
+func (s *UdpServer) Close() error {
+	done := s.doneChan()
+	s.closeMutex.Lock()
+	select {
+	case <-done:
+		s.closeMutex.Unlock()
+		return nil
+	default:
+	}
+	close(done)
+	if s.internalConn != nil {
+		_ = s.internalConn.Close()
+	}
+	for _, conn := range s.externalConns {
+		_ = conn.Close()
+	}
+	s.closeMutex.Unlock()
+
+	s.sessionMutex.Lock()
+	for id, tm := range s.sessionTimeoutMap {
+		tm.Stop()
+		delete(s.sessionTimeoutMap, id)
+	}
+	for id, stat := range s.sessionStatMap {
+		stat.end(&s.logger, id, CLOSE_STOPPED)
+	}
+	s.sessionMutex.Unlock()
+	s.Metrics.linkDown()
 	return nil
 }
 
-func (s *UdpServer) handleExternalMsg(data []byte, addr *net.UDPAddr) {
+func (s *UdpServer) handleExternalMsg(index int, data []byte, addr net.Addr) {
+	if !replyable(addr) {
+		s.logger.Debug("dropped %v bytes from an unbound unix socket", len(data))
+		s.Metrics.add(&s.Metrics.Dropped, 1)
+		return
+	}
 	addrStr := addr.String()
-	id := s.getSessionId(addrStr)
-	frame := protocol.EncodeFrame(protocol.DATA, id, data)
-	s.clientAddrMutex.Lock()
-	_, err := s.internalConn.WriteToUDP(frame, s.clientAddr)
+	id, key, stat, ok := s.getSession(index, addr)
+	if !ok {
+		s.logger.Debug("no session available, dropped %v bytes from %v", len(data), addrStr)
+		s.Metrics.add(&s.Metrics.Dropped, 1)
+		return
+	}
+	if !stat.limit.allow(DOWNLOAD, len(data)) {
+		if s.logger.Enabled(tools.DEBUG) {
+			s.logger.Session(id, addr).Debug("over its limit, dropped %v bytes from %v", len(data), addrStr)
+		}
+		s.Metrics.add(&s.Metrics.Dropped, 1)
+		return
+	}
+	stat.addIn(len(data))
+	t := byte(protocol.DATA)
+	if s.ranged {
+		// every datagram names its port, the client may see a session first on any of them
+		t = protocol.PORT_DATA
+		data = append(encodeSessionPort(portOf(s.externalConns[index].LocalAddr()), index), data...)
+	}
+	err := s.internalWriteFrame(s.clientAddr(key), t, id, data)
 	if err != nil {
 		s.logger.Warn("failed to send internal message : %v", err)
+		s.Metrics.add(&s.Metrics.Dropped, 1)
+		return
+	}
+	if s.logger.Enabled(tools.DEBUG) {
+		s.logger.Session(id, addr).Debug("<- %v bytes", len(data))
+	}
+}
+
+func (s *UdpServer) internalWriteFrame(clientAddr *net.UDPAddr, t byte, id uint32, data []byte) error {
+	if clientAddr == nil {
+		return errors.New("no udp client")
+	}
+	frames, err := encodeUdpFrames(t, id, data, s.Mtu, &s.fragId)
+	if err != nil {
+		return err
 	}
-	s.logger.Debug("session %v <- %v bytes", id, len(data))
-	s.clientAddrMutex.Unlock()
+	for _, frame := range frames {
+		_, err = s.internalConn.WriteToUDP(frame, clientAddr)
+		if err != nil {
+			return err
+		}
+		s.Metrics.add(&s.Metrics.FramesOut, 1)
+	}
+	return nil
 }
 
-func (s *UdpServer) recvExternalMsg() {
-	buf := make([]byte, BUF_SIZE)
+func (s *UdpServer) recvExternalMsg(index int) {
+	buf := make([]byte, UDP_BUF_SIZE)
+	var readErrors readErrors
 	for {
-		n, remoteAddr, err := s.externalConn.ReadFromUDP(buf)
+		n, remoteAddr, err := s.externalConns[index].ReadFrom(buf)
 		if err != nil {
+			if s.closed() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			readErrors.failed(&s.logger, "reading external message", err)
 			continue
 		}
-		s.handleExternalMsg(buf[:n], remoteAddr)
+		readErrors.ok()
+		s.handleExternalMsg(index, buf[:n], remoteAddr)
 	}
 }
 
-func (s *UdpServer) listenExternal(addr *net.UDPAddr) error {
-	externalConn, err := net.ListenUDP("udp", addr)
+func (s *UdpServer) listenExternal(addr string) (net.PacketConn, error) {
+	externalConn, err := listenPacket(addr)
 	if err != nil {
 		//log.Printf("udp server failed to listen external connection at %v:%v", *addr, err)
-		s.logger.Error("failed to listen external connection at %v:%v", *addr, err)
-		return err
+		s.logger.Error("failed to listen external connection at %v:%v", addr, err)
+		return nil, err
 	}
 	//log.Printf("udp server listening external connection at %v", *addr)
-	s.logger.Info("listening external connection at %v", *addr)
-	s.externalConn = externalConn
-	return nil
+	s.logger.Info("listening external connection at %v", externalConn.LocalAddr())
+	return externalConn, nil
 }
 
-func (s *UdpServer) listenInternal(addr *net.UDPAddr) error {
+func (s *UdpServer) listenInternal(addr *net.UDPAddr) (*net.UDPConn, error) {
 	internalConn, err := net.ListenUDP("udp", addr)
 	if err != nil {
 		//log.Printf("udp server failed to listen internal connection at %v:%v", *addr, err)
 		s.logger.Error("failed to listen internal connection at %v:%v", *addr, err)
-		return err
+		return nil, err
 	}
 	//log.Printf("udp server listening internal connection at %v", *addr)
 	s.logger.Info("listening internal connection at %v", *addr)
-	s.internalConn = internalConn
-	return nil
+	return internalConn, nil
 }
 
 func (s *UdpServer) handleInternalMsg() {
-	buf := make([]byte, BUF_SIZE)
+	buf := make([]byte, UDP_BUF_SIZE)
+	var readErrors readErrors
 	for {
 		n, clientAddr, err := s.internalConn.ReadFromUDP(buf)
+		if err != nil {
+			if s.closed() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			readErrors.failed(&s.logger, "reading internal message", err)
+			continue
+		}
+		readErrors.ok()
 		t, id, data, err := protocol.ParseFrame(buf[:n])
 		if err != nil {
 			//log.Printf("error in handling internal message : %v", err)
 			s.logger.Warn("handling internal message : %v", err)
 			continue
 		}
+		s.Metrics.add(&s.Metrics.FramesIn, 1)
+		if t == protocol.DATA_FRAGMENT {
+			var ok bool
+			t, data, ok, err = s.reassembler.Add(clientAddr.String(), id, data)
+			if err != nil {
+				s.logger.Warn("handling internal fragment : %v", err)
+				s.Metrics.add(&s.Metrics.Dropped, 1)
+				continue
+			}
+			if !ok {
+				continue
+			}
+		}
 		switch t {
 		case protocol.MAINTAIN_UDP_CLIENT_ADDR:
-			s.setClientAddr(clientAddr)
+			s.maintainClient(data, clientAddr)
+		case protocol.HEALTH_STATUS:
+			s.setClientHealth(data, clientAddr)
 		case protocol.DATA:
-			s.dispatch(id, data)
+			s.dispatch(clientAddr, id, data)
+		case protocol.REMOVE_SESSION:
+			if key, ok := s.sessionClient(id); ok && s.checkSender(key, clientAddr) {
+				s.removeSession(id, false, CLOSE_REMOTE)
+			}
 		default:
 			s.logger.Warn("unknown message type %v", t)
 		}
@@ -120,54 +412,194 @@ func (s *UdpServer) handleInternalMsg() {
 
 }
 
-func (s *UdpServer) setClientAddr(addr *net.UDPAddr) {
-	s.clientAddrMutex.Lock()
-	s.clientAddr = addr
-	s.logger.Info("set internal address : %v", addr.String())
-	s.clientAddrMutex.Unlock()
+// sessionKey identifies the session of addr on the external socket index
+func sessionKey(index int, addr net.Addr) string {
+	return strconv.Itoa(index) + " " + addr.String()
 }
 
-func (s *UdpServer) getSessionId(addrStr string) uint32 {
+func (s *UdpServer) getSession(index int, addr net.Addr) (uint32, string, *sessionStat, bool) {
+	addrStr := sessionKey(index, addr)
 	s.sessionMutex.Lock()
 	defer s.sessionMutex.Unlock()
 	id, ok := s.addrSessionMap[addrStr]
 	if ok {
-		return id
+		s.sessionActiveMap[id] = time.Now()
+		key := s.sessionClientMap[id]
+		if s.clientAlive(key) {
+			return id, key, s.sessionStatMap[id], true
+		}
+		// the owner is gone, another client takes the session over and
+		// creates its local socket on the first DATA frame
+		newKey, ok := s.pickClient()
+		if !ok {
+			return 0, "", nil, false
+		}
+		s.sessionClientMap[id] = newKey
+		s.logger.Session(id, nil).Info("moved from udp client %q to %q", key, newKey)
+		return id, newKey, s.sessionStatMap[id], true
+	}
+	if s.draining {
+		return 0, "", nil, false
+	}
+	limit, ok := s.Limiter.open(ipOf(addr))
+	if !ok {
+		return 0, "", nil, false
+	}
+	key, ok := s.pickClient()
+	if !ok {
+		limit.close()
+		return 0, "", nil, false
 	}
+	// ids are handed out sequentially so that an id is not reused while the
+	// client may still hold a socket for an earlier session with the same id
 	var newId uint32
 	for {
-		newId = rand.Uint32()
+		newId = s.nextSessionId
+		s.nextSessionId++
 		if _, ok := s.sessionAddrMap[newId]; !ok {
 			break
 		}
 	}
-	s.sessionAddrMap[newId] = addrStr
+	s.sessionAddrMap[newId] = addr
+	s.sessionConnMap[newId] = index
 	s.addrSessionMap[addrStr] = newId
-	s.logger.Debug("created a new session %v , address :%s", newId, addrStr)
-	return newId
+	s.sessionClientMap[newId] = key
+	s.sessionStatMap[newId] = newSessionStat(s.Metrics, addr.String(), "")
+	s.sessionStatMap[newId].limit = limit
+	s.Metrics.add(&s.Metrics.SessionsOpened, 1)
+	s.sessionActiveMap[newId] = time.Now()
+	s.sessionTimeoutMap[newId] = time.AfterFunc(s.Idle, func() {
+		s.expireSession(newId)
+	})
+	s.logger.Session(newId, addr).Debug("created , address :%s , client %q", addrStr, key)
+	return newId, key, s.sessionStatMap[newId], true
+}
+
+func (s *UdpServer) sessionClient(id uint32) (key string, ok bool) {
+	s.sessionMutex.Lock()
+	defer s.sessionMutex.Unlock()
+	key, ok = s.sessionClientMap[id]
+	return
+}
+
+func (s *UdpServer) removeSession(id uint32, notify bool, reason string) bool {
+	s.sessionMutex.Lock()
+	key, ok := s.forgetSession(id, reason)
+	s.sessionMutex.Unlock()
+	if ok && notify {
+		s.notifyRemoved(id, key)
+	}
+	return ok
+}
+
+// expireSession removes session id when it was idle for s.Idle. A packet may
+// have refreshed the session while the timer fired, then the timer is set
+// again for the rest of the idle time.
+func (s *UdpServer) expireSession(id uint32) {
+	s.sessionMutex.Lock()
+	tm, ok := s.sessionTimeoutMap[id]
+	if !ok {
+		// removed or the server closed
+		s.sessionMutex.Unlock()
+		return
+	}
+	if idle := time.Since(s.sessionActiveMap[id]); idle < s.Idle {
+		tm.Reset(s.Idle - idle)
+		s.sessionMutex.Unlock()
+		return
+	}
+	addr := s.sessionAddrMap[id]
+	key, _ := s.forgetSession(id, CLOSE_IDLE)
+	s.sessionMutex.Unlock()
+	s.logger.Session(id, addr).Info("idle, removed")
+	s.notifyRemoved(id, key)
 }
 
-func (s *UdpServer) dispatch(id uint32, data []byte) {
-	addr, ok := s.getAddr(id)
+// forgetSession drops every record of session id and returns its client,
+// the caller must hold sessionMutex
+func (s *UdpServer) forgetSession(id uint32, reason string) (string, bool) {
+	addr, ok := s.sessionAddrMap[id]
+	if !ok {
+		return "", false
+	}
+	key := s.sessionClientMap[id]
+	delete(s.addrSessionMap, sessionKey(s.sessionConnMap[id], addr))
+	delete(s.sessionAddrMap, id)
+	delete(s.sessionConnMap, id)
+	delete(s.sessionClientMap, id)
+	s.sessionStatMap[id].end(&s.logger, id, reason)
+	delete(s.sessionStatMap, id)
+	s.sessionTimeoutMap[id].Stop()
+	delete(s.sessionTimeoutMap, id)
+	delete(s.sessionActiveMap, id)
+	s.logger.Session(id, addr).Debug("address %v removed", addr)
+	return key, true
+}
+
+// notifyRemoved tells the client of a removed session to close its local socket
+func (s *UdpServer) notifyRemoved(id uint32, key string) {
+	err := s.internalWriteFrame(s.clientAddr(key), protocol.REMOVE_SESSION, id, []byte{})
+	if err != nil {
+		s.logger.Session(id, nil).Warn("failed to notify client to remove the session : %v", err)
+	}
+}
+
+func (s *UdpServer) dispatch(clientAddr *net.UDPAddr, id uint32, data []byte) {
+	key, ok := s.sessionClient(id)
+	if ok && !s.checkSender(key, clientAddr) {
+		if s.logger.Enabled(tools.DEBUG) {
+			s.logger.Session(id, clientAddr).Debug("dropped %v bytes from %v, which is not the client of the session", len(data), clientAddr)
+		}
+		s.Metrics.add(&s.Metrics.Dropped, 1)
+		// the client may have roamed, it signs its new address when asked
+		s.promptClient(clientAddr)
+		return
+	}
+	var addr net.Addr
+	var index int
+	var stat *sessionStat
+	if ok {
+		addr, index, stat, ok = s.getAddr(id)
+	}
 	if !ok {
 		//log.Printf("in udp server, unkonwn session id %v", id)
-		s.logger.Warn("unknown session id %v", id)
+		s.logger.Session(id, clientAddr).Warn("unknown session from %v", clientAddr)
+		s.Metrics.add(&s.Metrics.Dropped, 1)
+		if s.knownSender(clientAddr) {
+			_ = s.internalWriteFrame(clientAddr, protocol.REMOVE_SESSION, id, []byte{})
+		} else {
+			s.promptClient(clientAddr)
+		}
+		return
 	}
-	_, err := s.externalConn.WriteToUDP(data, addr)
+	if !stat.limit.allow(UPLOAD, len(data)) {
+		if s.logger.Enabled(tools.DEBUG) {
+			s.logger.Session(id, addr).Debug("over its limit, dropped %v bytes to %v", len(data), addr)
+		}
+		s.Metrics.add(&s.Metrics.Dropped, 1)
+		return
+	}
+	n, err := s.externalConns[index].WriteTo(data, addr)
+	stat.addOut(n)
 	if err != nil {
+		s.Metrics.add(&s.Metrics.Dropped, 1)
 		//log.Printf("udp server %v", err)
 		s.logger.Warn("%v", err)
 	}
-	s.logger.Debug("session %v : %v bytes -> %v", id, len(data), *addr)
+	if s.logger.Enabled(tools.DEBUG) {
+		s.logger.Session(id, addr).Debug("%v bytes -> %v", len(data), addr)
+	}
 }
 
-func (s *UdpServer) getAddr(id uint32) (addr *net.UDPAddr, ok bool) {
+func (s *UdpServer) getAddr(id uint32) (addr net.Addr, index int, stat *sessionStat, ok bool) {
 	s.sessionMutex.Lock()
 	defer s.sessionMutex.Unlock()
-	addrStr, ok := s.sessionAddrMap[id]
+	addr, ok = s.sessionAddrMap[id]
 	if !ok {
 		return
 	}
-	addr, _ = net.ResolveUDPAddr("udp", addrStr)
+	index = s.sessionConnMap[id]
+	stat = s.sessionStatMap[id]
+	s.sessionActiveMap[id] = time.Now()
 	return
 }
@@ -0,0 +1,129 @@
+package app
+
+import (
+	"context"
+	"ezturp/protocol"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestUdpServer is a server with only an internal socket and one live client
+func newTestUdpServer(t *testing.T, idle time.Duration) *UdpServer {
+	s := &UdpServer{Name: "test", Idle: idle}
+	s.init()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	s.internalConn = conn
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000}
+	s.clients["client"] = &udpPeer{key: "client", addr: addr, lastSeen: time.Now()}
+	s.addrClientMap[addr.String()] = "client"
+	return s
+}
+
+func Test_udpSessionIdle(t *testing.T) {
+	s := newTestUdpServer(t, 50*time.Millisecond)
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}
+	id, _, _, ok := s.getSession(0, addr)
+	if !ok {
+		t.Fatal("no session")
+	}
+	// the timer fires while a packet holds the lock and refreshes the session
+	s.sessionMutex.Lock()
+	time.Sleep(80 * time.Millisecond)
+	s.sessionActiveMap[id] = time.Now()
+	s.sessionMutex.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	if s.sessionCount() != 1 {
+		t.Fatal("refreshed session removed")
+	}
+	if again, _, _, _ := s.getSession(0, addr); again != id {
+		t.Errorf("session %v replaced by %v", id, again)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if s.sessionCount() != 0 {
+		t.Error("idle session kept")
+	}
+}
+
+// serveUdpServer runs a server on local sockets with a registered client and
+// returns the address of its external socket
+func serveUdpServer(t *testing.T, s *UdpServer) (net.Addr, chan error) {
+	internalConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	externalConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(internalConn, externalConn)
+	}()
+	client, err := net.DialUDP("udp", nil, internalConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	var fragId uint32
+	frames, _ := encodeUdpFrames(protocol.MAINTAIN_UDP_CLIENT_ADDR, 0, maintainFrame("client", s.Secret, time.Now()), 0, &fragId)
+	for deadline := time.Now().Add(time.Second); s.clientAddr("client") == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("client not registered")
+		}
+		_, _ = client.Write(frames[0])
+	}
+	return externalConn.LocalAddr(), served
+}
+
+func Test_udpServerShutdown(t *testing.T) {
+	cases := []struct {
+		name  string
+		idle  time.Duration
+		err   error
+		ended bool // the session went idle before the deadline
+	}{
+		{"sessions end", 100 * time.Millisecond, nil, true},
+		{"deadline", time.Minute, context.DeadlineExceeded, false},
+	}
+	for _, c := range cases {
+		s := &UdpServer{Name: "test", Idle: c.idle}
+		external, served := serveUdpServer(t, s)
+		peer, err := net.Dial("udp", external.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = peer.Write([]byte("hello"))
+		for deadline := time.Now().Add(time.Second); s.sessionCount() == 0; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: no session", c.name)
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		// a draining server opens no new session
+		s.drain()
+		if _, _, _, ok := s.getSession(0, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5000}); ok {
+			t.Errorf("%s: session opened while draining", c.name)
+		}
+		if err := s.Shutdown(ctx); err != c.err {
+			t.Errorf("%s: shutdown returned %v, want %v", c.name, err, c.err)
+		}
+		cancel()
+		if !s.closed() {
+			t.Errorf("%s: server still open", c.name)
+		}
+		select {
+		case <-served:
+		case <-time.After(time.Second):
+			t.Fatalf("%s: Serve did not return", c.name)
+		}
+		if ended := s.Metrics.SessionsOpened == 1 && s.sessionCount() == 0; c.ended && !ended {
+			t.Errorf("%s: session still open", c.name)
+		}
+		_ = peer.Close()
+	}
+}
@@ -0,0 +1,307 @@
+package app
+
+import (
+	"crypto/tls"
+	"errors"
+	"ezturp/tools"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HTTP = "http"
+	TLS  = "tls"
+
+	SNIFF_TIMEOUT = 10 * time.Second
+)
+
+// routeOptions are per host settings of a vhostRouter route
+type routeOptions struct {
+	xForwarded bool
+	fallback   bool
+	auth       *httpAuth
+}
+
+// vhostRouter accepts connections on one shared external address and hands
+// each of them to the listener registered for the host name it asks for.
+type vhostRouter struct {
+	Name     string
+	Protocol string
+	logger   tools.Logger
+
+	mutex    sync.Mutex
+	routes   map[string]*vhostListener
+	fallback *vhostListener
+	listener net.Listener
+	certs    map[string]*certStore
+}
+
+func newVhostRouter(protocol, address string) *vhostRouter {
+	return &vhostRouter{
+		Name:     address,
+		Protocol: protocol,
+		logger:   tools.Logger{Service: "VhostRouter", Name: protocol + " " + address},
+		routes:   make(map[string]*vhostListener),
+		certs:    make(map[string]*certStore),
+	}
+}
+
+func (r *vhostRouter) Listen(address string) error {
+	listener, err := listenStream(address)
+	if err != nil {
+		return err
+	}
+	return r.Serve(listener)
+}
+
+// Serve routes the connections of listener, it is closed when Serve returns
+func (r *vhostRouter) Serve(listener net.Listener) error {
+	r.mutex.Lock()
+	r.listener = listener
+	r.mutex.Unlock()
+	defer listener.Close()
+	r.logger.Info("listen external connection %v", listener.Addr())
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go r.route(conn)
+	}
+}
+
+// Close stops the shared listener, registered routes stay in place
+func (r *vhostRouter) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.listener != nil {
+		return r.listener.Close()
+	}
+	return nil
+}
+
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// listen registers host, which may be a wildcard such as "*.example.com", and
+// returns the listener that receives its connections. A fallback route also
+// receives every connection whose host matches no other route.
+func (r *vhostRouter) listen(host string, options routeOptions) (net.Listener, error) {
+	host = normalizeHost(host)
+	if host == "" && !options.fallback {
+		return nil, errors.New("empty host name")
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.routes[host]; ok && host != "" {
+		return nil, fmt.Errorf("host %v is already routed on %v", host, r.Name)
+	}
+	if options.fallback && r.fallback != nil {
+		return nil, fmt.Errorf("%v already has a default route", r.Name)
+	}
+	l := &vhostListener{
+		router:  r,
+		host:    host,
+		options: options,
+		conns:   make(chan net.Conn),
+		done:    make(chan struct{}),
+	}
+	if host != "" {
+		r.routes[host] = l
+	}
+	if options.fallback {
+		r.fallback = l
+	}
+	return l, nil
+}
+
+// setCertificate makes the router terminate TLS, choosing the certificate by
+// the server name of each connection
+func (r *vhostRouter) setCertificate(host string, store *certStore) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.certs[normalizeHost(host)] = store
+}
+
+// removeCertificate stops terminating TLS for host, unless another store was
+// set for it in the meantime
+func (r *vhostRouter) removeCertificate(host string, store *certStore) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	host = normalizeHost(host)
+	if r.certs[host] == store {
+		delete(r.certs, host)
+	}
+}
+
+func (r *vhostRouter) terminatesTls() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.certs) > 0
+}
+
+func (r *vhostRouter) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := normalizeHost(hello.ServerName)
+	r.mutex.Lock()
+	store, ok := r.certs[host]
+	if i := strings.IndexByte(host, '.'); !ok && i >= 0 {
+		store, ok = r.certs["*"+host[i:]]
+	}
+	if !ok {
+		// fall back to the certificate of the smallest host name so the choice is stable
+		var first string
+		for h, s := range r.certs {
+			if store == nil || h < first {
+				first, store = h, s
+			}
+		}
+	}
+	r.mutex.Unlock()
+	if store == nil {
+		return nil, errors.New("no certificate")
+	}
+	return store.GetCertificate(hello)
+}
+
+func (r *vhostRouter) find(host string) *vhostListener {
+	host = normalizeHost(host)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if l, ok := r.routes[host]; ok {
+		return l
+	}
+	if i := strings.IndexByte(host, '.'); i >= 0 {
+		if l, ok := r.routes["*"+host[i:]]; ok {
+			return l
+		}
+	}
+	return r.fallback
+}
+
+func (r *vhostRouter) remove(l *vhostListener) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.routes[l.host] == l {
+		delete(r.routes, l.host)
+	}
+	if r.fallback == l {
+		r.fallback = nil
+	}
+}
+
+func (r *vhostRouter) route(conn net.Conn) {
+	if r.Protocol == TLS {
+		r.routeTls(conn)
+	} else {
+		r.routeHttp(conn)
+	}
+}
+
+func (r *vhostRouter) routeTls(conn net.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(SNIFF_TIMEOUT))
+	pc, serverName, err := sniffTls(conn)
+	if err != nil {
+		r.logger.Debug("%v sent a bad client hello : %v", conn.RemoteAddr(), err)
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	l := r.find(serverName)
+	if l == nil || !l.deliver(pc) {
+		r.logger.Debug("%v asked for unknown server name %q", conn.RemoteAddr(), serverName)
+		_ = conn.Close()
+	}
+}
+
+func (r *vhostRouter) routeHttp(conn net.Conn) {
+	proto := "http"
+	if r.terminatesTls() {
+		conn = tls.Server(conn, &tls.Config{GetCertificate: r.getCertificate})
+		proto = "https"
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(SNIFF_TIMEOUT))
+	hc, req, err := sniffHttp(conn)
+	if err != nil {
+		r.logger.Debug("%v sent a bad request : %v", conn.RemoteAddr(), err)
+		writeHttpError(conn, 400, nil)
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	l := r.find(req.Host)
+	if l == nil {
+		r.logger.Debug("%v asked for unknown host %q", conn.RemoteAddr(), req.Host)
+		writeHttpError(conn, 404, nil)
+		_ = conn.Close()
+		return
+	}
+	if l.options.auth != nil && !l.options.auth.allow(req) {
+		r.logger.Debug("%v failed to authenticate for %q", conn.RemoteAddr(), req.Host)
+		writeHttpError(conn, 401, l.options.auth.challenge())
+		_ = conn.Close()
+		return
+	}
+	if l.options.xForwarded || l.options.auth != nil {
+		hc.filter(conn.RemoteAddr(), proto, l.options)
+	}
+	if !l.deliver(hc) {
+		writeHttpError(conn, 404, nil)
+		_ = conn.Close()
+	}
+}
+
+type vhostAddr string
+
+func (a vhostAddr) Network() string { return TCP }
+func (a vhostAddr) String() string  { return string(a) }
+
+// vhostListener is the net.Listener of a single host of a vhostRouter
+type vhostListener struct {
+	router    *vhostRouter
+	host      string
+	options   routeOptions
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *vhostListener) deliver(conn net.Conn) bool {
+	select {
+	case l.conns <- conn:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+func (l *vhostListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *vhostListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.router.remove(l)
+	})
+	return nil
+}
+
+func (l *vhostListener) Addr() net.Addr {
+	host := l.host
+	if host == "" {
+		host = "default"
+	}
+	return vhostAddr(host + "@" + l.router.Name)
+}
@@ -0,0 +1,100 @@
+package app
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+)
+
+func Test_vhostFind(t *testing.T) {
+	withFallback := newVhostRouter(HTTP, "127.0.0.1:80")
+	withoutFallback := newVhostRouter(TLS, "127.0.0.1:443")
+	for _, route := range []struct {
+		router  *vhostRouter
+		host    string
+		options routeOptions
+	}{
+		{withFallback, "Example.com", routeOptions{}},
+		{withFallback, "*.example.org", routeOptions{}},
+		{withFallback, "api.example.org", routeOptions{}},
+		{withFallback, "", routeOptions{fallback: true}},
+		{withoutFallback, "example.com:443", routeOptions{}},
+		{withoutFallback, "*.example.org", routeOptions{}},
+	} {
+		if _, err := route.router.listen(route.host, route.options); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cases := []struct {
+		router *vhostRouter
+		host   string
+		route  string
+	}{
+		{withFallback, "example.com", "example.com"},
+		{withFallback, "EXAMPLE.com.", "example.com"},
+		{withFallback, "example.com:8080", "example.com"},
+		{withFallback, "api.example.org", "api.example.org"},
+		{withFallback, "web.example.org", "*.example.org"},
+		{withFallback, "a.web.example.org", ""},
+		{withFallback, "example.org", ""},
+		{withFallback, "", ""},
+		{withoutFallback, "example.com", "example.com"},
+		{withoutFallback, "web.example.org", "*.example.org"},
+		{withoutFallback, "example.net", "none"},
+		{withoutFallback, "", "none"},
+	}
+	for _, c := range cases {
+		l := c.router.find(c.host)
+		switch {
+		case l == nil && c.route != "none":
+			t.Errorf("%s %q: no route, want %q", c.router.Protocol, c.host, c.route)
+		case l != nil && l.host != c.route:
+			t.Errorf("%s %q: routed to %q, want %q", c.router.Protocol, c.host, l.host, c.route)
+		}
+	}
+}
+
+func Test_vhostListenConflicts(t *testing.T) {
+	r := newVhostRouter(HTTP, "127.0.0.1:80")
+	cases := []struct {
+		host    string
+		options routeOptions
+		ok      bool
+	}{
+		{"example.com", routeOptions{}, true},
+		{"EXAMPLE.COM", routeOptions{}, false},
+		{"", routeOptions{}, false},
+		{"", routeOptions{fallback: true}, true},
+		{"other.com", routeOptions{fallback: true}, false},
+	}
+	for _, c := range cases {
+		if _, err := r.listen(c.host, c.options); (err == nil) != c.ok {
+			t.Errorf("listen %q fallback %v: error %v", c.host, c.options.fallback, err)
+		}
+	}
+}
+
+func Test_sniffTls(t *testing.T) {
+	for _, serverName := range []string{"web.example.org", ""} {
+		client, server := net.Pipe()
+		go func() {
+			_ = tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+		}()
+		conn, name, err := sniffTls(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != serverName {
+			t.Errorf("got server name %q, want %q", name, serverName)
+		}
+		// the hello is replayed to whoever terminates TLS
+		record := make([]byte, 5)
+		if _, err := io.ReadFull(conn, record); err != nil || !bytes.Equal(record[:1], []byte{0x16}) {
+			t.Errorf("replayed %x, want a handshake record : %v", record, err)
+		}
+		_ = client.Close()
+		_ = server.Close()
+	}
+}
@@ -1,3 +1,5 @@
 module ezturp
 
 go 1.20
+
+require golang.org/x/crypto v0.17.0
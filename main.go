@@ -4,8 +4,13 @@ import (
 	"ezturp/app"
 	"ezturp/tools"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -23,6 +28,21 @@ const (
 	OP_LOCAL_ADDR     = "laddr"
 	OP_NAME           = "n"
 	OP_LOG            = "log"
+	OP_LOG_FORMAT     = "logfmt"
+	OP_LOG_LEVELS     = "levels"
+	OP_LOG_ROTATE     = "logrotate"
+	OP_ADMIN          = "admin"
+	OP_ADMIN_TOKEN    = "admintoken"
+	OP_AUDIT          = "audit"
+	OP_STATE          = "state"
+	OP_QUOTA          = "quota"
+	OP_SOCKET         = "socket"
+
+	CMD_STATUS   = "status"
+	CMD_SESSIONS = "sessions"
+	CMD_KILL     = "kill"
+
+	ADMIN_TOKEN_ENV = "EZTURP_ADMIN_TOKEN"
 )
 
 func main() {
@@ -32,10 +52,25 @@ func main() {
 	//testCS()
 	//testUdpCS()
 	args := tools.ParseCommandArgs(os.Args)
-	if args.ContainsOpt(OP_LOG) {
-		initLogger(args)
+	initLogger(args)
+	if args.ContainsOpt(OP_AUDIT) {
+		if err := app.OpenAuditLog(args.Get0(OP_AUDIT)); err != nil {
+			panic(err)
+		}
+	}
+	if args.ContainsOpt(OP_STATE) {
+		if err := app.OpenQuotaState(args.Get0(OP_STATE)); err != nil {
+			panic(err)
+		}
+	}
+	switch args.GetDefault("", 1, "") {
+	case CMD_STATUS, CMD_SESSIONS, CMD_KILL:
+		runStatusCommand(args)
+		return
 	}
 	switch {
+	case args.ContainsOpt(OP_QUOTA):
+		printQuotas(args)
 	case args.ContainsOpt(OP_TCP_SERVER):
 		launchTcpServer(args)
 	case args.ContainsOpt(OP_UDP_SERVER):
@@ -49,18 +84,35 @@ func main() {
 	case args.ContainsOpt(OP_CLIENT_MANAGER):
 		launchClientManager(args)
 	default:
-		panic(fmt.Errorf("\n%s <-%v | -%v | -%v | -%v> <-%v | -%v | -%v | -%v | -%v> [-%v] [-%v [level] [path]]",
+		panic(fmt.Errorf("\n%s <-%v | -%v | -%v | -%v> <-%v | -%v | -%v | -%v | -%v> [-%v] [-%v [level] [path]] [-%v size=100MB,daily,keep=7,gzip] [-%v text|json] [-%v tunnel:name=level,service:name=level] [-%v address [-%v path]] [-%v path] [-%v path] [-%v path]\n%s -%v path\n%s <%v | %v [tunnel] | %v id [tunnel]> [-%v | -%v] [-%v name] [-%v path]",
 			os.Args[0], OP_TCP_SERVER, OP_UDP_SERVER, OP_TCP_CLIENT, OP_UDP_CLIENT,
 			OP_INTERNAL_ADDR, OP_EXTERNAL_ADDR, OP_LOCAL_ADDR,
 			OP_JSON, OP_CONFIG, OP_NAME,
-			OP_LOG,
+			OP_LOG, OP_LOG_ROTATE, OP_LOG_FORMAT, OP_LOG_LEVELS, OP_ADMIN, OP_ADMIN_TOKEN, OP_AUDIT, OP_STATE, OP_SOCKET,
+			os.Args[0], OP_QUOTA,
+			os.Args[0], CMD_STATUS, CMD_SESSIONS, CMD_KILL, OP_SERVER_MANAGER, OP_CLIENT_MANAGER, OP_NAME, OP_SOCKET,
 		))
 	}
 }
 
 func initLogger(args tools.CommandArgs) {
-	tools.SetLevelStr(args.GetDefault(OP_LOG, 0, ""))
-	tools.SetLogOutput(args.GetDefault(OP_LOG, 1, ""))
+	if args.ContainsOpt(OP_LOG) {
+		tools.SetLevelStr(args.GetDefault(OP_LOG, 0, ""))
+		rotation, err := tools.ParseRotation(args.Get0Default(OP_LOG_ROTATE, ""))
+		if err == nil {
+			err = tools.SetRotatedLogOutput(args.GetDefault(OP_LOG, 1, ""), rotation)
+		}
+		if err != nil {
+			panic(fmt.Errorf("failed set log output file : %v", err))
+		}
+		tools.ReopenLogOnSignal()
+	}
+	tools.SetFormatStr(args.Get0Default(OP_LOG_FORMAT, ""))
+	if args.ContainsOpt(OP_LOG_LEVELS) {
+		if err := tools.SetLevels(args.Get0(OP_LOG_LEVELS)); err != nil {
+			panic(err)
+		}
+	}
 }
 
 func launchClientManager(args tools.CommandArgs) {
@@ -74,11 +126,25 @@ func launchClientManager(args tools.CommandArgs) {
 			panic(err)
 		}
 	}
-	app.StartClientManager(
+	cm := app.StartClientManager(
 		args.Get0Default(OP_NAME, ""),
 		app.LoadClientConfigsFromJson(json),
 	)
-	select {}
+	go closeOnSignal(cm)
+	go launchStatus(args, "client", cm)
+	if args.ContainsOpt(OP_ADMIN) {
+		go launchAdmin(args, cm)
+	}
+	if args.ContainsOpt(OP_JSON) {
+		select {}
+	}
+	app.WatchConfig(args.Get0(OP_CONFIG), func(p []byte) error {
+		configs, err := app.ParseClientConfigs(p)
+		if err != nil {
+			return err
+		}
+		return cm.Reload(configs)
+	})
 }
 
 func launchServerManager(args tools.CommandArgs) {
@@ -92,11 +158,136 @@ func launchServerManager(args tools.CommandArgs) {
 			panic(err)
 		}
 	}
-	app.StartServerManager(
+	cm := app.StartServerManager(
 		args.Get0Default(OP_NAME, ""),
 		app.LoadServerConfigsFromJson(json),
 	)
-	select {}
+	go closeOnSignal(cm)
+	go launchStatus(args, "server", cm)
+	if args.ContainsOpt(OP_ADMIN) {
+		go launchAdmin(args, cm)
+	}
+	if args.ContainsOpt(OP_JSON) {
+		select {}
+	}
+	app.WatchConfig(args.Get0(OP_CONFIG), func(p []byte) error {
+		configs, err := app.ParseServerConfigs(p)
+		if err != nil {
+			return err
+		}
+		return cm.Reload(configs)
+	})
+}
+
+// closeOnSignal stops the manager on SIGINT or SIGTERM, which logs the totals
+// of every tunnel, then exits
+func closeOnSignal(manager io.Closer) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	_ = manager.Close()
+	_ = app.CloseAuditLog()
+	os.Exit(0)
+}
+
+func launchStatus(args tools.CommandArgs, role string, manager app.Manager) {
+	name := args.Get0Default(OP_NAME, "")
+	err := app.ListenStatus(args.Get0Default(OP_SOCKET, app.StatusSocketPath(role, name)), name, manager)
+	if err != nil {
+		tools.Logger{Service: "StatusSocket", Name: name}.Error("%v", err)
+	}
+}
+
+// statusSocketPath is the status socket of the manager picked by -sm or -cm,
+// without either the server manager's when it runs, else the client manager's
+func statusSocketPath(args tools.CommandArgs) string {
+	name := args.Get0Default(OP_NAME, "")
+	switch {
+	case args.ContainsOpt(OP_SERVER_MANAGER):
+		return app.StatusSocketPath("server", name)
+	case args.ContainsOpt(OP_CLIENT_MANAGER):
+		return app.StatusSocketPath("client", name)
+	}
+	path := app.StatusSocketPath("server", name)
+	if _, err := os.Stat(path); err != nil {
+		return app.StatusSocketPath("client", name)
+	}
+	return path
+}
+
+// runStatusCommand asks a running manager over its status socket for its
+// tunnels or sessions, or to kill a session, and prints the answer
+func runStatusCommand(args tools.CommandArgs) {
+	socket := app.StatusSocket{Path: args.Get0Default(OP_SOCKET, statusSocketPath(args))}
+	var err error
+	switch args.GetDefault("", 1, "") {
+	case CMD_STATUS:
+		// a second sample a moment later measures the throughput
+		var first, status app.Status
+		sampled := time.Now()
+		if first, err = socket.Status(); err == nil {
+			time.Sleep(time.Second)
+			if status, err = socket.Status(); err == nil {
+				err = app.WriteStatus(os.Stdout, status, &first, time.Since(sampled))
+			}
+		}
+	case CMD_SESSIONS:
+		var sessions []app.SessionInfo
+		if sessions, err = socket.Sessions(args.GetDefault("", 2, "")); err == nil {
+			err = app.WriteSessions(os.Stdout, sessions)
+		}
+	case CMD_KILL:
+		var id uint64
+		if id, err = strconv.ParseUint(args.GetDefault("", 2, ""), 10, 32); err != nil {
+			err = fmt.Errorf("%s needs a session id", CMD_KILL)
+		} else if err = socket.KillSession(args.GetDefault("", 3, ""), uint32(id)); err == nil {
+			fmt.Printf("session %d killed\n", id)
+		}
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// printQuotas prints the quota usage saved in a state file
+func printQuotas(args tools.CommandArgs) {
+	usage, err := app.ReadQuotaState(args.Get0(OP_QUOTA))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	app.WriteQuotaUsage(os.Stdout, usage)
+}
+
+func launchAdmin(args tools.CommandArgs, manager app.Manager) {
+	logger := tools.Logger{Service: "AdminServer", Name: args.Get0Default(OP_NAME, "")}
+	token, err := adminToken(args)
+	if err != nil {
+		logger.Error("%v", err)
+		return
+	}
+	s := app.AdminServer{Name: args.Get0Default(OP_NAME, ""), Token: token, Manager: manager}
+	err = s.Listen(args.Get0(OP_ADMIN))
+	if err != nil {
+		logger.Error("%v", err)
+	}
+}
+
+// adminToken reads the admin token from the file of -admintoken, or from the
+// environment, so that it does not show in the process list
+func adminToken(args tools.CommandArgs) (string, error) {
+	if args.GetDefault(OP_ADMIN, 1, "") != "" {
+		return "", fmt.Errorf("the admin token is read from $%s or -%s path, not from the command line", ADMIN_TOKEN_ENV, OP_ADMIN_TOKEN)
+	}
+	if args.ContainsOpt(OP_ADMIN_TOKEN) {
+		p, err := os.ReadFile(args.Get0(OP_ADMIN_TOKEN))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(p)), nil
+	}
+	return os.Getenv(ADMIN_TOKEN_ENV), nil
 }
 
 func launchTcpClient(args tools.CommandArgs) {
@@ -0,0 +1,156 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	FRAME_HEADER_SIZE    = 3 + 1 + 4 + 4
+	FRAGMENT_HEADER_SIZE = 4 + 2 + 2 + 1
+	MAX_FRAGMENTS        = 1024
+	MAX_PENDING_PACKETS  = 4096
+	FRAGMENT_TIMEOUT     = 5 * time.Second
+)
+
+/*
+DATA_FRAGMENT payload:
+FRAGMENT_ID INDEX COUNT TYPE CHUNK
+*/
+
+// EncodeFrames encodes a frame and splits it into DATA_FRAGMENT frames
+// when the result would not fit into mtu bytes.
+func EncodeFrames(t byte, id uint32, data []byte, mtu int, fragId uint32) ([][]byte, error) {
+	if mtu <= 0 || FRAME_HEADER_SIZE+len(data) <= mtu {
+		return [][]byte{EncodeFrame(t, id, data)}, nil
+	}
+	chunkSize := mtu - FRAME_HEADER_SIZE - FRAGMENT_HEADER_SIZE
+	if chunkSize <= 0 {
+		return nil, errors.New("mtu is too small")
+	}
+	count := (len(data) + chunkSize - 1) / chunkSize
+	if count > MAX_FRAGMENTS {
+		return nil, errors.New("too many fragments")
+	}
+	frames := make([][]byte, 0, count)
+	payload := make([]byte, FRAGMENT_HEADER_SIZE+chunkSize)
+	for i := 0; i < count; i++ {
+		chunk := data[i*chunkSize:]
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		binary.BigEndian.PutUint32(payload[0:4], fragId)
+		binary.BigEndian.PutUint16(payload[4:6], uint16(i))
+		binary.BigEndian.PutUint16(payload[6:8], uint16(count))
+		payload[8] = t
+		n := copy(payload[FRAGMENT_HEADER_SIZE:], chunk)
+		frames = append(frames, EncodeFrame(DATA_FRAGMENT, id, payload[:FRAGMENT_HEADER_SIZE+n]))
+	}
+	return frames, nil
+}
+
+type fragmentKey struct {
+	source string
+	id     uint32
+	fragId uint32
+}
+
+type fragmentBuffer struct {
+	t        byte
+	chunks   [][]byte
+	received int
+	deadline time.Time
+}
+
+// Reassembler collects DATA_FRAGMENT payloads until the original frame is complete.
+// Incomplete frames are dropped after Timeout.
+type Reassembler struct {
+	Timeout   time.Duration
+	mutex     sync.Mutex
+	pending   map[fragmentKey]*fragmentBuffer
+	lastSweep time.Time
+}
+
+func (r *Reassembler) timeout() time.Duration {
+	if r.Timeout <= 0 {
+		return FRAGMENT_TIMEOUT
+	}
+	return r.Timeout
+}
+
+// Add stores one fragment received from source for session id. When the last
+// missing fragment arrives it returns the original frame type and data with ok set.
+func (r *Reassembler) Add(source string, id uint32, payload []byte) (t byte, data []byte, ok bool, err error) {
+	if len(payload) < FRAGMENT_HEADER_SIZE {
+		err = errors.New("bad fragment")
+		return
+	}
+	fragId := binary.BigEndian.Uint32(payload[0:4])
+	index := int(binary.BigEndian.Uint16(payload[4:6]))
+	count := int(binary.BigEndian.Uint16(payload[6:8]))
+	if count == 0 || count > MAX_FRAGMENTS || index >= count {
+		err = errors.New("bad fragment")
+		return
+	}
+	now := time.Now()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.pending == nil {
+		r.pending = make(map[fragmentKey]*fragmentBuffer)
+	}
+	r.sweep(now)
+	key := fragmentKey{source, id, fragId}
+	buf, exists := r.pending[key]
+	if !exists {
+		if len(r.pending) >= MAX_PENDING_PACKETS {
+			err = errors.New("too many pending fragmented frames")
+			return
+		}
+		buf = &fragmentBuffer{t: payload[8], chunks: make([][]byte, count), deadline: now.Add(r.timeout())}
+		r.pending[key] = buf
+	}
+	if len(buf.chunks) != count {
+		delete(r.pending, key)
+		err = errors.New("inconsistent fragment count")
+		return
+	}
+	if buf.chunks[index] != nil {
+		return
+	}
+	buf.chunks[index] = append([]byte(nil), payload[FRAGMENT_HEADER_SIZE:]...)
+	buf.received++
+	if buf.received < count {
+		return
+	}
+	delete(r.pending, key)
+	var size int
+	for _, c := range buf.chunks {
+		size += len(c)
+	}
+	data = make([]byte, 0, size)
+	for _, c := range buf.chunks {
+		data = append(data, c...)
+	}
+	return buf.t, data, true, nil
+}
+
+func (r *Reassembler) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < r.timeout()/2 {
+		return
+	}
+	r.lastSweep = now
+	for key, buf := range r.pending {
+		if now.After(buf.deadline) {
+			delete(r.pending, key)
+		}
+	}
+}
+
+// Pending returns the number of incomplete frames being held.
+func (r *Reassembler) Pending() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.pending)
+}
@@ -0,0 +1,47 @@
+package protocol
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func Test_fragment(t *testing.T) {
+	data := make([]byte, 64*1024)
+	rand.Read(data)
+	frames, err := EncodeFrames(DATA, 7, data, 1400, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := Reassembler{}
+	rand.Shuffle(len(frames), func(i, j int) { frames[i], frames[j] = frames[j], frames[i] })
+	for i, frame := range frames {
+		if len(frame) > 1400 {
+			t.Fatalf("frame %d is %d bytes", i, len(frame))
+		}
+		ft, id, payload, err := ParseFrame(frame)
+		if err != nil || ft != DATA_FRAGMENT || id != 7 {
+			t.Fatalf("bad fragment frame %v %v %v", ft, id, err)
+		}
+		tp, result, ok, err := r.Add("peer", id, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != (i == len(frames)-1) {
+			t.Fatalf("unexpected completion at fragment %d", i)
+		}
+		if ok && (tp != DATA || !bytes.Equal(result, data)) {
+			t.Fatal("reassembled data mismatch")
+		}
+	}
+	if r.Pending() != 0 {
+		t.Fatal("pending fragments left")
+	}
+}
+
+func Test_smallFrameNotFragmented(t *testing.T) {
+	frames, _ := EncodeFrames(DATA, 1, []byte("hello"), 1400, 1)
+	if len(frames) != 1 || frames[0][len(HEAD)] != DATA {
+		t.Fatal("small frame should not be fragmented")
+	}
+}
@@ -17,6 +17,13 @@ const (
 	DATA
 	KEEP_ALIVE
 	MAINTAIN_UDP_CLIENT_ADDR
+	DATA_FRAGMENT
+	REGISTER_TUNNEL
+	TUNNEL_REGISTERED
+	HEALTH_STATUS
+	PORT_DATA
+	LINK_AUTH
+	REQUEST_UDP_CLIENT_ADDR
 )
 
 /*
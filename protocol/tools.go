@@ -43,7 +43,9 @@ func BytesFormat(bytes int64) string {
 		return fmt.Sprintf("%d B", bytes)
 	} else if bytes < 1024*1024 {
 		return fmt.Sprintf("%.2f KB", float32(bytes)/1024.0)
-	} else {
+	} else if bytes < 1024*1024*1024 {
 		return fmt.Sprintf("%.2f MB", float32(bytes)/1024.0/1024.0)
+	} else {
+		return fmt.Sprintf("%.2f GB", float32(bytes)/1024.0/1024.0/1024.0)
 	}
 }
@@ -1,10 +1,16 @@
 package tools
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -15,82 +21,264 @@ const (
 	SILENT
 )
 
+const (
+	FORMAT_TEXT = "text"
+	FORMAT_JSON = "json"
+)
+
 var (
-	LoggerOut   = os.Stdout
-	Level       = INFO
-	debugLogger *log.Logger
-	infoLogger  *log.Logger
-	warnLogger  *log.Logger
-	errorLogger *log.Logger
+	// LoggerOut receives the log lines, change it with SetLogOutput or SetLogWriter
+	LoggerOut   io.Writer = os.Stdout
+	Level                 = INFO
+	Format                = FORMAT_TEXT
+	debugLogger           = log.New(output{}, "[DEBUG] ", log.Ldate|log.Ltime)
+	infoLogger            = log.New(output{}, "[INFO] ", log.Ldate|log.Ltime)
+	warnLogger            = log.New(output{}, "[WARN] ", log.Ldate|log.Ltime)
+	errorLogger           = log.New(output{}, "[ERROR] ", log.Ldate|log.Ltime)
+
+	levelNames  = []string{"debug", "info", "warn", "error", "silent"}
+	overrides   atomic.Value
+	outputMutex sync.Mutex
 )
 
+// output writes to the current LoggerOut, so that the loggers follow its changes
+type output struct{}
+
+func (output) Write(p []byte) (int, error) {
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+	return LoggerOut.Write(p)
+}
+
+// levelOverrides are the levels of some services and tunnels, which take
+// precedence over Level. A tunnel level wins over the level of its service.
+type levelOverrides struct {
+	services map[string]int
+	tunnels  map[string]int
+}
+
+// Logger writes the lines of a service, Name is the tunnel or component it
+// belongs to. Session returns a Logger that also tags its lines with a session.
 type Logger struct {
 	Service string
 	Name    string
+
+	session    uint32
+	hasSession bool
+	peer       any
+}
+
+type jsonLine struct {
+	Ts      string  `json:"ts"`
+	Level   string  `json:"level"`
+	Service string  `json:"service"`
+	Tunnel  string  `json:"tunnel,omitempty"`
+	Session *uint32 `json:"session,omitempty"`
+	Peer    string  `json:"peer,omitempty"`
+	Msg     string  `json:"msg"`
 }
 
+// SetLogOutput appends the log to the file at path, or writes it to the
+// standard output when path is empty
 func SetLogOutput(path string) {
+	if err := SetRotatedLogOutput(path, Rotation{}); err != nil {
+		panic(fmt.Errorf("failed set log output file : %v", err))
+	}
+}
+
+// SetRotatedLogOutput appends the log to the file at path and rotates it as
+// rotation says, an empty path is the standard output
+func SetRotatedLogOutput(path string, rotation Rotation) error {
 	if path == "" {
-		LoggerOut = os.Stdout
-	} else {
-		file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			panic(fmt.Errorf("failed set log output file : %v", err))
+		SetLogWriter(os.Stdout)
+		return nil
+	}
+	file, err := openRotatingFile(path, rotation)
+	if err != nil {
+		return err
+	}
+	SetLogWriter(file)
+	return nil
+}
+
+// SetLogWriter sends the log to w, closing the log file opened before
+func SetLogWriter(w io.Writer) {
+	outputMutex.Lock()
+	previous := LoggerOut
+	LoggerOut = w
+	outputMutex.Unlock()
+	if f, ok := previous.(*rotatingFile); ok {
+		_ = f.Close()
+	}
+}
+
+// ReopenLogOutput opens the log file again, for tools such as logrotate that
+// move it away. It does nothing when the log goes elsewhere.
+func ReopenLogOutput() error {
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+	if f, ok := LoggerOut.(*rotatingFile); ok {
+		return f.Reopen()
+	}
+	return nil
+}
+
+func parseLevel(s string) (int, error) {
+	for level, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return level, nil
 		}
-		LoggerOut = file
 	}
+	return 0, fmt.Errorf("unknown log level: '%v'", s)
 }
 
 func SetLevelStr(s string) {
 	if s == "" {
 		return
 	}
+	level, err := parseLevel(s)
+	if err != nil || level == SILENT {
+		panic(fmt.Errorf("unknown log level: '%v'", s))
+	}
+	Level = level
+}
+
+// SetFormatStr selects the text or json format of the log lines
+func SetFormatStr(s string) {
 	switch {
-	case strings.EqualFold(s, "debug"):
-		Level = DEBUG
-	case strings.EqualFold(s, "info"):
-		Level = INFO
-	case strings.EqualFold(s, "warn"):
-		Level = WARN
-	case strings.EqualFold(s, "error"):
-		Level = ERROR
+	case s == "":
+	case strings.EqualFold(s, FORMAT_TEXT):
+		Format = FORMAT_TEXT
+	case strings.EqualFold(s, FORMAT_JSON):
+		Format = FORMAT_JSON
 	default:
-		panic(fmt.Errorf("unknown log level: '%v'", s))
+		panic(fmt.Errorf("unknown log format: '%v'", s))
 	}
 }
 
-func (l *Logger) Debug(f string, args ...any) {
-	if debugLogger == nil {
-		debugLogger = log.New(LoggerOut, "[DEBUG] ", log.Ldate|log.Ltime)
+// SetLevels sets the levels of some tunnels and services from a comma
+// separated list such as "tunnel:sunshine=debug,service:UdpServer=warn".
+// A tunnel is matched by the Name of its loggers. The list replaces the
+// levels set before, and may be changed while logging.
+func SetLevels(spec string) error {
+	next := levelOverrides{services: make(map[string]int), tunnels: make(map[string]int)}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return fmt.Errorf("log level %q is not key=level", item)
+		}
+		level, err := parseLevel(strings.TrimSpace(value))
+		if err != nil {
+			return err
+		}
+		kind, name, _ := strings.Cut(strings.TrimSpace(key), ":")
+		switch kind {
+		case "tunnel":
+			next.tunnels[name] = level
+		case "service":
+			next.services[name] = level
+		default:
+			return fmt.Errorf("log level %q applies to neither a tunnel: nor a service:", item)
+		}
+	}
+	overrides.Store(next)
+	return nil
+}
+
+// Session returns a copy of the logger that tags its lines with session id and
+// peer, which is only formatted when a line is written
+func (l Logger) Session(id uint32, peer any) Logger {
+	l.session, l.hasSession, l.peer = id, true, peer
+	return l
+}
+
+// Enabled reports whether lines of level are written, so that callers may
+// skip preparing them
+func (l Logger) Enabled(level int) bool {
+	threshold := Level
+	if o, ok := overrides.Load().(levelOverrides); ok {
+		if v, ok := o.tunnels[l.Name]; ok {
+			threshold = v
+		} else if v, ok := o.services[l.Service]; ok {
+			threshold = v
+		}
+	}
+	return threshold <= level
+}
+
+// prefix names the service, the tunnel and the session of a text line
+func (l Logger) prefix() string {
+	if l.hasSession {
+		return fmt.Sprintf("[%s %s session %d]", l.Service, l.Name, l.session)
+	}
+	return "[" + l.Service + " " + l.Name + "]"
+}
+
+func (l Logger) writeJson(level int, msg string) {
+	line := jsonLine{
+		Ts:      time.Now().Format(time.RFC3339Nano),
+		Level:   levelNames[level],
+		Service: l.Service,
+		Tunnel:  l.Name,
+		Msg:     msg,
 	}
-	if Level <= DEBUG {
-		debugLogger.Printf("[%s %s] %s", l.Service, l.Name, fmt.Sprintf(f, args...))
+	if l.hasSession {
+		line.Session = &l.session
 	}
+	if l.peer != nil {
+		line.Peer = fmt.Sprint(l.peer)
+	}
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	_ = encoder.Encode(line)
+	_, _ = output{}.Write(b.Bytes())
 }
 
-func (l *Logger) Info(f string, args ...any) {
-	if infoLogger == nil {
-		infoLogger = log.New(LoggerOut, "[INFO] ", log.Ldate|log.Ltime)
+func (l Logger) Debug(f string, args ...any) {
+	if !l.Enabled(DEBUG) {
+		return
 	}
-	if Level <= INFO {
-		infoLogger.Printf("[%s %s] %s", l.Service, l.Name, fmt.Sprintf(f, args...))
+	if Format == FORMAT_JSON {
+		l.writeJson(DEBUG, fmt.Sprintf(f, args...))
+		return
 	}
+	debugLogger.Printf("%s %s", l.prefix(), fmt.Sprintf(f, args...))
 }
 
-func (l *Logger) Warn(f string, args ...any) {
-	if warnLogger == nil {
-		warnLogger = log.New(LoggerOut, "[WARN] ", log.Ldate|log.Ltime)
+func (l Logger) Info(f string, args ...any) {
+	if !l.Enabled(INFO) {
+		return
 	}
-	if Level <= WARN {
-		warnLogger.Printf("[%s %s] %s", l.Service, l.Name, fmt.Sprintf(f, args...))
+	if Format == FORMAT_JSON {
+		l.writeJson(INFO, fmt.Sprintf(f, args...))
+		return
 	}
+	infoLogger.Printf("%s %s", l.prefix(), fmt.Sprintf(f, args...))
 }
 
-func (l *Logger) Error(f string, args ...any) {
-	if errorLogger == nil {
-		errorLogger = log.New(LoggerOut, "[ERROR] ", log.Ldate|log.Ltime)
+func (l Logger) Warn(f string, args ...any) {
+	if !l.Enabled(WARN) {
+		return
 	}
-	if Level <= ERROR {
-		errorLogger.Printf("[%s %s] %s", l.Service, l.Name, fmt.Sprintf(f, args...))
+	if Format == FORMAT_JSON {
+		l.writeJson(WARN, fmt.Sprintf(f, args...))
+		return
+	}
+	warnLogger.Printf("%s %s", l.prefix(), fmt.Sprintf(f, args...))
+}
+
+func (l Logger) Error(f string, args ...any) {
+	if !l.Enabled(ERROR) {
+		return
+	}
+	if Format == FORMAT_JSON {
+		l.writeJson(ERROR, fmt.Sprintf(f, args...))
+		return
 	}
+	errorLogger.Printf("%s %s", l.prefix(), fmt.Sprintf(f, args...))
 }
@@ -0,0 +1,99 @@
+package tools
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+// captureLog sends the log to a buffer with format and level until the test ends
+func captureLog(t *testing.T, format string, level int) *bytes.Buffer {
+	var b bytes.Buffer
+	SetLogWriter(&b)
+	Format, Level = format, level
+	t.Cleanup(func() {
+		SetLogWriter(os.Stdout)
+		Format, Level = FORMAT_TEXT, INFO
+		_ = SetLevels("")
+	})
+	return &b
+}
+
+func Test_loggerJson(t *testing.T) {
+	b := captureLog(t, FORMAT_JSON, INFO)
+	logger := Logger{Service: "UdpServer", Name: "sunshine"}
+	logger.Info("listening on %v", ":47998")
+	logger.Session(7, "10.0.0.1:5000").Warn("over its limit")
+	logger.Debug("not written")
+	var lines []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		var fields map[string]any
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			t.Fatalf("%q : %v", line, err)
+		}
+		lines = append(lines, fields)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("wrote %d lines, want 2 : %s", len(lines), b)
+	}
+	want := []map[string]any{
+		{"level": "info", "service": "UdpServer", "tunnel": "sunshine", "msg": "listening on :47998"},
+		{"level": "warn", "service": "UdpServer", "tunnel": "sunshine", "session": float64(7), "peer": "10.0.0.1:5000", "msg": "over its limit"},
+	}
+	for i, fields := range lines {
+		if _, ok := fields["ts"]; !ok {
+			t.Errorf("line %d has no ts", i)
+		}
+		delete(fields, "ts")
+		if len(fields) != len(want[i]) {
+			t.Errorf("line %d: fields %v, want %v", i, fields, want[i])
+		}
+		for key, value := range want[i] {
+			if fields[key] != value {
+				t.Errorf("line %d: %s = %v, want %v", i, key, fields[key], value)
+			}
+		}
+	}
+}
+
+func Test_loggerText(t *testing.T) {
+	b := captureLog(t, FORMAT_TEXT, INFO)
+	Logger{Service: "TcpServer", Name: "web"}.Session(3, nil).Info("created")
+	if line := b.String(); !strings.HasPrefix(line, "[INFO] ") || !strings.HasSuffix(line, " [TcpServer web session 3] created\n") {
+		t.Errorf("wrote %q", line)
+	}
+}
+
+func Test_SetLevels(t *testing.T) {
+	captureLog(t, FORMAT_TEXT, INFO)
+	if err := SetLevels("tunnel:sunshine=debug, service:UdpServer=warn"); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		logger Logger
+		level  int
+		ok     bool
+	}{
+		{Logger{Service: "UdpServer", Name: "sunshine"}, DEBUG, true},
+		{Logger{Service: "UdpServer", Name: "dns"}, INFO, false},
+		{Logger{Service: "UdpServer", Name: "dns"}, WARN, true},
+		{Logger{Service: "TcpServer", Name: "web"}, DEBUG, false},
+		{Logger{Service: "TcpServer", Name: "web"}, INFO, true},
+	}
+	for _, c := range cases {
+		if ok := c.logger.Enabled(c.level); ok != c.ok {
+			t.Errorf("%s %s: level %s enabled = %v", c.logger.Service, c.logger.Name, levelNames[c.level], ok)
+		}
+	}
+	for _, spec := range []string{"sunshine=debug", "tunnel:sunshine", "host:a=info", "tunnel:a=loud"} {
+		if err := SetLevels(spec); err == nil {
+			t.Errorf("%q accepted", spec)
+		}
+	}
+	// a rejected list keeps the levels before it
+	if !(Logger{Service: "UdpServer", Name: "sunshine"}).Enabled(DEBUG) {
+		t.Error("levels lost after a rejected list")
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+
+package tools
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// ReopenLogOnSignal reopens the log file whenever the process receives SIGUSR1
+func ReopenLogOnSignal() {
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	go func() {
+		for range usr1 {
+			if err := ReopenLogOutput(); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to reopen the log file : %v\n", err)
+			}
+		}
+	}()
+}
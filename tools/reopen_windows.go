@@ -0,0 +1,4 @@
+package tools
+
+// ReopenLogOnSignal does nothing, Windows has no SIGUSR1
+func ReopenLogOnSignal() {}
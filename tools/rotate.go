@@ -0,0 +1,309 @@
+package tools
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ROTATED_SUFFIX = "2006-01-02T15-04-05"
+)
+
+// Rotation controls when a log file is rotated. The file is renamed with the
+// time of the rotation appended, such as "ezturp.log.2026-10-19T00-00-00",
+// and a new one is started.
+type Rotation struct {
+	MaxSize  int64 // rotate before the file grows past MaxSize bytes, 0 never does
+	Daily    bool  // rotate when the first line of a new day is written
+	Keep     int   // rotated files kept, the oldest are removed, 0 keeps all
+	Compress bool  // gzip the rotated files
+}
+
+// ParseRotation reads a comma separated list such as "size=100MB,daily,keep=7,gzip"
+func ParseRotation(spec string) (Rotation, error) {
+	var r Rotation
+	for _, item := range strings.Split(spec, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(item), "=")
+		var err error
+		switch key {
+		case "":
+		case "size":
+			r.MaxSize, err = ParseSize(value)
+		case "daily":
+			r.Daily = true
+		case "keep":
+			r.Keep, err = strconv.Atoi(value)
+			if err == nil && r.Keep < 0 {
+				err = fmt.Errorf("keep=%v is negative", r.Keep)
+			}
+		case "gzip":
+			r.Compress = true
+		default:
+			err = fmt.Errorf("unknown log rotation option %q", item)
+		}
+		if err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+// rotatingFile is a log file that rotates itself. Rotated files are
+// compressed and pruned in the background, one rotation at a time.
+type rotatingFile struct {
+	mutex    sync.Mutex
+	path     string
+	rotation Rotation
+	file     *os.File
+	size     int64
+	day      string
+	pending  string // the rotated file still written to while path fails to open
+	closed   bool
+	last     string // the time of the last rotation
+	count    int    // the counter of the last rotation within its second
+	cleanup  sync.Mutex
+}
+
+func openRotatingFile(path string, rotation Rotation) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, rotation: rotation}
+	if err := f.open(path); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// rename is replaced by tests
+var rename = os.Rename
+
+// open opens the file at name for appending, the day of a file that already
+// exists is the day it was last written
+func (f *rotatingFile) open(name string) error {
+	file, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	f.day = time.Now().Format("2006-01-02")
+	if f.size > 0 {
+		f.day = info.ModTime().Format("2006-01-02")
+	}
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	now := time.Now()
+	day := now.Format("2006-01-02")
+	daily := f.rotation.Daily && day != f.day
+	switch {
+	case f.pending != "" || f.file == nil:
+		_ = f.reopen()
+	case f.size > 0 && (daily || (f.rotation.MaxSize > 0 && f.size+int64(len(p)) > f.rotation.MaxSize)):
+		if daily {
+			// the file holds the lines of f.day, name it after its last second
+			if t, err := time.ParseInLocation("2006-01-02", f.day, time.Local); err == nil {
+				now = t.AddDate(0, 0, 1).Add(-time.Second)
+			}
+		}
+		if err := f.rotate(now); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to rotate log file %v : %v\n", f.path, err)
+		}
+	}
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	f.day = day
+	return n, err
+}
+
+// rotate renames the file with the time stamp and starts a new one while the
+// caller holds the mutex. The file is closed first, Windows cannot rename an
+// open file. The renamed file is written to until path opens.
+func (f *rotatingFile) rotate(stamp time.Time) error {
+	suffix, n := stamp.Format(ROTATED_SUFFIX), 0
+	if suffix == f.last {
+		// older files of this second may be pruned already, count on after them
+		n = f.count + 1
+	}
+	name := rotatedName(f.path, suffix, n)
+	for exists(name) || exists(name+".gz") {
+		n++
+		name = rotatedName(f.path, suffix, n)
+	}
+	_ = f.file.Close()
+	f.file = nil
+	if err := rename(f.path, name); err != nil {
+		// keep writing to path, the next write past the limit tries again
+		_ = f.open(f.path)
+		return err
+	}
+	f.last, f.count = suffix, n
+	f.pending = name
+	return f.reopen()
+}
+
+// rotatedName is the name of the nth file rotated within the second of suffix
+func rotatedName(path, suffix string, n int) string {
+	if n == 0 {
+		return path + "." + suffix
+	}
+	return fmt.Sprintf("%s.%s-%d", path, suffix, n)
+}
+
+// reopen opens path in place of the file it was rotated to, which is then
+// compressed and pruned. The rotated file is written to when path fails to open.
+func (f *rotatingFile) reopen() error {
+	old := f.file
+	if err := f.open(f.path); err != nil {
+		if old == nil && f.pending != "" {
+			_ = f.open(f.pending)
+		}
+		return err
+	}
+	if old != nil {
+		_ = old.Close()
+	}
+	if f.pending != "" {
+		go f.clean(f.pending)
+		f.pending = ""
+	}
+	return nil
+}
+
+// Reopen closes the file and opens path again, after an external tool moved it away
+func (f *rotatingFile) Reopen() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	return f.reopen()
+}
+
+func (f *rotatingFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// clean compresses the file rotated to name, then removes the oldest rotated
+// files beyond the retention count
+func (f *rotatingFile) clean(name string) {
+	f.cleanup.Lock()
+	defer f.cleanup.Unlock()
+	if f.rotation.Compress {
+		// a later rotation may have pruned it already
+		if err := compress(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "failed to compress log file %v : %v\n", name, err)
+		}
+	}
+	if f.rotation.Keep <= 0 {
+		return
+	}
+	rotated := f.rotated()
+	for len(rotated) > f.rotation.Keep {
+		_ = os.Remove(rotated[0])
+		rotated = rotated[1:]
+	}
+}
+
+// rotated lists the rotated files of path, oldest first. Files rotated within
+// the same second are ordered by the counter after their time.
+func (f *rotatingFile) rotated() []string {
+	matches, _ := filepath.Glob(f.path + ".*")
+	type file struct {
+		name  string
+		stamp string
+		n     int
+	}
+	var files []file
+	for _, m := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(m, f.path+"."), ".gz")
+		if len(suffix) < len(ROTATED_SUFFIX) {
+			continue
+		}
+		stamp, counter := suffix[:len(ROTATED_SUFFIX)], suffix[len(ROTATED_SUFFIX):]
+		if _, err := time.Parse(ROTATED_SUFFIX, stamp); err != nil {
+			continue
+		}
+		n := 0
+		if counter != "" {
+			number, ok := strings.CutPrefix(counter, "-")
+			var err error
+			if n, err = strconv.Atoi(number); !ok || err != nil {
+				continue
+			}
+		}
+		files = append(files, file{m, stamp, n})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].stamp != files[j].stamp {
+			return files[i].stamp < files[j].stamp
+		}
+		return files[i].n < files[j].n
+	})
+	rotated := make([]string, len(files))
+	for i, file := range files {
+		rotated[i] = file.name
+	}
+	return rotated
+}
+
+func compress(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w := gzip.NewWriter(out)
+	_, err = io.Copy(w, in)
+	if err == nil {
+		err = w.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(name + ".gz")
+		return err
+	}
+	return os.Remove(name)
+}
+
+func exists(name string) bool {
+	_, err := os.Lstat(name)
+	return err == nil
+}
@@ -0,0 +1,203 @@
+package tools
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_ParseRotation(t *testing.T) {
+	cases := []struct {
+		spec     string
+		rotation Rotation
+		ok       bool
+	}{
+		{"", Rotation{}, true},
+		{"size=100MB,daily,keep=7,gzip", Rotation{MaxSize: 100 << 20, Daily: true, Keep: 7, Compress: true}, true},
+		{" daily , keep=0 ", Rotation{Daily: true}, true},
+		{"keep=-1", Rotation{}, false},
+		{"size=big", Rotation{}, false},
+		{"hourly", Rotation{}, false},
+	}
+	for _, c := range cases {
+		rotation, err := ParseRotation(c.spec)
+		if (err == nil) != c.ok || (c.ok && rotation != c.rotation) {
+			t.Errorf("%q: got %+v , %v", c.spec, rotation, err)
+		}
+	}
+}
+
+// waitRotated waits for the background cleanup to leave keep rotated files
+func waitRotated(t *testing.T, f *rotatingFile, keep int) []string {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		f.cleanup.Lock()
+		rotated := f.rotated()
+		f.cleanup.Unlock()
+		if len(rotated) == keep || time.Now().After(deadline) {
+			return rotated
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_rotateAndPrune(t *testing.T) {
+	cases := []struct {
+		name     string
+		rotation Rotation
+		lines    int
+		kept     int
+	}{
+		{"keeps all", Rotation{MaxSize: 100}, 10, 4},
+		{"prunes the oldest", Rotation{MaxSize: 100, Keep: 2}, 24, 2},
+		{"prunes compressed files", Rotation{MaxSize: 100, Keep: 3, Compress: true}, 24, 3},
+	}
+	for _, c := range cases {
+		path := filepath.Join(t.TempDir(), "ezturp.log")
+		f, err := openRotatingFile(path, c.rotation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// two lines of 40 bytes fit in a file, the third one rotates it
+		for i := 0; i < c.lines; i++ {
+			if _, err := fmt.Fprintf(f, "%-39d\n", i); err != nil {
+				t.Fatal(err)
+			}
+		}
+		rotated := waitRotated(t, f, c.kept)
+		_ = f.Close()
+		if len(rotated) != c.kept {
+			t.Fatalf("%s: %d rotated files, want %d : %v", c.name, len(rotated), c.kept, rotated)
+		}
+		if info, _ := os.Stat(path); info.Size() > c.rotation.MaxSize {
+			t.Errorf("%s: current file grew to %d bytes", c.name, info.Size())
+		}
+		for _, name := range rotated {
+			if strings.HasSuffix(name, ".gz") != c.rotation.Compress {
+				t.Errorf("%s: %v compressed = %v", c.name, name, !c.rotation.Compress)
+			}
+		}
+		// the newest rotated file holds the two lines before the current file
+		if !c.rotation.Compress {
+			p, _ := os.ReadFile(rotated[len(rotated)-1])
+			if want := fmt.Sprintf("%-39d\n%-39d\n", c.lines-4, c.lines-3); string(p) != want {
+				t.Errorf("%s: newest rotated file holds %q, want %q", c.name, p, want)
+			}
+		}
+	}
+}
+
+func Test_rotateDaily(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ezturp.log")
+	f, err := openRotatingFile(path, Rotation{Daily: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte("yesterday\n")); err != nil {
+		t.Fatal(err)
+	}
+	f.day = "2026-10-18"
+	if _, err := f.Write([]byte("today\n")); err != nil {
+		t.Fatal(err)
+	}
+	rotated := waitRotated(t, f, 1)
+	if want := []string{path + ".2026-10-18T23-59-59"}; !reflect.DeepEqual(rotated, want) {
+		t.Fatalf("rotated %v, want %v", rotated, want)
+	}
+	if p, _ := os.ReadFile(rotated[0]); string(p) != "yesterday\n" {
+		t.Errorf("rotated file holds %q", p)
+	}
+}
+
+func Test_rotateReopenFails(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ezturp.log")
+	f, err := openRotatingFile(path, Rotation{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// the file was rotated but path cannot be opened again yet
+	if err := os.Rename(path, path+".2026-10-18T23-59-59"); err != nil {
+		t.Fatal(err)
+	}
+	f.pending = path + ".2026-10-18T23-59-59"
+	f.path = filepath.Join(dir, "missing", "ezturp.log")
+	if _, err := f.Write([]byte("kept\n")); err != nil {
+		t.Fatalf("write while the new file fails to open : %v", err)
+	}
+	if f.pending == "" {
+		t.Fatal("pending rotation forgotten")
+	}
+	f.path = path
+	if _, err := f.Write([]byte("reopened\n")); err != nil {
+		t.Fatal(err)
+	}
+	if f.pending != "" {
+		t.Fatal("pending rotation left after the new file opened")
+	}
+	if p, _ := os.ReadFile(path + ".2026-10-18T23-59-59"); string(p) != "kept\n" {
+		t.Errorf("rotated file holds %q", p)
+	}
+	if p, _ := os.ReadFile(path); string(p) != "reopened\n" {
+		t.Errorf("new file holds %q", p)
+	}
+}
+
+func Test_rotateClosesFirst(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ezturp.log")
+	f, err := openRotatingFile(path, Rotation{MaxSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	defer func() { rename = os.Rename }()
+	// rename fails like it does on Windows while the file is open
+	var current *os.File
+	renamed := 0
+	rename = func(from, to string) error {
+		if _, err := current.Stat(); err == nil {
+			return fmt.Errorf("%v is still open", from)
+		}
+		renamed++
+		return os.Rename(from, to)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		current = f.file
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if renamed != 2 {
+		t.Errorf("renamed %d times, want 2", renamed)
+	}
+	if p, _ := os.ReadFile(path); string(p) != "third\n" {
+		t.Errorf("current file holds %q", p)
+	}
+}
+
+func Test_rotateRenameFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ezturp.log")
+	f, err := openRotatingFile(path, Rotation{MaxSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	defer func() { rename = os.Rename }()
+	rename = func(from, to string) error {
+		return fmt.Errorf("%v is in use", from)
+	}
+	for _, line := range []string{"first\n", "second\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if p, _ := os.ReadFile(path); string(p) != "first\nsecond\n" {
+		t.Errorf("file holds %q after a failed rotation", p)
+	}
+}
@@ -0,0 +1,30 @@
+package tools
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var byteUnits = []struct {
+	suffix string
+	size   float64
+}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1}}
+
+// ParseSize reads a size in bytes such as "512KB" or "1.5MB" with an optional
+// K, KB, M, MB, G or GB unit, units are powers of 1024
+func ParseSize(s string) (int64, error) {
+	upper := strings.ToUpper(strings.TrimSpace(s))
+	unit := 1.0
+	for _, u := range byteUnits {
+		if number, ok := strings.CutSuffix(upper, u.suffix); ok {
+			upper, unit = strings.TrimSpace(number), u.size
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(upper, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(v * unit), nil
+}
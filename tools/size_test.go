@@ -0,0 +1,31 @@
+package tools
+
+import "testing"
+
+func Test_ParseSize(t *testing.T) {
+	cases := []struct {
+		s    string
+		size int64
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"512", 512, true},
+		{"512B", 512, true},
+		{"1K", 1 << 10, true},
+		{"1kb", 1 << 10, true},
+		{"1.5MB", 3 << 19, true},
+		{" 100 MB ", 100 << 20, true},
+		{"2G", 2 << 30, true},
+		{"", 0, false},
+		{"MB", 0, false},
+		{"-1MB", 0, false},
+		{"10TB", 0, false},
+		{"ten", 0, false},
+	}
+	for _, c := range cases {
+		size, err := ParseSize(c.s)
+		if (err == nil) != c.ok || size != c.size {
+			t.Errorf("%q: got %d , %v, want %d", c.s, size, err, c.size)
+		}
+	}
+}